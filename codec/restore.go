@@ -0,0 +1,90 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// FieldTypes 返回结构体中按 tag 命名的字段的类型，多个结构体中同名的字段以前面的为准
+func FieldTypes(tag string, structs ...interface{}) map[string]reflect.Type {
+	types := make(map[string]reflect.Type)
+	for _, s := range structs {
+		t := reflect.TypeOf(s)
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		for i := 0; i < t.NumField(); i++ {
+			name := t.Field(i).Tag.Get(tag)
+			if _, ok := types[name]; name == "" || ok {
+				continue
+			}
+			types[name] = t.Field(i).Type
+		}
+	}
+	return types
+}
+
+// Restore 将 JSON 解析得到的事件还原为 structTagDecoder 输出的类型，是 Decode 的逆过程：
+// types 中的时间字段按 RFC3339 解析为 time.Time，数值字段转换为对应的整数类型，
+// 其他 json.Number 转换为 int64，有小数时为 float64，转换失败时返回错误
+func Restore(event map[string]interface{}, types map[string]reflect.Type) error {
+	for k, v := range event {
+		t, ok := types[k]
+		if !ok {
+			if n, ok := v.(json.Number); ok {
+				event[k] = numberOf(n)
+			}
+			continue
+		}
+		restored, err := restore(v, t)
+		if err != nil {
+			return fmt.Errorf("field %s: %v", k, err)
+		}
+		event[k] = restored
+	}
+	return nil
+}
+
+func restore(v interface{}, t reflect.Type) (interface{}, error) {
+	if t == timeType {
+		switch s := v.(type) {
+		case time.Time:
+			return s, nil
+		case string:
+			return time.Parse(time.RFC3339Nano, s)
+		}
+		return nil, fmt.Errorf("invalid time (%v)", v)
+	}
+	var n reflect.Value
+	switch s := v.(type) {
+	case json.Number:
+		n = reflect.ValueOf(numberOf(s))
+	case float64, int64, int:
+		n = reflect.ValueOf(s)
+	default:
+		rv := reflect.ValueOf(v)
+		if !rv.IsValid() || !rv.Type().ConvertibleTo(t) {
+			return nil, fmt.Errorf("invalid %s (%v)", t, v)
+		}
+		return rv.Convert(t).Interface(), nil
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return n.Convert(t).Interface(), nil
+	}
+	return nil, fmt.Errorf("invalid %s (%v)", t, v)
+}
+
+func numberOf(n json.Number) interface{} {
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	f, _ := n.Float64()
+	return f
+}
@@ -132,6 +132,14 @@ func (h *fileHandler) UploadedRecordCount(filename string) (int64, error) {
 	return v, nil
 }
 
+func (h *fileHandler) ResetFile(filename string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.content.UploadProgress, filename)
+	delete(h.content.UploadedFile, filename)
+	return nil
+}
+
 func (h *fileHandler) Stop() {
 	h.exitSignal <- struct{}{}
 	h.flushToFile()
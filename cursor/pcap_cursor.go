@@ -9,6 +9,8 @@ type PcapCursor interface {
 	MarkFileAsUploaded(filename string) error
 	IsFileUploaded(filename string) (bool, error)
 	UploadedRecordCount(filename string) (int64, error)
+	// ResetFile 删除文件的上传进度，之后以同一文件名创建的文件从头上传
+	ResetFile(filename string) error
 	Stop()
 }
 
@@ -135,5 +135,11 @@ func (h *sqliteHandler) UploadedRecordCount(filename string) (int64, error) {
 	return count, nil
 }
 
+func (h *sqliteHandler) ResetFile(filename string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.db.Where("file = ?", filename).Delete(&uploadProgress{}).Error
+}
+
 func (h *sqliteHandler) Stop() {
 }
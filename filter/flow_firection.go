@@ -35,8 +35,20 @@ func newFlowDirectionFilter(config map[interface{}]interface{}) topology.Filter
 	} else {
 		log.Fatal("service_public_ip must be set in flow direction filter plugin")
 	}
-	plugin.srcIPVR = value_render.GetValueRender2("src_ip")
-	plugin.dstIPVR = value_render.GetValueRender2("dst_ip")
+	// 隧道流量可以配置为 inner_src_ip 和 inner_dst_ip，按内层 IP 判断方向
+	srcField, dstField := "src_ip", "dst_ip"
+	if field, ok := config["src_ip_field"]; ok {
+		if srcField, ok = field.(string); !ok {
+			log.Fatal("wrong config of src_ip_field in flow direction filter plugin")
+		}
+	}
+	if field, ok := config["dst_ip_field"]; ok {
+		if dstField, ok = field.(string); !ok {
+			log.Fatal("wrong config of dst_ip_field in flow direction filter plugin")
+		}
+	}
+	plugin.srcIPVR = value_render.GetValueRender2(srcField)
+	plugin.dstIPVR = value_render.GetValueRender2(dstField)
 	if target, ok := config["target"]; ok {
 		plugin.target, ok = target.(string)
 		if !ok {
@@ -0,0 +1,342 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mitchellh/mapstructure"
+	"github.com/oschwald/maxminddb-golang"
+
+	"traffic-statistics/pkg/log"
+	"traffic-statistics/pkg/lru"
+	"traffic-statistics/topology"
+	"traffic-statistics/value_render"
+)
+
+func init() {
+	register("GeoIP", newGeoIPFilter)
+}
+
+// 库文件变化后等待该时间再重新加载，避免读到写了一半的文件
+const geoIPReloadDelay = time.Second
+
+// geoIPFields 为可以添加的字段，实际的字段名为 <prefix><field>
+var geoIPFields = []string{"country_code", "country", "region", "city", "latitude", "longitude", "asn", "as_org"}
+
+type geoIPConfig struct {
+	// MaxMind 格式的 City（或 Country）库和 ASN 库，至少配置一个，文件变化后自动重新加载
+	CityDB string `mapstructure:"city_db"`
+	ASNDB  string `mapstructure:"asn_db"`
+	// 查找的字段到添加的字段前缀的映射，字段支持 [a][b] 格式的多层字段，默认为 src_ip: src_ 和 dst_ip: dst_
+	Sources map[string]string `mapstructure:"sources"`
+	// 添加的字段，默认为全部
+	Fields    []string `mapstructure:"fields"`
+	Language  string   `mapstructure:"language"`   // 国家、地区和城市名称的语言，没有时使用英文，默认为 en
+	CacheSize int      `mapstructure:"cache_size"` // 按 IP 缓存查找结果的数量，默认为 10000
+}
+
+// geoIPFilter 读取本地的 MaxMind 库，为 IP 添加国家、地区、城市、经纬度、ASN 和运营商，
+// 不依赖 Elasticsearch 的 ingest pipeline，Kafka、ClickHouse 等输出同样可以使用
+type geoIPFilter struct {
+	config  geoIPConfig
+	sources []geoIPSource
+	fields  map[string]bool
+	cache   *lru.Cache
+
+	// lock 保护 city 和 asn，重新加载时需要等待正在进行的查找结束后才能关闭旧的库；
+	// 查找结果在读锁中写入 cache，重新加载在写锁中清空 cache，旧库的结果不会留在 cache 中
+	lock sync.RWMutex
+	city *maxminddb.Reader
+	asn  *maxminddb.Reader
+}
+
+type geoIPSource struct {
+	vr     value_render.ValueRender
+	prefix string
+}
+
+// geoIPRecord 为一个 IP 的查找结果，found 为 false 时表示两个库中都没有该 IP（如内网地址）
+type geoIPRecord struct {
+	found       bool
+	countryCode string
+	country     string
+	region      string
+	city        string
+	hasLocation bool
+	latitude    float64
+	longitude   float64
+	asn         uint
+	asOrg       string
+}
+
+// mmdbCity 为 City 库中使用的字段，Country 库没有 city、subdivisions 和 location
+type mmdbCity struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+type mmdbASN struct {
+	ASN uint   `maxminddb:"autonomous_system_number"`
+	Org string `maxminddb:"autonomous_system_organization"`
+}
+
+func newGeoIPFilter(config map[interface{}]interface{}) topology.Filter {
+	c := geoIPConfig{
+		Sources:   map[string]string{"src_ip": "src_", "dst_ip": "dst_"},
+		Language:  "en",
+		CacheSize: 10000,
+	}
+	if sources, ok := config["sources"]; ok {
+		// mapstructure 会合并默认值和配置的 map，配置了 sources 时只使用配置的字段
+		c.Sources = nil
+		if err := mapstructure.Decode(sources, &c.Sources); err != nil {
+			log.Fatalw("wrong config of sources in geoip filter plugin", "error", err)
+		}
+	}
+	if err := mapstructure.Decode(config, &c); err != nil {
+		log.Fatalw("decode geoip filter config failed", "error", err)
+	}
+	// mapstructure 会将配置的 fields 写入默认值的底层数组，不能使用 geoIPFields 作为默认值
+	if len(c.Fields) == 0 {
+		c.Fields = geoIPFields
+	}
+	if c.CityDB == "" && c.ASNDB == "" {
+		log.Fatal("city_db or asn_db must be set in geoip filter plugin")
+	}
+	if len(c.Sources) == 0 {
+		log.Fatal("sources must not be empty in geoip filter plugin")
+	}
+	if c.CacheSize <= 0 {
+		log.Fatalw("invalid cache_size in geoip filter plugin", "cache_size", c.CacheSize)
+	}
+	plugin := &geoIPFilter{
+		config: c,
+		fields: make(map[string]bool, len(c.Fields)),
+		cache:  lru.New(c.CacheSize),
+	}
+	for _, f := range c.Fields {
+		if !stringIn(f, geoIPFields) {
+			log.Fatalw("invalid field in geoip filter plugin", "field", f, "available", geoIPFields)
+		}
+		plugin.fields[f] = true
+	}
+	paths := make([]string, 0, len(c.Sources))
+	for path := range c.Sources {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		plugin.sources = append(plugin.sources, geoIPSource{
+			vr:     value_render.GetPathValueRender(path),
+			prefix: c.Sources[path],
+		})
+	}
+	var err error
+	if plugin.city, err = openMMDB(c.CityDB, "City", "Country"); err != nil {
+		log.Fatalw("open city_db failed in geoip filter plugin", "city_db", c.CityDB, "error", err)
+	}
+	if plugin.asn, err = openMMDB(c.ASNDB, "ASN"); err != nil {
+		log.Fatalw("open asn_db failed in geoip filter plugin", "asn_db", c.ASNDB, "error", err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Fatalw("create geoip db watcher failed", "error", err)
+	}
+	for _, path := range []string{c.CityDB, c.ASNDB} {
+		if path == "" {
+			continue
+		}
+		// 监听所在的目录，geoipupdate 等工具以重命名的方式替换文件
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			log.Fatalw("watch geoip db failed", "path", path, "error", err)
+		}
+	}
+	go plugin.watch(watcher)
+	return plugin
+}
+
+// openMMDB 打开 MaxMind 格式的库，并检查库的类型，路径为空时返回 nil
+func openMMDB(path string, types ...string) (*maxminddb.Reader, error) {
+	if path == "" {
+		return nil, nil
+	}
+	r, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range types {
+		if strings.Contains(r.Metadata.DatabaseType, t) {
+			return r, nil
+		}
+	}
+	r.Close()
+	return nil, fmt.Errorf("unexpected database type %s", r.Metadata.DatabaseType)
+}
+
+// watch 在库文件变化后重新加载并清空缓存，加载失败时继续使用之前的库
+func (f *geoIPFilter) watch(watcher *fsnotify.Watcher) {
+	city, asn := filepath.Clean(f.config.CityDB), filepath.Clean(f.config.ASNDB)
+	var reloadCity, reloadASN <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename) == 0 {
+				continue
+			}
+			switch filepath.Clean(event.Name) {
+			case city:
+				reloadCity = time.After(geoIPReloadDelay)
+			case asn:
+				reloadASN = time.After(geoIPReloadDelay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorw("watch geoip db error", "error", err)
+		case <-reloadCity:
+			reloadCity = nil
+			f.reload(f.config.CityDB, &f.city, "City", "Country")
+		case <-reloadASN:
+			reloadASN = nil
+			f.reload(f.config.ASNDB, &f.asn, "ASN")
+		}
+	}
+}
+
+func (f *geoIPFilter) reload(path string, db **maxminddb.Reader, types ...string) {
+	r, err := openMMDB(path, types...)
+	if err != nil {
+		log.Errorw("reload geoip db failed, keep the previous db", "path", path, "error", err)
+		return
+	}
+	f.lock.Lock()
+	old := *db
+	*db = r
+	f.cache.Purge()
+	f.lock.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	log.Infow("geoip db reloaded", "path", path, "build_time", time.Unix(int64(r.Metadata.BuildEpoch), 0))
+}
+
+func (f *geoIPFilter) Filter(event map[string]interface{}) map[string]interface{} {
+	for _, s := range f.sources {
+		v, ok := s.vr.Render(event).(string)
+		if !ok || v == "" {
+			continue
+		}
+		r := f.lookup(v)
+		if !r.found {
+			continue
+		}
+		f.set(event, s.prefix, r)
+	}
+	return event
+}
+
+func (f *geoIPFilter) lookup(v string) geoIPRecord {
+	if cached, ok := f.cache.Get(v); ok {
+		return cached.(geoIPRecord)
+	}
+	var r geoIPRecord
+	ip := net.ParseIP(v)
+	if ip == nil {
+		log.Errorw("parse input to ip error", "input", v)
+		return r
+	}
+	f.lock.RLock()
+	if f.city != nil {
+		var c mmdbCity
+		if _, ok, err := f.city.LookupNetwork(ip, &c); err != nil {
+			log.Errorw("lookup city db error", "ip", v, "error", err)
+		} else if ok {
+			r.found = true
+			r.countryCode = c.Country.ISOCode
+			r.country = f.name(c.Country.Names)
+			r.city = f.name(c.City.Names)
+			if len(c.Subdivisions) > 0 {
+				r.region = f.name(c.Subdivisions[0].Names)
+			}
+			if c.Location.Latitude != nil && c.Location.Longitude != nil {
+				r.hasLocation = true
+				r.latitude, r.longitude = *c.Location.Latitude, *c.Location.Longitude
+			}
+		}
+	}
+	if f.asn != nil {
+		var a mmdbASN
+		if _, ok, err := f.asn.LookupNetwork(ip, &a); err != nil {
+			log.Errorw("lookup asn db error", "ip", v, "error", err)
+		} else if ok {
+			r.found = true
+			r.asn, r.asOrg = a.ASN, a.Org
+		}
+	}
+	f.cache.Add(v, r)
+	f.lock.RUnlock()
+	return r
+}
+
+// name 返回配置语言的名称，没有时使用英文
+func (f *geoIPFilter) name(names map[string]string) string {
+	if n, ok := names[f.config.Language]; ok {
+		return n
+	}
+	return names["en"]
+}
+
+func (f *geoIPFilter) set(event map[string]interface{}, prefix string, r geoIPRecord) {
+	setString := func(field, v string) {
+		if v != "" && f.fields[field] {
+			event[prefix+field] = v
+		}
+	}
+	setString("country_code", r.countryCode)
+	setString("country", r.country)
+	setString("region", r.region)
+	setString("city", r.city)
+	setString("as_org", r.asOrg)
+	if r.hasLocation {
+		if f.fields["latitude"] {
+			event[prefix+"latitude"] = r.latitude
+		}
+		if f.fields["longitude"] {
+			event[prefix+"longitude"] = r.longitude
+		}
+	}
+	if r.asn != 0 && f.fields["asn"] {
+		event[prefix+"asn"] = int64(r.asn)
+	}
+}
+
+func stringIn(s string, arr []string) bool {
+	for _, v := range arr {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,279 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"traffic-statistics/pkg/log"
+)
+
+var testLoggerOnce sync.Once
+
+// initTestLogger 将测试中的日志写到临时目录
+func initTestLogger() {
+	testLoggerOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "traffic-statistics-test-log")
+		if err != nil {
+			panic(err)
+		}
+		log.NewLogger(map[string]interface{}{"log": map[interface{}]interface{}{"log_dir": dir}})
+	})
+}
+
+// mmdbNetwork 为测试库中的一个网段和数据
+type mmdbNetwork struct {
+	cidr string
+	data map[string]interface{}
+}
+
+// writeMMDB 生成只包含 IPv4 网段的 MaxMind 格式的库，记录长度为 24 位，网段不能重叠
+func writeMMDB(t *testing.T, dir, dbType string, networks []mmdbNetwork) string {
+	t.Helper()
+	const empty = -1
+	type node struct{ records [2]int } // 子节点的序号，empty 或者 -2 - 数据的序号
+	nodes := []*node{{records: [2]int{empty, empty}}}
+	var data []byte
+	for i, n := range networks {
+		_, prefix, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := prefix.Mask.Size()
+		ip := prefix.IP.To4()
+		cur := nodes[0]
+		for bit := 0; bit < ones-1; bit++ {
+			b := int(ip[bit/8]>>(7-uint(bit%8))) & 1
+			if cur.records[b] == empty {
+				nodes = append(nodes, &node{records: [2]int{empty, empty}})
+				cur.records[b] = len(nodes) - 1
+			}
+			cur = nodes[cur.records[b]]
+		}
+		b := int(ip[(ones-1)/8]>>(7-uint((ones-1)%8))) & 1
+		cur.records[b] = -2 - i
+	}
+	offsets := make([]int, len(networks))
+	for i, n := range networks {
+		offsets[i] = len(data)
+		data = append(data, mmdbEncode(t, n.data)...)
+	}
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		for _, r := range n.records {
+			v := len(nodes) // 没有数据
+			switch {
+			case r >= 0:
+				v = r
+			case r <= -2:
+				v = len(nodes) + 16 + offsets[-2-r]
+			}
+			buf.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(data)
+	buf.WriteString("\xAB\xCD\xEFMaxMind.com")
+	buf.Write(mmdbEncode(t, map[string]interface{}{
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(4),
+		"database_type":               dbType,
+		"languages":                   []interface{}{"en", "zh-CN"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1622534400),
+		"description":                 map[string]interface{}{"en": "test"},
+	}))
+	path := filepath.Join(dir, dbType+".mmdb")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// mmdbEncode 按 MaxMind DB 的数据格式编码，只支持测试中使用的类型
+func mmdbEncode(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	// 控制字节的高 3 位为类型，扩展类型在之后的字节中；低 5 位为长度，29 表示长度为之后的 1 个字节加 29
+	control := func(typ, size int) []byte {
+		if size >= 29+256 {
+			t.Fatalf("mmdb value size %d is too large", size)
+		}
+		var extra []byte
+		if size >= 29 {
+			size, extra = 29, []byte{byte(size - 29)}
+		}
+		if typ <= 7 {
+			return append([]byte{byte(typ<<5 | size)}, extra...)
+		}
+		return append([]byte{byte(size), byte(typ - 7)}, extra...)
+	}
+	uintBytes := func(v uint64) []byte {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, v)
+		return bytes.TrimLeft(b, "\x00")
+	}
+	switch v := v.(type) {
+	case string:
+		return append(control(2, len(v)), v...)
+	case float64:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(v))
+		return append(control(3, 8), b...)
+	case uint16:
+		b := uintBytes(uint64(v))
+		return append(control(5, len(b)), b...)
+	case uint32:
+		b := uintBytes(uint64(v))
+		return append(control(6, len(b)), b...)
+	case uint64:
+		b := uintBytes(v)
+		return append(control(9, len(b)), b...)
+	case []interface{}:
+		out := control(11, len(v))
+		for _, e := range v {
+			out = append(out, mmdbEncode(t, e)...)
+		}
+		return out
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out := control(7, len(v))
+		for _, k := range keys {
+			out = append(out, mmdbEncode(t, k)...)
+			out = append(out, mmdbEncode(t, v[k])...)
+		}
+		return out
+	}
+	t.Fatalf("unsupported mmdb value %T", v)
+	return nil
+}
+
+// writeTestGeoIPDBs 生成 City 库和 ASN 库，8.8.8.0/24 只在 ASN 库中
+func writeTestGeoIPDBs(t *testing.T) (city, asn string) {
+	t.Helper()
+	dir := t.TempDir()
+	city = writeMMDB(t, dir, "GeoIP2-City", []mmdbNetwork{
+		{cidr: "1.2.3.0/24", data: map[string]interface{}{
+			"city":    map[string]interface{}{"names": map[string]interface{}{"en": "Shanghai", "zh-CN": "上海"}},
+			"country": map[string]interface{}{"iso_code": "CN", "names": map[string]interface{}{"en": "China", "zh-CN": "中国"}},
+			"subdivisions": []interface{}{
+				map[string]interface{}{"names": map[string]interface{}{"en": "Shanghai"}},
+			},
+			"location": map[string]interface{}{"latitude": 31.2222, "longitude": 121.4581},
+		}},
+		// Country 级别的数据，没有城市和经纬度
+		{cidr: "5.6.0.0/16", data: map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": "DE", "names": map[string]interface{}{"en": "Germany"}},
+		}},
+	})
+	asn = writeMMDB(t, dir, "GeoLite2-ASN", []mmdbNetwork{
+		{cidr: "1.2.0.0/16", data: map[string]interface{}{
+			"autonomous_system_number":       uint32(4134),
+			"autonomous_system_organization": "CHINANET",
+		}},
+		{cidr: "8.8.8.0/24", data: map[string]interface{}{
+			"autonomous_system_number":       uint32(15169),
+			"autonomous_system_organization": "GOOGLE",
+		}},
+	})
+	return city, asn
+}
+
+func TestGeoIPConfig(t *testing.T) {
+	initTestLogger()
+	city, asn := writeTestGeoIPDBs(t)
+	all := append([]string(nil), geoIPFields...)
+
+	f := newGeoIPFilter(map[interface{}]interface{}{
+		"city_db": city,
+		"fields":  []interface{}{"asn"},
+		"sources": map[interface{}]interface{}{"[client][ip]": "client_"},
+	}).(*geoIPFilter)
+	if !reflect.DeepEqual(f.fields, map[string]bool{"asn": true}) {
+		t.Errorf("fields = %v, want only asn", f.fields)
+	}
+	if len(f.sources) != 1 || f.sources[0].prefix != "client_" {
+		t.Errorf("sources = %+v, want only [client][ip]", f.sources)
+	}
+	// 配置的 fields 不能修改默认值
+	if !reflect.DeepEqual(geoIPFields, all) {
+		t.Fatalf("geoIPFields = %v after decoding config, want %v", geoIPFields, all)
+	}
+
+	f = newGeoIPFilter(map[interface{}]interface{}{"asn_db": asn}).(*geoIPFilter)
+	if len(f.fields) != len(all) {
+		t.Errorf("default fields = %v, want %v", f.fields, all)
+	}
+	if len(f.sources) != 2 || f.sources[0].prefix != "dst_" || f.sources[1].prefix != "src_" {
+		t.Errorf("default sources = %+v", f.sources)
+	}
+	if f.config.Language != "en" || f.config.CacheSize != 10000 || f.city != nil || f.asn == nil {
+		t.Errorf("default config = %+v, city %v, asn %v", f.config, f.city, f.asn)
+	}
+}
+
+func TestGeoIPFilter(t *testing.T) {
+	initTestLogger()
+	city, asn := writeTestGeoIPDBs(t)
+	tests := []struct {
+		name   string
+		config map[interface{}]interface{}
+		event  map[string]interface{}
+		want   map[string]interface{}
+	}{
+		{
+			name:   "city and asn",
+			config: map[interface{}]interface{}{"city_db": city, "asn_db": asn},
+			event:  map[string]interface{}{"src_ip": "1.2.3.4", "dst_ip": "8.8.8.8"},
+			want: map[string]interface{}{
+				"src_ip": "1.2.3.4", "dst_ip": "8.8.8.8",
+				"src_country_code": "CN", "src_country": "China", "src_region": "Shanghai", "src_city": "Shanghai",
+				"src_latitude": 31.2222, "src_longitude": 121.4581, "src_asn": int64(4134), "src_as_org": "CHINANET",
+				"dst_asn": int64(15169), "dst_as_org": "GOOGLE",
+			},
+		},
+		{
+			name:   "language and fields",
+			config: map[interface{}]interface{}{"city_db": city, "language": "zh-CN", "fields": []interface{}{"country", "region", "city"}},
+			event:  map[string]interface{}{"src_ip": "1.2.3.4", "dst_ip": "5.6.7.8"},
+			// 没有对应语言时使用英文
+			want: map[string]interface{}{
+				"src_ip": "1.2.3.4", "dst_ip": "5.6.7.8",
+				"src_country": "中国", "src_region": "Shanghai", "src_city": "上海", "dst_country": "Germany",
+			},
+		},
+		{
+			name:   "not found",
+			config: map[interface{}]interface{}{"city_db": city, "asn_db": asn},
+			event:  map[string]interface{}{"src_ip": "10.0.0.1", "dst_ip": "invalid", "src_port": 53},
+			want:   map[string]interface{}{"src_ip": "10.0.0.1", "dst_ip": "invalid", "src_port": 53},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newGeoIPFilter(tt.config)
+			// 第二次从缓存中读取
+			for i := 0; i < 2; i++ {
+				event := make(map[string]interface{}, len(tt.event))
+				for k, v := range tt.event {
+					event[k] = v
+				}
+				if got := f.Filter(event); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("Filter = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
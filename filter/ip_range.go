@@ -1,8 +1,21 @@
 package filter
 
 import (
+	"encoding/csv"
+	"fmt"
+	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/mitchellh/mapstructure"
+	"gopkg.in/yaml.v2"
+
+	"traffic-statistics/pkg/iptrie"
 	"traffic-statistics/pkg/log"
 	"traffic-statistics/pkg/utils"
 	"traffic-statistics/topology"
@@ -13,52 +26,246 @@ func init() {
 	register("IPRange", newIPRangeFilter)
 }
 
+// 文件变化后等待该时间再重新加载，避免读到写了一半的文件
+const ipRangeReloadDelay = time.Second
+
+type ipRangeConfig struct {
+	Source string `mapstructure:"source"` // 源字段
+	Target string `mapstructure:"target"` // 目标字段，多个标签时为目标字段的前缀
+	// 网段和标签的配置文件，.csv 结尾时按 CSV 解析，否则按 YAML 解析，文件变化后自动重新加载
+	NetPath string `mapstructure:"net_path"`
+	// 没有匹配的网段并且为公网 IP 时 target 的取值，为空则不设置
+	PublicLabel string `mapstructure:"public_label"`
+}
+
 type ipRangeFilter struct {
-	config        map[interface{}]interface{}
-	source        string // 源字段
-	target        string // 目标字段
-	sourceVR      value_render.ValueRender
-	netConfigFile string // IP范围配置的文件
+	config   ipRangeConfig
+	sourceVR value_render.ValueRender
+	trie     atomic.Value // *iptrie.Trie，值为 ipRangeLabels
+}
+
+// ipRangeLabels 为一个网段的标签，value 不为空时设置 target，labels 中的标签设置 <target>_<name>
+type ipRangeLabels struct {
+	value  string
+	labels map[string]string
 }
 
 func newIPRangeFilter(config map[interface{}]interface{}) topology.Filter {
+	c := ipRangeConfig{
+		PublicLabel: "public",
+	}
+	if err := mapstructure.Decode(config, &c); err != nil {
+		log.Fatalw("decode ip range filter config failed", "error", err)
+	}
+	if c.Source == "" {
+		log.Fatal("source must be set in ip range filter plugin")
+	}
+	if c.Target == "" {
+		log.Fatal("target must be set in ip range filter plugin")
+	}
+	if c.NetPath == "" {
+		log.Fatal("net_path must be set in ip range filter plugin")
+	}
 	plugin := &ipRangeFilter{
-		config: config,
+		config:   c,
+		sourceVR: value_render.GetValueRender2(c.Source),
 	}
-	if source, ok := config["source"]; ok {
-		plugin.source = source.(string)
-	} else {
-		log.Fatal("source must be set in translate filter plugin")
+	trie, err := loadIPRanges(c.NetPath)
+	if err != nil {
+		log.Fatalf("could not parse (%s):(%s)", c.NetPath, err)
 	}
-	plugin.sourceVR = value_render.GetValueRender2(plugin.source)
-	if target, ok := config["target"]; ok {
-		plugin.target = target.(string)
-	} else {
-		log.Fatal("target must be set in translate filter plugin")
+	plugin.trie.Store(trie)
+	log.Infow("ip ranges loaded", "net_path", c.NetPath, "prefixes", trie.Len())
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Fatalw("create net_path watcher failed", "error", err)
 	}
-	if path, ok := config["net_path"]; ok {
-		plugin.netConfigFile = path.(string)
-	} else {
-		log.Fatal("dictionary_path must be set in translate filter plugin")
+	// 监听所在的目录，编辑器和配置管理工具通常以重命名的方式替换文件
+	if err := watcher.Add(filepath.Dir(c.NetPath)); err != nil {
+		log.Fatalw("watch net_path failed", "net_path", c.NetPath, "error", err)
 	}
+	go plugin.watch(watcher)
 	return plugin
 }
 
+// watch 在 net_path 变化后重新加载，加载失败时继续使用之前的网段
+func (f *ipRangeFilter) watch(watcher *fsnotify.Watcher) {
+	name := filepath.Clean(f.config.NetPath)
+	var reload <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == name && event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename) != 0 {
+				reload = time.After(ipRangeReloadDelay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorw("watch net_path error", "error", err)
+		case <-reload:
+			reload = nil
+			trie, err := loadIPRanges(f.config.NetPath)
+			if err != nil {
+				log.Errorw("reload ip ranges failed, keep the previous ranges", "net_path", f.config.NetPath, "error", err)
+				continue
+			}
+			f.trie.Store(trie)
+			log.Infow("ip ranges reloaded", "net_path", f.config.NetPath, "prefixes", trie.Len())
+		}
+	}
+}
+
 func (f *ipRangeFilter) Filter(event map[string]interface{}) map[string]interface{} {
 	o := f.sourceVR.Render(event)
 	if o == nil {
 		return event
 	}
-	if v, ok := o.(string); ok {
-		ip := net.ParseIP(v)
-		if ip == nil {
-			log.Errorw("parse input to ip error", "input", v)
-			return event
+	v, ok := o.(string)
+	if !ok {
+		return event
+	}
+	ip := net.ParseIP(v)
+	if ip == nil {
+		log.Errorw("parse input to ip error", "input", v)
+		return event
+	}
+	if _, value, ok := f.trie.Load().(*iptrie.Trie).Lookup(ip); ok {
+		l := value.(ipRangeLabels)
+		if l.value != "" {
+			event[f.config.Target] = l.value
 		}
-		if utils.IsPublicIP(ip) {
-			event[f.target] = "public"
+		for name, label := range l.labels {
+			event[f.config.Target+"_"+name] = label
 		}
+		return event
+	}
+	if f.config.PublicLabel != "" && utils.IsPublicIP(ip) {
+		event[f.config.Target] = f.config.PublicLabel
 	}
-	// TODO: 根据netConfigFilePath判断source是上海还是常州
 	return event
 }
+
+// loadIPRanges 读取网段配置，YAML 的格式为网段到标签的映射，标签为字符串时设置 target，
+// 为映射时设置多个标签，其中 value 设置 target：
+//
+//	10.1.0.0/16: shanghai
+//	10.2.0.0/16:
+//	  value: changzhou
+//	  zone: dc2
+//	  owner: infra
+//
+// CSV 的第一行为表头，第一列为网段，其他列为标签名，列名为 value 时设置 target，如
+//
+//	cidr,value,zone,owner
+//	10.2.0.0/16,changzhou,dc2,infra
+func loadIPRanges(path string) (*iptrie.Trie, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return parseIPRangesCSV(file)
+	}
+	return parseIPRangesYAML(file)
+}
+
+func parseIPRangesYAML(r io.Reader) (*iptrie.Trie, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	ranges := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &ranges); err != nil {
+		return nil, err
+	}
+	trie := iptrie.New()
+	for cidr, v := range ranges {
+		var l ipRangeLabels
+		switch labels := v.(type) {
+		case map[interface{}]interface{}:
+			l.labels = make(map[string]string, len(labels))
+			for name, label := range labels {
+				if fmt.Sprint(name) == "value" {
+					l.value = fmt.Sprint(label)
+				} else {
+					l.labels[fmt.Sprint(name)] = fmt.Sprint(label)
+				}
+			}
+		case nil:
+			return nil, fmt.Errorf("no label for %s", cidr)
+		default:
+			l.value = fmt.Sprint(labels)
+		}
+		if err := insertIPRange(trie, cidr, l); err != nil {
+			return nil, err
+		}
+	}
+	return trie, nil
+}
+
+func parseIPRangesCSV(r io.Reader) (*iptrie.Trie, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read csv header: %v", err)
+	}
+	if len(header) < 2 {
+		return nil, fmt.Errorf("csv needs a cidr column and at least one label column")
+	}
+	trie := iptrie.New()
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return trie, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		l := ipRangeLabels{labels: make(map[string]string, len(header)-1)}
+		for i, name := range header[1:] {
+			label := strings.TrimSpace(record[i+1])
+			if label == "" {
+				continue
+			}
+			if name == "value" {
+				l.value = label
+			} else {
+				l.labels[name] = label
+			}
+		}
+		if err := insertIPRange(trie, strings.TrimSpace(record[0]), l); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// insertIPRange 插入一个网段，没有掩码的地址按单个 IP 处理，
+// 重复的网段（包括写法不同但掩码后相同的网段）返回错误，避免按文件中的顺序或 map 的遍历顺序决定标签
+func insertIPRange(trie *iptrie.Trie, cidr string, l ipRangeLabels) error {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return fmt.Errorf("invalid cidr (%s)", cidr)
+		}
+		if ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	_, prefix, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid cidr (%s)", cidr)
+	}
+	if trie.Insert(prefix, l) {
+		return fmt.Errorf("duplicate cidr (%s)", prefix)
+	}
+	return nil
+}
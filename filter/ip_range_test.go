@@ -0,0 +1,85 @@
+package filter
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadIPRanges(t *testing.T) {
+	// ip_ranges.yaml 和 ip_ranges.csv 为同样的网段，csv 中没有 10.1.0.0/16
+	tests := []struct {
+		ip   string
+		want *ipRangeLabels // nil 表示没有匹配的网段
+		csv  bool           // 只检查 csv
+		yaml bool           // 只检查 yaml
+	}{
+		{ip: "10.1.2.3", want: &ipRangeLabels{value: "shanghai", labels: map[string]string{}}, yaml: true},
+		{ip: "10.1.2.3", want: &ipRangeLabels{value: "internal", labels: map[string]string{}}, csv: true},
+		{ip: "10.2.0.1", want: &ipRangeLabels{value: "changzhou", labels: map[string]string{"zone": "dc2", "owner": "infra"}}},
+		{ip: "10.2.3.4", want: &ipRangeLabels{value: "gateway", labels: map[string]string{}}, yaml: true},
+		{ip: "10.2.3.4", want: &ipRangeLabels{value: "gateway", labels: map[string]string{"zone": "dc2"}}, csv: true},
+		{ip: "10.3.0.1", want: &ipRangeLabels{value: "internal", labels: map[string]string{}}},
+		{ip: "2001:db8::1", want: &ipRangeLabels{labels: map[string]string{"zone": "dc3"}}},
+		{ip: "192.168.0.1"},
+	}
+	for _, file := range []string{"testdata/ip_ranges.yaml", "testdata/ip_ranges.csv"} {
+		isCSV := strings.HasSuffix(file, ".csv")
+		t.Run(file, func(t *testing.T) {
+			trie, err := loadIPRanges(file)
+			if err != nil {
+				t.Fatalf("loadIPRanges: %v", err)
+			}
+			for _, tt := range tests {
+				if (tt.csv && !isCSV) || (tt.yaml && isCSV) {
+					continue
+				}
+				_, value, ok := trie.Lookup(net.ParseIP(tt.ip))
+				if tt.want == nil {
+					if ok {
+						t.Errorf("%s matched %+v, want no match", tt.ip, value)
+					}
+					continue
+				}
+				if !ok {
+					t.Errorf("%s matched nothing, want %+v", tt.ip, *tt.want)
+					continue
+				}
+				got := value.(ipRangeLabels)
+				// yaml 中标签为字符串时 labels 为 nil
+				if got.labels == nil {
+					got.labels = map[string]string{}
+				}
+				if !reflect.DeepEqual(got, *tt.want) {
+					t.Errorf("%s matched %+v, want %+v", tt.ip, got, *tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadIPRangesErrors(t *testing.T) {
+	tests := []struct {
+		file    string
+		wantErr string
+	}{
+		{file: "testdata/ip_ranges_duplicate.yaml", wantErr: "duplicate cidr (10.1.0.0/16)"},
+		{file: "testdata/ip_ranges_duplicate.csv", wantErr: "duplicate cidr (10.2.3.4/32)"},
+		{file: "testdata/ip_ranges_invalid.yaml", wantErr: "invalid cidr (10.1.0.0/33)"},
+		{file: "testdata/ip_ranges_invalid.csv", wantErr: "invalid cidr (shanghai)"},
+		{file: "testdata/ip_ranges_no_label.yaml", wantErr: "no label for 10.1.0.0/16"},
+		{file: "testdata/not_exist.yaml", wantErr: "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			trie, err := loadIPRanges(tt.file)
+			if err == nil {
+				t.Fatalf("loadIPRanges returned %d prefixes, want error", trie.Len())
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
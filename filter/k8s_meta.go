@@ -0,0 +1,250 @@
+package filter
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+
+	"traffic-statistics/pkg/k8smeta"
+	"traffic-statistics/pkg/log"
+	"traffic-statistics/topology"
+)
+
+func init() {
+	register("K8sMeta", newK8sMetaFilter)
+}
+
+const (
+	k8sSourceKubernetes = "kubernetes"
+	k8sSourceFile       = "file"
+	k8sSourceHTTP       = "http"
+)
+
+type k8sMetaConfig struct {
+	Source string `mapstructure:"source"` // kubernetes、file 或 http，默认为 kubernetes
+	// source 为 kubernetes 时使用，为空时使用集群中的 service account
+	APIServer          string `mapstructure:"api_server"`
+	TokenFile          string `mapstructure:"token_file"`
+	CAFile             string `mapstructure:"ca_file"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+	FieldSelector      string `mapstructure:"field_selector"` // 如 spec.nodeName=node1
+	// source 为 file 或 http 时读取的 JSON 文件或地址，格式为 PodList 或简化的 pod 数组，每隔 refresh_interval 重新读取
+	Path            string `mapstructure:"path"`
+	URL             string `mapstructure:"url"`
+	RefreshInterval string `mapstructure:"refresh_interval"`
+	// pod 删除后保留的时间，期间时间早于删除时间的事件仍然关联到该 pod，默认为 5m
+	Retention string `mapstructure:"retention"`
+	// 查找的 IP 字段和添加的字段的前缀，默认为 src_ip、dst_ip 和 src_、dst_，
+	// 添加的字段为 <prefix>pod、<prefix>namespace、<prefix>node、<prefix>labels
+	SrcField  string `mapstructure:"src_field"`
+	DstField  string `mapstructure:"dst_field"`
+	SrcPrefix string `mapstructure:"src_prefix"`
+	DstPrefix string `mapstructure:"dst_prefix"`
+}
+
+// k8sMetaFilter 按 IP 为事件添加 pod 的名称、namespace、节点和标签，
+// IP 被新的 pod 复用时按事件的 create_time 选择当时使用该 IP 的 pod
+type k8sMetaFilter struct {
+	config k8sMetaConfig
+	store  *k8smeta.Store
+}
+
+func newK8sMetaFilter(config map[interface{}]interface{}) topology.Filter {
+	c := k8sMetaConfig{
+		Source:          k8sSourceKubernetes,
+		RefreshInterval: "30s",
+		Retention:       "5m",
+		SrcField:        "src_ip",
+		DstField:        "dst_ip",
+		SrcPrefix:       "src_",
+		DstPrefix:       "dst_",
+	}
+	if err := mapstructure.Decode(config, &c); err != nil {
+		log.Fatalw("decode k8s meta filter config failed", "error", err)
+	}
+	durations := make(map[string]time.Duration, 2)
+	for name, v := range map[string]string{
+		"refresh_interval": c.RefreshInterval,
+		"retention":        c.Retention,
+	} {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalw("invalid duration in k8s meta filter", "option", name, "value", v)
+		}
+		durations[name] = d
+	}
+	// filter 没有 Shutdown，同步 goroutine 随进程退出
+	ctx := context.Background()
+	plugin := &k8sMetaFilter{
+		config: c,
+		store:  k8smeta.NewStore(durations["retention"]),
+	}
+	switch c.Source {
+	case k8sSourceKubernetes:
+		apiConfig, err := c.apiConfig()
+		if err != nil {
+			log.Fatalw("invalid kubernetes config in k8s meta filter", "error", err)
+		}
+		watcher := k8smeta.NewWatcher(apiConfig, plugin.store, func(err error) {
+			log.Errorw("sync pods from kubernetes failed", "api_server", apiConfig.Server, "error", err)
+		})
+		go watcher.Run(ctx, 5*time.Second)
+	case k8sSourceFile, k8sSourceHTTP:
+		if (c.Source == k8sSourceFile && c.Path == "") || (c.Source == k8sSourceHTTP && c.URL == "") {
+			log.Fatalw("path or url must be set in k8s meta filter", "source", c.Source)
+		}
+		// 启动时读取失败说明配置有误
+		if err := plugin.load(ctx); err != nil {
+			log.Fatalw("load pods failed in k8s meta filter", "source", c.Source, "error", err)
+		}
+		go plugin.poll(ctx, durations["refresh_interval"])
+	default:
+		log.Fatalw("invalid source in k8s meta filter", "source", c.Source)
+	}
+	go plugin.expire(ctx, durations["retention"])
+	return plugin
+}
+
+func (c *k8sMetaConfig) apiConfig() (k8smeta.APIConfig, error) {
+	server, tokenFile, caFile := c.APIServer, c.TokenFile, c.CAFile
+	if server == "" {
+		var err error
+		if server, tokenFile, caFile, err = k8smeta.InClusterServer(); err != nil {
+			return k8smeta.APIConfig{}, err
+		}
+	}
+	apiConfig := k8smeta.APIConfig{Server: server, FieldSelector: c.FieldSelector}
+	if tokenFile != "" {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return apiConfig, err
+		}
+		apiConfig.Token = strings.TrimSpace(string(token))
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return apiConfig, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return apiConfig, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	// watch 为长连接，不设置整体超时
+	apiConfig.Client = &http.Client{Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	}}
+	return apiConfig, nil
+}
+
+func (f *k8sMetaFilter) poll(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := f.load(ctx); err != nil {
+				log.Errorw("reload pods failed in k8s meta filter", "source", f.config.Source, "error", err)
+			}
+		}
+	}
+}
+
+// load 读取完整的 pod 列表，文件或接口中没有的 pod 视为已经删除
+func (f *k8sMetaFilter) load(ctx context.Context) error {
+	var (
+		data []byte
+		err  error
+	)
+	if f.config.Source == k8sSourceFile {
+		data, err = os.ReadFile(f.config.Path)
+	} else {
+		data, err = httpGet(ctx, f.config.URL)
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	pods, err := k8smeta.DecodePods(data, now)
+	if err != nil {
+		return err
+	}
+	f.store.Replace(pods, now)
+	return nil
+}
+
+func httpGet(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (f *k8sMetaFilter) expire(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			f.store.Expire(now)
+		}
+	}
+}
+
+func (f *k8sMetaFilter) Filter(event map[string]interface{}) map[string]interface{} {
+	at, ok := event["create_time"].(time.Time)
+	if !ok {
+		at = time.Now()
+	}
+	f.set(event, f.config.SrcField, f.config.SrcPrefix, at)
+	f.set(event, f.config.DstField, f.config.DstPrefix, at)
+	return event
+}
+
+func (f *k8sMetaFilter) set(event map[string]interface{}, field, prefix string, at time.Time) {
+	ip, ok := event[field].(string)
+	if !ok || ip == "" {
+		return
+	}
+	p, ok := f.store.Lookup(ip, at)
+	if !ok {
+		return
+	}
+	event[prefix+"pod"] = p.Name
+	event[prefix+"namespace"] = p.Namespace
+	if p.Node != "" {
+		event[prefix+"node"] = p.Node
+	}
+	if len(p.Labels) > 0 {
+		event[prefix+"labels"] = p.Labels
+	}
+}
@@ -0,0 +1,126 @@
+package filter
+
+import (
+	"net"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+
+	"traffic-statistics/pkg/log"
+	"traffic-statistics/pkg/procnet"
+	"traffic-statistics/topology"
+)
+
+func init() {
+	register("Process", newProcessFilter)
+}
+
+type processConfig struct {
+	ProcRoot        string `mapstructure:"proc_root"`        // 默认为 /proc，只能看到该 proc 所在 network namespace 的 socket
+	RefreshInterval string `mapstructure:"refresh_interval"` // 重新读取 socket 表的间隔，默认为 5s
+}
+
+// processFilter 按本机的 IP 和端口查找产生流量的进程，添加 process_pid、process_name、process_cgroup、
+// container_id 和 process_side（本机为 src 还是 dst），找不到进程的事件不修改。
+// socket 和进程的映射在后台定时刷新，刷新间隔内新建并结束的连接无法关联到进程；
+// 监听所有地址的 socket 只关联本机地址的流量，经过本机转发的流量即使端口相同也不关联
+type processFilter struct {
+	table *procnet.Table
+}
+
+func newProcessFilter(config map[interface{}]interface{}) topology.Filter {
+	c := processConfig{
+		ProcRoot:        "/proc",
+		RefreshInterval: "5s",
+	}
+	if err := mapstructure.Decode(config, &c); err != nil {
+		log.Fatalw("decode process filter config failed", "error", err)
+	}
+	interval, err := time.ParseDuration(c.RefreshInterval)
+	if err != nil || interval <= 0 {
+		log.Fatalw("invalid refresh_interval in process filter", "refresh_interval", c.RefreshInterval)
+	}
+	plugin := &processFilter{table: procnet.NewTable(c.ProcRoot)}
+	if err := plugin.table.Refresh(); err != nil {
+		log.Fatalw("read sockets failed in process filter", "proc_root", c.ProcRoot, "error", err)
+	}
+	go plugin.refresh(interval)
+	return plugin
+}
+
+func (f *processFilter) refresh(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := f.table.Refresh(); err != nil {
+			log.Errorw("refresh process table failed", "error", err)
+		}
+	}
+}
+
+func (f *processFilter) Filter(event map[string]interface{}) map[string]interface{} {
+	srcIP, dstIP := ipOf(event["src_ip"]), ipOf(event["dst_ip"])
+	srcPort, ok1 := uintOf(event["src_port"])
+	dstPort, ok2 := uintOf(event["dst_port"])
+	if srcIP == nil || dstIP == nil || !ok1 || !ok2 {
+		return event
+	}
+	protocols := []uint8{procnet.ProtocolTCP, procnet.ProtocolUDP}
+	if protocol, ok := uintOf(event["protocol"]); ok {
+		protocols = []uint8{uint8(protocol)}
+	}
+	for _, protocol := range protocols {
+		if p, ok := f.table.Lookup(protocol, srcIP, uint16(srcPort), dstIP, uint16(dstPort)); ok {
+			setProcess(event, p, "src")
+			return event
+		}
+		if p, ok := f.table.Lookup(protocol, dstIP, uint16(dstPort), srcIP, uint16(srcPort)); ok {
+			setProcess(event, p, "dst")
+			return event
+		}
+	}
+	return event
+}
+
+func setProcess(event map[string]interface{}, p *procnet.Process, side string) {
+	event["process_pid"] = int64(p.PID)
+	event["process_name"] = p.Name
+	event["process_side"] = side
+	if p.Cgroup != "" {
+		event["process_cgroup"] = p.Cgroup
+	}
+	if p.ContainerID != "" {
+		event["container_id"] = p.ContainerID
+	}
+}
+
+func ipOf(v interface{}) net.IP {
+	s, ok := v.(string)
+	if !ok {
+		return nil
+	}
+	ip := net.ParseIP(s)
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
+
+// uintOf 转换事件中的端口和协议号，抓包的事件为 uint16 和 uint8，JSON 还原的事件可能为 int64
+func uintOf(v interface{}) (uint64, bool) {
+	switch n := v.(type) {
+	case uint8:
+		return uint64(n), true
+	case uint16:
+		return uint64(n), true
+	case uint32:
+		return uint64(n), true
+	case uint64:
+		return n, true
+	case int:
+		return uint64(n), n >= 0
+	case int32:
+		return uint64(n), n >= 0
+	case int64:
+		return uint64(n), n >= 0
+	}
+	return 0, false
+}
@@ -8,6 +8,7 @@ require (
 	github.com/google/gopacket v1.1.19
 	github.com/mitchellh/mapstructure v1.5.0
 	github.com/olivere/elastic/v7 v7.0.32
+	github.com/oschwald/maxminddb-golang v1.9.0
 	github.com/spf13/viper v1.15.0
 	go.uber.org/automaxprocs v1.5.1
 	go.uber.org/zap v1.21.0
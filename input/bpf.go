@@ -0,0 +1,51 @@
+package input
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// bpfOfDevice 返回设备对应的 BPF 过滤表达式，设备单独配置的表达式优先于全局表达式
+func bpfOfDevice(device, global string, devices map[string]string) string {
+	if expr, ok := devices[device]; ok && expr != "" {
+		return expr
+	}
+	return global
+}
+
+// validateDeviceBPF 按设备的链路类型编译 BPF 表达式，用于在加载配置时提前发现错误的表达式
+func validateDeviceBPF(device string, snapshotLen int32, expr string) error {
+	if expr == "" {
+		return nil
+	}
+	handle, err := pcap.OpenLive(device, snapshotLen, false, time.Second)
+	if err != nil {
+		return fmt.Errorf("open device (%s) to get link type error (%v)", device, err)
+	}
+	defer handle.Close()
+	if _, err := handle.CompileBPFFilter(expr); err != nil {
+		return fmt.Errorf("compile bpf (%s) for device (%s) error (%v)", expr, device, err)
+	}
+	return nil
+}
+
+// validateUploadBPF 校验上传文件时使用的 BPF 表达式，离线文件的链路类型在加载配置时未知，按以太网校验
+func validateUploadBPF(c uploadConfig) error {
+	exprs := make([]string, 0, len(c.DeviceBPF)+1)
+	exprs = append(exprs, c.BPF)
+	for _, v := range c.DeviceBPF {
+		exprs = append(exprs, v)
+	}
+	for _, expr := range exprs {
+		if expr == "" {
+			continue
+		}
+		if _, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, 65535, expr); err != nil {
+			return fmt.Errorf("compile bpf (%s) error (%v)", expr, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package input
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+const (
+	timestampPrecisionMicro = "micro"
+	timestampPrecisionNano  = "nano"
+)
+
+// captureOptions 为某个设备最终生效的抓包配置
+type captureOptions struct {
+	SnapshotLen        int32
+	Promiscuous        bool
+	BufferSize         int
+	ImmediateMode      bool
+	TimestampPrecision string
+	Timeout            time.Duration
+	BPF                string
+}
+
+// optionsOfDevice 合并全局配置和设备配置，设备配置中设置了的项覆盖全局配置
+func (c captureConfig) optionsOfDevice(device string) (captureOptions, error) {
+	o := captureOptions{
+		SnapshotLen:        c.SnapshotLen,
+		Promiscuous:        c.Promiscuous,
+		BufferSize:         c.BufferSize,
+		ImmediateMode:      c.ImmediateMode,
+		TimestampPrecision: c.TimestampPrecision,
+		BPF:                c.BPF,
+	}
+	timeout := c.Timeout
+	if dc, ok := c.DeviceConfig[device]; ok {
+		if dc.SnapshotLen != nil {
+			o.SnapshotLen = *dc.SnapshotLen
+		}
+		if dc.Promiscuous != nil {
+			o.Promiscuous = *dc.Promiscuous
+		}
+		if dc.BufferSize != nil {
+			o.BufferSize = *dc.BufferSize
+		}
+		if dc.ImmediateMode != nil {
+			o.ImmediateMode = *dc.ImmediateMode
+		}
+		if dc.TimestampPrecision != "" {
+			o.TimestampPrecision = dc.TimestampPrecision
+		}
+		if dc.Timeout != "" {
+			timeout = dc.Timeout
+		}
+		if dc.BPF != "" {
+			o.BPF = dc.BPF
+		}
+	}
+	if o.TimestampPrecision == "" {
+		o.TimestampPrecision = timestampPrecisionMicro
+	}
+	if o.TimestampPrecision != timestampPrecisionMicro && o.TimestampPrecision != timestampPrecisionNano {
+		return o, fmt.Errorf("invalid timestamp_precision (%s) for device (%s)", o.TimestampPrecision, device)
+	}
+	o.Timeout = pcap.BlockForever
+	if timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return o, fmt.Errorf("parse timeout of device (%s) error (%v)", device, err)
+		}
+		o.Timeout = d
+	}
+	return o, nil
+}
+
+// openDevice 通过 inactive handle 按配置打开设备
+func openDevice(device string, o captureOptions) (*pcap.Handle, error) {
+	inactive, err := pcap.NewInactiveHandle(device)
+	if err != nil {
+		return nil, err
+	}
+	defer inactive.CleanUp()
+	if err := inactive.SetSnapLen(int(o.SnapshotLen)); err != nil {
+		return nil, fmt.Errorf("set snapshot_len error (%v)", err)
+	}
+	if err := inactive.SetPromisc(o.Promiscuous); err != nil {
+		return nil, fmt.Errorf("set promiscuous error (%v)", err)
+	}
+	if err := inactive.SetTimeout(o.Timeout); err != nil {
+		return nil, fmt.Errorf("set timeout error (%v)", err)
+	}
+	if o.BufferSize > 0 {
+		if err := inactive.SetBufferSize(o.BufferSize); err != nil {
+			return nil, fmt.Errorf("set buffer_size error (%v)", err)
+		}
+	}
+	if o.ImmediateMode {
+		if err := inactive.SetImmediateMode(true); err != nil {
+			return nil, fmt.Errorf("set immediate_mode error (%v)", err)
+		}
+	}
+	// Activate 时会尝试使用纳秒精度，实际精度通过 handle.Resolution 获取
+	return inactive.Activate()
+}
+
+// fileNanos 返回写入 pcap 文件时是否使用纳秒精度，只有配置为 nano 且设备实际支持时才使用
+func (o captureOptions) fileNanos(handle *pcap.Handle) bool {
+	return o.TimestampPrecision == timestampPrecisionNano &&
+		handle.Resolution() == gopacket.TimestampResolutionNanosecond
+}
@@ -0,0 +1,60 @@
+package input
+
+import (
+	"sync/atomic"
+	"time"
+
+	"traffic-statistics/input/netdata"
+	"traffic-statistics/pkg/log"
+)
+
+// 抓包统计事件的 type 字段取值
+const eventTypeCaptureStats = "capture_stats"
+
+type statsConfig struct {
+	Interval string `mapstructure:"interval"` // 统计间隔，为空则不统计
+	Event    bool   `mapstructure:"event"`    // 是否将统计结果作为事件发送到 filter 和 output
+}
+
+// deviceStats 为单个设备的抓包统计，均为开始抓包以来的累计值
+type deviceStats struct {
+	written uint64 // 写入 pcap 文件的数据包数
+	handled uint64 // 交给 PacketHandler 的数据包数
+	stalls  uint64 // 交给 PacketHandler 时管道已满，需要等待的次数
+}
+
+// reportStats 读取 libpcap 的统计和设备的计数，输出到日志，并按配置发送统计事件
+func (d *deviceCapturer) reportStats() {
+	s, err := d.handle.Stats()
+	if err != nil {
+		log.Errorw("read capture stats error", "device", d.device, "error", err)
+		return
+	}
+	written := atomic.LoadUint64(&d.stats.written)
+	handled := atomic.LoadUint64(&d.stats.handled)
+	stalls := atomic.LoadUint64(&d.stats.stalls)
+	log.Infow("capture stats", "device", d.device,
+		"received", s.PacketsReceived, "dropped", s.PacketsDropped, "if_dropped", s.PacketsIfDropped,
+		"written", written, "handled", handled, "stalls", stalls,
+		"total_handled", netdata.Read(), "total_handled_bytes", netdata.ReadSize())
+	if !d.packetCapturer.statsEvent {
+		return
+	}
+	event := map[string]interface{}{
+		"type":        eventTypeCaptureStats,
+		"device":      d.device,
+		"create_time": time.Now(),
+		"received":    int64(s.PacketsReceived),
+		"dropped":     int64(s.PacketsDropped),
+		"if_dropped":  int64(s.PacketsIfDropped),
+		"written":     int64(written),
+		"handled":     int64(handled),
+		"stalls":      int64(stalls),
+	}
+	// 统计事件不能阻塞抓包，管道已满时丢弃本次统计
+	select {
+	case d.packetCapturer.PacketHandler.stats <- event:
+	default:
+		log.Warnw("stats channel is full, drop capture stats event", "device", d.device)
+	}
+}
@@ -7,13 +7,13 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/pcapgo"
 
-	"traffic-statistics/input/netdata"
 	"traffic-statistics/pkg/log"
 )
 
@@ -26,19 +26,60 @@ const (
 	captureOutputFile = "file"
 )
 
-func newCapturer(c captureConfig, packetHandler *PacketHandler) (Capturer, error) {
-	devicesToCapture, err := deviceToCapture(c.DeviceType, c.Device)
+// 读取数据包的 goroutine 和抓包 goroutine 之间的管道大小
+const readChannelSize = 128
+
+// stopDeviceTimeout 为停止设备时等待抓包 goroutine 退出的最长时间，读取超时较长的设备关闭 handle 时
+// 需要等待当前的读取返回，抓包 goroutine 也可能阻塞在已满的上传管道上
+const stopDeviceTimeout = 5 * time.Second
+
+func newCapturer(c captureConfig, handlerConfig packetHandlerConfig, packetHandler *PacketHandler) (Capturer, error) {
+	patterns, err := compileDevicePatterns(c.Device)
 	if err != nil {
 		return nil, err
 	}
-	if len(devicesToCapture) == 0 {
-		return nil, errors.New("no device to capture")
+	devicesToCapture, err := deviceToCapture(c.DeviceType, patterns)
+	if err != nil {
+		return nil, err
 	}
 	f := &packetCapturer{
-		SnapshotLen:     c.SnapshotLen,
-		Promiscuous:     c.Promiscuous,
 		PacketHandler:   packetHandler,
+		config:          c,
+		devicePatterns:  patterns,
 		deviceToCapture: devicesToCapture,
+		options:         make(map[string]captureOptions, len(devicesToCapture)),
+		running:         make(map[string]*runningDevice),
+		statsEvent:      c.Stats.Event,
+		decodePool: newDecodePool(packetHandler, handlerConfig.Workers, handlerConfig.PreserveOrder,
+			int(handlerConfig.ChannelSize)),
+	}
+	if c.RescanInterval != "" {
+		d, err := time.ParseDuration(c.RescanInterval)
+		if err != nil {
+			return nil, fmt.Errorf("parse rescan interval to time duration error (%v)", err)
+		}
+		f.rescanInterval = d
+	}
+	if len(devicesToCapture) == 0 {
+		// 开启了重新扫描设备时，允许启动时没有设备，等设备出现后再抓包
+		if f.rescanInterval == 0 {
+			return nil, errors.New("no device to capture")
+		}
+		log.Warnw("no device to capture now, wait for rescan", "rescan_interval", c.RescanInterval)
+	}
+	if c.Stats.Interval != "" {
+		d, err := time.ParseDuration(c.Stats.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("parse stats interval to time duration error (%v)", err)
+		}
+		f.statsInterval = d
+	}
+	for _, v := range devicesToCapture {
+		o, err := f.deviceOptions(v)
+		if err != nil {
+			return nil, err
+		}
+		f.options[v] = o
 	}
 	if c.Output == captureOutputFile {
 		fg := c.OutputFile
@@ -71,29 +112,60 @@ type fileOutput struct {
 }
 
 type packetCapturer struct {
-	SnapshotLen int32
-	Promiscuous bool
-	FileOutput  *fileOutput
+	FileOutput *fileOutput
 
 	PacketHandler *PacketHandler
 
+	config          captureConfig
+	devicePatterns  []devicePattern
 	wg              sync.WaitGroup
 	deviceToCapture []string
+	options         map[string]captureOptions // 设备对应的抓包配置
+	statsInterval   time.Duration             // 抓包统计的间隔，为 0 则不统计
+	statsEvent      bool
+	rescanInterval  time.Duration // 重新扫描设备的间隔，为 0 则只在启动时扫描一次
+	decodePool      *decodePool
 	closer          func()
 	lock            sync.Mutex
+
+	runningLock sync.Mutex
+	running     map[string]*runningDevice // 正在抓包的设备
+}
+
+type runningDevice struct {
+	cancel context.CancelFunc
+	done   chan struct{} // 抓包的 goroutine 退出后关闭，此时 pcap 文件已经关闭
+}
+
+// deviceOptions 返回设备的抓包配置并校验其中的 BPF 表达式
+func (c *packetCapturer) deviceOptions(device string) (captureOptions, error) {
+	o, err := c.config.optionsOfDevice(device)
+	if err != nil {
+		return o, err
+	}
+	if err := validateDeviceBPF(device, o.SnapshotLen, o.BPF); err != nil {
+		return o, err
+	}
+	return o, nil
 }
 
 func (c *packetCapturer) Startup() {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	ctx, cancel := context.WithCancel(context.Background())
+	c.decodePool.start()
 	c.closer = func() {
 		cancel()
 		c.wg.Wait()
+		// 所有设备停止后不会再有新的数据包，等待已经抓到的数据包解析完成
+		c.decodePool.stop()
 	}
 	for _, v := range c.deviceToCapture {
+		c.startDevice(ctx, v, c.options[v], "configured")
+	}
+	if c.rescanInterval > 0 {
 		c.wg.Add(1)
-		go c.captureByDevice(ctx, v)
+		go c.rescan(ctx)
 	}
 }
 
@@ -106,46 +178,195 @@ func (c *packetCapturer) Stop() {
 	}
 }
 
-func (c *packetCapturer) captureByDevice(ctx context.Context, device string) {
+func (c *packetCapturer) startDevice(ctx context.Context, device string, o captureOptions, reason string) {
+	c.runningLock.Lock()
+	defer c.runningLock.Unlock()
+	if _, ok := c.running[device]; ok {
+		return
+	}
+	log.Infow("start capture device", "device", device, "reason", reason)
+	deviceCtx, cancel := context.WithCancel(ctx)
+	r := &runningDevice{cancel: cancel, done: make(chan struct{})}
+	c.running[device] = r
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer close(r.done)
+		c.captureByDevice(deviceCtx, device, o)
+		c.runningLock.Lock()
+		// 设备异常退出时从正在抓包的设备中移除，下次扫描到时重新抓包
+		if c.running[device] == r {
+			delete(c.running, device)
+			if ctx.Err() == nil {
+				log.Warnw("capture device exited", "device", device, "reason", "capture exited")
+			}
+		}
+		c.runningLock.Unlock()
+		cancel()
+	}()
+}
+
+// stopDevice 停止设备的抓包并等待抓包的 goroutine 退出，避免设备重新出现后新的 goroutine
+// 在旧的 goroutine 关闭同名的 pcap 文件之前开始写入，最多等待 stopDeviceTimeout，避免阻塞重新扫描
+func (c *packetCapturer) stopDevice(device string, reason string) {
+	c.runningLock.Lock()
+	r, ok := c.running[device]
+	if ok {
+		log.Infow("stop capture device", "device", device, "reason", reason)
+		r.cancel()
+		delete(c.running, device)
+	}
+	// 抓包的 goroutine 退出时需要获取 runningLock，不能持有锁等待
+	c.runningLock.Unlock()
+	if !ok {
+		return
+	}
+	timer := time.NewTimer(stopDeviceTimeout)
+	defer timer.Stop()
+	select {
+	case <-r.done:
+	case <-timer.C:
+		log.Warnw("capture device does not exit in time", "device", device, "timeout", stopDeviceTimeout)
+	}
+}
+
+// rescan 定时重新扫描设备，为新出现的设备启动抓包，停止已经消失的设备的抓包
+func (c *packetCapturer) rescan(ctx context.Context) {
 	defer c.wg.Done()
-	handle, err := pcap.OpenLive(device, c.SnapshotLen, c.Promiscuous, -1*time.Second)
+	ticker := time.NewTicker(c.rescanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		devices, err := deviceToCapture(c.config.DeviceType, c.devicePatterns)
+		if err != nil {
+			log.Errorw("rescan devices error", "error", err)
+			continue
+		}
+		current := make(map[string]bool, len(devices))
+		for _, v := range devices {
+			current[v] = true
+		}
+		c.runningLock.Lock()
+		gone := make([]string, 0)
+		for v := range c.running {
+			if !current[v] {
+				gone = append(gone, v)
+			}
+		}
+		appeared := make([]string, 0)
+		for _, v := range devices {
+			if _, ok := c.running[v]; !ok {
+				appeared = append(appeared, v)
+			}
+		}
+		c.runningLock.Unlock()
+		for _, v := range gone {
+			c.stopDevice(v, "device disappeared")
+		}
+		for _, v := range appeared {
+			o, err := c.deviceOptions(v)
+			if err != nil {
+				log.Errorw("invalid capture options of device", "device", v, "error", err)
+				continue
+			}
+			c.startDevice(ctx, v, o, "device appeared")
+		}
+	}
+}
+
+func (c *packetCapturer) captureByDevice(ctx context.Context, device string, o captureOptions) {
+	handle, err := openDevice(device, o)
 	if err != nil {
 		log.Errorw("open device error", "device", device, "error", err)
 		return
 	}
 	defer handle.Close()
-	log.Infow("start capture packet", "device", device)
+	if o.BPF != "" {
+		if err := handle.SetBPFFilter(o.BPF); err != nil {
+			log.Errorw("set bpf filter error", "device", device, "bpf", o.BPF, "error", err)
+			return
+		}
+	}
+	if o.TimestampPrecision == timestampPrecisionNano && !o.fileNanos(handle) {
+		log.Warnw("nanosecond timestamp is not supported, fall back to microsecond",
+			"device", device, "resolution", handle.Resolution())
+	}
+	log.Infow("start capture packet", "device", device, "snapshot_len", o.SnapshotLen,
+		"promiscuous", o.Promiscuous, "buffer_size", o.BufferSize, "immediate_mode", o.ImmediateMode,
+		"timestamp_precision", o.TimestampPrecision, "bpf", o.BPF)
 	d := &deviceCapturer{
 		packetCapturer: c,
 		device:         device,
 		handle:         handle,
+		linkType:       handle.LinkType(),
+		options:        o,
+		worker:         c.decodePool.workerOf(device),
+	}
+	packets := d.readPackets(ctx)
+	var statsTicker <-chan time.Time
+	if c.statsInterval > 0 {
+		ticker := time.NewTicker(c.statsInterval)
+		defer ticker.Stop()
+		statsTicker = ticker.C
 	}
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	packetSource.DecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true,
-		DecodeStreamsAsDatagrams: true}
 	for {
 		select {
 		case <-ctx.Done():
+			d.reportStats()
 			d.stop()
 			return
-		case packet := <-packetSource.Packets():
+		case <-statsTicker:
+			d.reportStats()
+		case packet, ok := <-packets:
+			if !ok {
+				// 设备被移除等原因导致读取结束
+				log.Warnw("stop capture device", "device", device, "reason", "packet source closed")
+				d.stop()
+				return
+			}
 			d.sendPacketToOutput(packet)
 		}
 	}
 }
 
-var lastMinute = int64(0)
-
-var lock sync.Mutex
+// readPackets 在单独的 goroutine 中读取设备的数据包，读取结束后关闭返回的管道
+func (d *deviceCapturer) readPackets(ctx context.Context) <-chan decodeTask {
+	packets := make(chan decodeTask, readChannelSize)
+	go func() {
+		defer close(packets)
+		for {
+			data, ci, err := d.handle.ReadPacketData()
+			if err == pcap.NextErrorTimeoutExpired {
+				continue
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Errorw("read packet error", "device", d.device, "error", err)
+				}
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case packets <- decodeTask{device: d, ci: ci, data: data}:
+			}
+		}
+	}()
+	return packets
+}
 
-func (d *deviceCapturer) sendPacketToOutput(packet gopacket.Packet) {
-	lock.Lock()
-	defer lock.Unlock()
+func (d *deviceCapturer) sendPacketToOutput(packet decodeTask) {
 	var newFile bool
 	f := d.currentFile
 	if d.packetCapturer.FileOutput != nil {
-		newFile = d.updateWriter(packet.Metadata().Timestamp)
-		d.writer.WritePacket(packet.Metadata().CaptureInfo, packet.Data())
+		newFile = d.updateWriter(packet.ci.Timestamp)
+		if err := d.writer.WritePacket(packet.ci, packet.data); err == nil {
+			atomic.AddUint64(&d.stats.written, 1)
+		}
 	}
 	if d.packetCapturer.PacketHandler.UploadSource == uploadSourceFile && newFile {
 		// 上传方式为文件且新文件已经产生，则将旧文件传递到上传模块
@@ -153,15 +374,14 @@ func (d *deviceCapturer) sendPacketToOutput(packet gopacket.Packet) {
 	}
 	if d.packetCapturer.PacketHandler.UploadSource == uploadSourceLivePacket {
 		now := time.Now()
-		if now.Unix()/60 != int64(lastMinute) {
-			lastMinute = now.Unix() / 60
+		if now.Unix()/60 != d.lastMinute {
+			d.lastMinute = now.Unix() / 60
 			formatted := fmt.Sprintf("%d-%02d-%02dT%02d:%02d",
 				now.Year(), now.Month(), now.Day(),
 				now.Hour(), now.Minute())
-			log.Infof("start uploading data in the minute of %s to upload module", formatted)
+			log.Infof("start uploading data of device %s in the minute of %s to upload module", d.device, formatted)
 		}
-		d.packetCapturer.PacketHandler.packet <- netdata.NetDataFromPacket(d.device,
-			d.packetCapturer.PacketHandler.IDGenerater.GenerateID(), packet)
+		d.packetCapturer.decodePool.submit(packet)
 	}
 }
 
@@ -177,6 +397,11 @@ type deviceCapturer struct {
 	device         string
 	packetCapturer *packetCapturer
 	handle         *pcap.Handle
+	linkType       layers.LinkType
+	options        captureOptions
+	stats          deviceStats
+	worker         int   // 保证数据包顺序时解析该设备数据包的 goroutine 序号
+	lastMinute     int64 // 上一次输出上传日志的分钟数
 	writer         *pcapgo.Writer
 	file           *os.File
 	currentFile    string
@@ -206,47 +431,15 @@ func (d *deviceCapturer) updateWriter(t time.Time) bool {
 		log.Errorw("create file error", "file", currentFile, "error", err)
 		return false
 	}
-	w := pcapgo.NewWriter(file)
-	w.WriteFileHeader(uint32(d.packetCapturer.SnapshotLen), d.handle.LinkType())
+	var w *pcapgo.Writer
+	// 文件头中记录实际使用的时间戳精度
+	if d.options.fileNanos(d.handle) {
+		w = pcapgo.NewWriterNanos(file)
+	} else {
+		w = pcapgo.NewWriter(file)
+	}
+	w.WriteFileHeader(uint32(d.options.SnapshotLen), d.handle.LinkType())
 	d.file = file
 	d.writer = w
 	return true
 }
-
-const (
-	// deviceTypeWhite 设备为白名单
-	deviceTypeWhite = "white"
-	// deviceTypeBlack 设备为黑名单
-	deviceTypeBlack = "black"
-)
-
-func deviceToCapture(deviceType string, devices []string) ([]string, error) {
-	allDevices, err := pcap.FindAllDevs()
-	if err != nil {
-		return nil, err
-	}
-	devicesToCapture := make([]string, 0, len(allDevices))
-	if deviceType == deviceTypeWhite {
-		allDevicesMap := make(map[string]bool, len(allDevices))
-		for _, v := range allDevices {
-			allDevicesMap[v.Name] = true
-		}
-		for _, v := range devices {
-			if _, ok := allDevicesMap[v]; ok {
-				devicesToCapture = append(devicesToCapture, v)
-			}
-		}
-	}
-	if deviceType == deviceTypeBlack {
-		devicesMap := make(map[string]bool, len(devices))
-		for _, v := range devices {
-			devicesMap[v] = true
-		}
-		for _, v := range allDevices {
-			if _, ok := devicesMap[v.Name]; !ok {
-				devicesToCapture = append(devicesToCapture, v.Name)
-			}
-		}
-	}
-	return devicesToCapture, nil
-}
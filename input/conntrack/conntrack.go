@@ -0,0 +1,152 @@
+package conntrack
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Tuple 为连接一个方向的地址、端口和计数，没有开启 nf_conntrack_acct 时计数为 0
+type Tuple struct {
+	SrcIP   string
+	DstIP   string
+	SrcPort uint16
+	DstPort uint16
+	Packets uint64
+	Bytes   uint64
+}
+
+// Entry 为 /proc/net/nf_conntrack 中的一条连接，Original 为发起方向，Reply 为应答方向，
+// NAT 时两个方向的地址不对称
+type Entry struct {
+	IPVersion uint8
+	Protocol  uint8
+	State     string // 只有 TCP 等有状态的协议有
+	Zone      uint16
+	Original  Tuple
+	Reply     Tuple
+	// HasCounters 表示条目中有 packets 和 bytes
+	HasCounters bool
+}
+
+// Parse 解析一行连接，支持 nf_conntrack 格式和旧的 ip_conntrack 格式（没有开头的三层协议），如
+// ipv4 2 tcp 6 431999 ESTABLISHED src=10.0.0.2 dst=1.1.1.1 sport=5000 dport=443 packets=10 bytes=1000
+// src=1.1.1.1 dst=203.0.113.5 sport=443 dport=5000 packets=8 bytes=4000 [ASSURED] mark=0 zone=0 use=2
+func Parse(line string) (Entry, error) {
+	var e Entry
+	fields := strings.Fields(line)
+	if len(fields) > 0 && (fields[0] == "ipv4" || fields[0] == "ipv6") {
+		if len(fields) < 2 {
+			return e, errors.New("too few fields")
+		}
+		if fields[0] == "ipv4" {
+			e.IPVersion = 4
+		} else {
+			e.IPVersion = 6
+		}
+		fields = fields[2:]
+	}
+	// 四层协议名称、协议号和超时时间
+	if len(fields) < 3 {
+		return e, errors.New("too few fields")
+	}
+	protocol, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return e, fmt.Errorf("invalid protocol (%s)", fields[1])
+	}
+	e.Protocol = uint8(protocol)
+	fields = fields[3:]
+	if len(fields) > 0 && !strings.Contains(fields[0], "=") && !strings.HasPrefix(fields[0], "[") {
+		e.State = fields[0]
+		fields = fields[1:]
+	}
+	tuples := 0
+	var t *Tuple
+	for _, f := range fields {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			continue // [ASSURED]、[UNREPLIED] 等标志
+		}
+		k, v := kv[0], kv[1]
+		if k == "src" {
+			if tuples++; tuples == 1 {
+				t = &e.Original
+			} else if tuples == 2 {
+				t = &e.Reply
+			} else {
+				return e, errors.New("too many tuples")
+			}
+		}
+		if t == nil {
+			continue
+		}
+		switch k {
+		case "src":
+			t.SrcIP = v
+		case "dst":
+			t.DstIP = v
+		case "sport", "dport":
+			port, err := strconv.ParseUint(v, 10, 16)
+			if err != nil {
+				return e, fmt.Errorf("invalid %s (%s)", k, v)
+			}
+			if k == "sport" {
+				t.SrcPort = uint16(port)
+			} else {
+				t.DstPort = uint16(port)
+			}
+		case "packets", "bytes":
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return e, fmt.Errorf("invalid %s (%s)", k, v)
+			}
+			if k == "packets" {
+				t.Packets = n
+			} else {
+				t.Bytes = n
+			}
+			e.HasCounters = true
+		case "zone":
+			zone, err := strconv.ParseUint(v, 10, 16)
+			if err != nil {
+				return e, fmt.Errorf("invalid zone (%s)", v)
+			}
+			e.Zone = uint16(zone)
+		}
+	}
+	if tuples != 2 {
+		return e, errors.New("original or reply tuple not found")
+	}
+	if e.IPVersion == 0 {
+		e.IPVersion = 4
+		if strings.Contains(e.Original.SrcIP, ":") {
+			e.IPVersion = 6
+		}
+	}
+	return e, nil
+}
+
+// Read 读取所有连接，无法解析的行交给 onError 处理后跳过
+func Read(r io.Reader, onError func(line string, err error)) ([]Entry, error) {
+	var entries []Entry
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 4096), 1<<20)
+	for s.Scan() {
+		line := s.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		e, err := Parse(line)
+		if err != nil {
+			if onError != nil {
+				onError(line, err)
+			}
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, s.Err()
+}
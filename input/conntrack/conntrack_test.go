@@ -0,0 +1,149 @@
+package conntrack
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    Entry
+		wantErr bool
+	}{
+		{
+			name: "nf_conntrack",
+			line: "ipv4     2 tcp      6 431999 ESTABLISHED src=10.0.0.2 dst=1.1.1.1 sport=5000 dport=443 packets=10 bytes=1000 " +
+				"src=1.1.1.1 dst=203.0.113.5 sport=443 dport=5000 packets=8 bytes=4000 [ASSURED] mark=0 zone=3 use=2",
+			want: Entry{
+				IPVersion:   4,
+				Protocol:    6,
+				State:       "ESTABLISHED",
+				Zone:        3,
+				Original:    Tuple{SrcIP: "10.0.0.2", DstIP: "1.1.1.1", SrcPort: 5000, DstPort: 443, Packets: 10, Bytes: 1000},
+				Reply:       Tuple{SrcIP: "1.1.1.1", DstIP: "203.0.113.5", SrcPort: 443, DstPort: 5000, Packets: 8, Bytes: 4000},
+				HasCounters: true,
+			},
+		},
+		{
+			name: "ip_conntrack without counters",
+			line: "udp      17 25 src=10.0.0.2 dst=10.0.0.53 sport=3000 dport=53 [UNREPLIED] src=10.0.0.53 dst=10.0.0.2 sport=53 dport=3000 mark=0 use=2",
+			want: Entry{
+				IPVersion: 4,
+				Protocol:  17,
+				Original:  Tuple{SrcIP: "10.0.0.2", DstIP: "10.0.0.53", SrcPort: 3000, DstPort: 53},
+				Reply:     Tuple{SrcIP: "10.0.0.53", DstIP: "10.0.0.2", SrcPort: 53, DstPort: 3000},
+			},
+		},
+		{
+			name: "ip_conntrack ipv6",
+			line: "icmpv6   58 29 src=2001:db8::2 dst=2001:db8::1 type=128 code=0 id=1 src=2001:db8::1 dst=2001:db8::2 type=129 code=0 id=1 use=1",
+			want: Entry{
+				IPVersion: 6,
+				Protocol:  58,
+				Original:  Tuple{SrcIP: "2001:db8::2", DstIP: "2001:db8::1"},
+				Reply:     Tuple{SrcIP: "2001:db8::1", DstIP: "2001:db8::2"},
+			},
+		},
+		{name: "truncated l3", line: "ipv4", wantErr: true},
+		{name: "truncated l4", line: "ipv6 10 tcp 6", wantErr: true},
+		{name: "invalid protocol", line: "ipv4 2 tcp x 10 src=1.1.1.1 dst=2.2.2.2 src=2.2.2.2 dst=1.1.1.1", wantErr: true},
+		{name: "invalid port", line: "ipv4 2 tcp 6 10 src=1.1.1.1 dst=2.2.2.2 sport=70000 src=2.2.2.2 dst=1.1.1.1", wantErr: true},
+		{name: "no reply", line: "ipv4 2 tcp 6 10 CLOSE src=1.1.1.1 dst=2.2.2.2 sport=1 dport=2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Parse(%q) = %+v, want error", tt.line, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.line, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse(%q) = %+v, want %+v", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func readTestdata(t *testing.T, name string) []Entry {
+	t.Helper()
+	f, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := Read(f, func(line string, err error) {
+		if line != "ipv4" {
+			t.Errorf("unexpected invalid line %q: %v", line, err)
+		}
+	})
+	if err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+	return entries
+}
+
+// testdata 下 nf_conntrack.0 和 nf_conntrack.1 为两次采样：
+// SNAT 连接的计数增加，DNAT 连接的五元组被新连接复用（计数回退），UDP 连接没有流量，
+// IPv6 连接完成握手，TIME_WAIT 的连接消失
+func TestTrackerUpdate(t *testing.T) {
+	t0 := time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC)
+	t1 := t0.Add(10 * time.Second)
+	tracker := NewTracker("gw")
+
+	entries := readTestdata(t, "nf_conntrack.0")
+	if len(entries) != 5 {
+		t.Fatalf("read %d entries, want 5", len(entries))
+	}
+	// 第一次采样计入全部计数
+	records := tracker.Update(entries, t0)
+	if len(records) != 5 {
+		t.Fatalf("first update returned %d records, want 5", len(records))
+	}
+	if r := records[0]; r.Bytes != 1000 || r.Packets != 10 || r.ReverseBytes != 4000 || r.ReversePackets != 8 {
+		t.Errorf("first record counters = %d/%d %d/%d", r.Bytes, r.Packets, r.ReverseBytes, r.ReversePackets)
+	}
+
+	records = tracker.Update(readTestdata(t, "nf_conntrack.1"), t1)
+	want := []Record{
+		{
+			Type: RecordType, Device: "gw", CreateTime: t1, FirstSeen: t0, LastSeen: t1,
+			SrcIP: "10.0.0.2", DstIP: "1.1.1.1", SrcPort: 5000, DstPort: 443, IPVersion: 4, Protocol: 6,
+			Bytes: 600, Packets: 5, ReverseBytes: 5000, ReversePackets: 4,
+			OrigSrcIP: "10.0.0.2", OrigDstIP: "1.1.1.1", OrigSrcPort: 5000, OrigDstPort: 443,
+			ReplySrcIP: "1.1.1.1", ReplyDstIP: "203.0.113.5", ReplySrcPort: 443, ReplyDstPort: 5000,
+			State: "ESTABLISHED", NAT: true,
+		},
+		{
+			// 计数回退，五元组被新连接复用，计入全部计数，first_seen 为本次采样
+			Type: RecordType, Device: "gw", CreateTime: t1, FirstSeen: t1, LastSeen: t1,
+			SrcIP: "198.51.100.7", DstIP: "10.0.0.3", SrcPort: 40000, DstPort: 8080, IPVersion: 4, Protocol: 6,
+			Bytes: 200, Packets: 2, ReverseBytes: 400, ReversePackets: 1,
+			OrigSrcIP: "198.51.100.7", OrigDstIP: "203.0.113.5", OrigSrcPort: 40000, OrigDstPort: 80,
+			ReplySrcIP: "10.0.0.3", ReplyDstIP: "198.51.100.7", ReplySrcPort: 8080, ReplyDstPort: 40000,
+			State: "ESTABLISHED", NAT: true,
+		},
+		{
+			Type: RecordType, Device: "gw", CreateTime: t1, FirstSeen: t0, LastSeen: t1,
+			SrcIP: "2001:db8::2", DstIP: "2001:db8::1", SrcPort: 6000, DstPort: 22, IPVersion: 6, Protocol: 6,
+			Bytes: 120, Packets: 2, ReverseBytes: 150, ReversePackets: 2,
+			OrigSrcIP: "2001:db8::2", OrigDstIP: "2001:db8::1", OrigSrcPort: 6000, OrigDstPort: 22,
+			ReplySrcIP: "2001:db8::1", ReplyDstIP: "2001:db8::2", ReplySrcPort: 22, ReplyDstPort: 6000,
+			State: "ESTABLISHED",
+		},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("second update:\n got %+v\nwant %+v", records, want)
+	}
+	if len(tracker.conns) != 4 {
+		t.Errorf("tracker keeps %d connections, want 4", len(tracker.conns))
+	}
+}
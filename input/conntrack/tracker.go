@@ -0,0 +1,132 @@
+package conntrack
+
+import (
+	"time"
+)
+
+// RecordType 与 Packet input 输出的流记录相同，SizeRecord 按 bytes、packets 和反方向的计数统计
+const RecordType = "flow"
+
+// Record 为一条连接在一个采样间隔内的流量，src 和 dst 为连接两端的真实地址：
+// src 为发起方向的源地址，dst 为应答方向的源地址，SNAT 和 DNAT 时均为内网主机的地址，而不是网关转换后的地址，
+// orig_ 和 reply_ 开头的字段为 conntrack 中两个方向完整的五元组
+type Record struct {
+	Type       string    `json:"type"`
+	Device     string    `json:"device"`
+	CreateTime time.Time `json:"create_time"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+
+	SrcIP     string `json:"src_ip"`
+	DstIP     string `json:"dst_ip"`
+	SrcPort   uint16 `json:"src_port"`
+	DstPort   uint16 `json:"dst_port"`
+	IPVersion uint8  `json:"ip_version"`
+	Protocol  uint8  `json:"protocol"`
+
+	// 发起方向（src 到 dst）和应答方向的字节数和数据包数，为与上次采样的差值
+	Bytes          int64 `json:"bytes"`
+	Packets        int64 `json:"packets"`
+	ReverseBytes   int64 `json:"reverse_bytes"`
+	ReversePackets int64 `json:"reverse_packets"`
+
+	OrigSrcIP    string `json:"orig_src_ip"`
+	OrigDstIP    string `json:"orig_dst_ip"`
+	OrigSrcPort  uint16 `json:"orig_src_port"`
+	OrigDstPort  uint16 `json:"orig_dst_port"`
+	ReplySrcIP   string `json:"reply_src_ip"`
+	ReplyDstIP   string `json:"reply_dst_ip"`
+	ReplySrcPort uint16 `json:"reply_src_port"`
+	ReplyDstPort uint16 `json:"reply_dst_port"`
+	State        string `json:"state"`
+	Zone         uint16 `json:"zone"`
+	// NAT 表示两个方向的地址不对称，即连接经过了地址转换
+	NAT bool `json:"nat"`
+}
+
+// connKey 以 zone、协议和发起方向的五元组区分连接
+type connKey struct {
+	zone             uint16
+	protocol         uint8
+	srcIP, dstIP     string
+	srcPort, dstPort uint16
+}
+
+type connState struct {
+	firstSeen time.Time
+	original  Tuple
+	reply     Tuple
+}
+
+// Tracker 记录每个连接上次采样的计数，计算每次采样的增量，不能在多个 goroutine 中同时使用
+type Tracker struct {
+	device string
+	conns  map[connKey]*connState
+}
+
+func NewTracker(device string) *Tracker {
+	return &Tracker{device: device, conns: make(map[connKey]*connState)}
+}
+
+// Update 返回本次采样中有流量的连接的增量，已经消失的连接不再记录，
+// 两次采样之间结束的连接在最后一次采样后的流量无法统计。
+// 新出现的连接计入全部计数；计数回退时说明五元组被新连接复用，同样计入全部计数
+func (t *Tracker) Update(entries []Entry, now time.Time) []Record {
+	conns := make(map[connKey]*connState, len(entries))
+	var records []Record
+	for _, e := range entries {
+		k := connKey{
+			zone: e.Zone, protocol: e.Protocol,
+			srcIP: e.Original.SrcIP, dstIP: e.Original.DstIP,
+			srcPort: e.Original.SrcPort, dstPort: e.Original.DstPort,
+		}
+		s, ok := t.conns[k]
+		if !ok || e.Original.Bytes < s.original.Bytes || e.Reply.Bytes < s.reply.Bytes ||
+			e.Original.Packets < s.original.Packets || e.Reply.Packets < s.reply.Packets {
+			s = &connState{firstSeen: now}
+		}
+		r := t.record(e, s, now)
+		s.original, s.reply = e.Original, e.Reply
+		conns[k] = s
+		if r.Packets > 0 || r.ReversePackets > 0 {
+			records = append(records, r)
+		}
+	}
+	t.conns = conns
+	return records
+}
+
+func (t *Tracker) record(e Entry, s *connState, now time.Time) Record {
+	return Record{
+		Type:       RecordType,
+		Device:     t.device,
+		CreateTime: now,
+		FirstSeen:  s.firstSeen,
+		LastSeen:   now,
+
+		SrcIP:     e.Original.SrcIP,
+		DstIP:     e.Reply.SrcIP,
+		SrcPort:   e.Original.SrcPort,
+		DstPort:   e.Reply.SrcPort,
+		IPVersion: e.IPVersion,
+		Protocol:  e.Protocol,
+
+		Bytes:          int64(e.Original.Bytes - s.original.Bytes),
+		Packets:        int64(e.Original.Packets - s.original.Packets),
+		ReverseBytes:   int64(e.Reply.Bytes - s.reply.Bytes),
+		ReversePackets: int64(e.Reply.Packets - s.reply.Packets),
+
+		OrigSrcIP:    e.Original.SrcIP,
+		OrigDstIP:    e.Original.DstIP,
+		OrigSrcPort:  e.Original.SrcPort,
+		OrigDstPort:  e.Original.DstPort,
+		ReplySrcIP:   e.Reply.SrcIP,
+		ReplyDstIP:   e.Reply.DstIP,
+		ReplySrcPort: e.Reply.SrcPort,
+		ReplyDstPort: e.Reply.DstPort,
+		State:        e.State,
+		Zone:         e.Zone,
+		NAT: e.Original.SrcIP != e.Reply.DstIP || e.Original.DstIP != e.Reply.SrcIP ||
+			e.Original.SrcPort != e.Reply.DstPort || e.Original.DstPort != e.Reply.SrcPort,
+	}
+}
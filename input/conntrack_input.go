@@ -0,0 +1,126 @@
+package input
+
+import (
+	"os"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+
+	"traffic-statistics/codec"
+	"traffic-statistics/input/conntrack"
+	"traffic-statistics/pkg/log"
+	"traffic-statistics/topology"
+)
+
+type conntrackConfig struct {
+	// 读取的连接表，默认为 /proc/net/nf_conntrack，需要开启 net.netfilter.nf_conntrack_acct 才有计数
+	Path        string `mapstructure:"path"`
+	Interval    string `mapstructure:"interval"` // 采样间隔，默认为 10s
+	Device      string `mapstructure:"device"`   // 事件的 device 字段，默认为主机名
+	ChannelSize int    `mapstructure:"channel_size"`
+}
+
+// conntrackInput 定时读取连接表，输出每个连接在采样间隔内的流量，
+// 网关上的 NAT 连接按内网主机的真实地址统计，而不是抓包看到的转换后的地址
+type conntrackInput struct {
+	config   conntrackConfig
+	interval time.Duration
+	tracker  *conntrack.Tracker
+	decoder  codec.Decoder
+	records  chan conntrack.Record
+	done     chan struct{}
+}
+
+func init() {
+	register("Conntrack", newConntrackInput)
+}
+
+func newConntrackInput(config map[interface{}]interface{}) topology.InputWorker {
+	c := conntrackConfig{
+		Path:        "/proc/net/nf_conntrack",
+		Interval:    "10s",
+		ChannelSize: 1024,
+	}
+	if err := mapstructure.Decode(config, &c); err != nil {
+		log.Fatalw("decode conntrack config failed", "error", err)
+	}
+	interval, err := time.ParseDuration(c.Interval)
+	if err != nil || interval <= 0 {
+		log.Fatalw("invalid interval in conntrack config", "interval", c.Interval)
+	}
+	if c.Device == "" {
+		if c.Device, err = os.Hostname(); err != nil {
+			log.Fatalw("get hostname failed, set device in conntrack config", "error", err)
+		}
+	}
+	p := &conntrackInput{
+		config:   c,
+		interval: interval,
+		tracker:  conntrack.NewTracker(c.Device),
+		decoder:  codec.NewDecoder("json_tag"),
+		records:  make(chan conntrack.Record, c.ChannelSize),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *conntrackInput) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	// 第一次采样只记录计数，之后的采样输出增量
+	p.sample(time.Now())
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-ticker.C:
+			for _, r := range p.sample(now) {
+				select {
+				case p.records <- r:
+				case <-p.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *conntrackInput) sample(now time.Time) []conntrack.Record {
+	f, err := os.Open(p.config.Path)
+	if err != nil {
+		log.Errorw("open conntrack file failed", "path", p.config.Path, "error", err)
+		return nil
+	}
+	defer f.Close()
+	invalid := 0
+	entries, err := conntrack.Read(f, func(line string, err error) {
+		if invalid++; invalid == 1 {
+			log.Warnw("parse conntrack entry failed", "line", line, "error", err)
+		}
+	})
+	if err != nil {
+		log.Errorw("read conntrack file failed", "path", p.config.Path, "error", err)
+		return nil
+	}
+	if invalid > 1 {
+		log.Warnw("skip invalid conntrack entries", "count", invalid)
+	}
+	if len(entries) > 0 && !entries[0].HasCounters {
+		log.Warnw("conntrack entries have no counters, enable net.netfilter.nf_conntrack_acct", "path", p.config.Path)
+	}
+	return p.tracker.Update(entries, now)
+}
+
+func (p *conntrackInput) ReadOneEvent() map[string]interface{} {
+	select {
+	case <-p.done:
+		return nil
+	case r := <-p.records:
+		return p.decoder.Decode(&r)
+	}
+}
+
+func (p *conntrackInput) Shutdown() {
+	close(p.done)
+}
@@ -0,0 +1,103 @@
+package input
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"traffic-statistics/input/netdata"
+)
+
+// decodeTask 为一个待解析的数据包，data 为 ReadPacketData 返回的副本，可以在其他 goroutine 中使用
+type decodeTask struct {
+	device *deviceCapturer
+	ci     gopacket.CaptureInfo
+	data   []byte
+}
+
+// decodePool 将各设备抓到的数据包分发到多个 goroutine 中解析为 NetData 并交给 PacketHandler，
+// preserveOrder 为 true 时同一设备的数据包总是由同一个 goroutine 解析，保证同一设备的数据顺序不变
+type decodePool struct {
+	handler       *PacketHandler
+	preserveOrder bool
+	tasks         []chan decodeTask
+	next          uint64
+	wg            sync.WaitGroup
+}
+
+func newDecodePool(handler *PacketHandler, workers int, preserveOrder bool, channelSize int) *decodePool {
+	if workers <= 0 {
+		workers = 1
+	}
+	p := &decodePool{
+		handler:       handler,
+		preserveOrder: preserveOrder,
+		tasks:         make([]chan decodeTask, workers),
+	}
+	for i := range p.tasks {
+		p.tasks[i] = make(chan decodeTask, channelSize)
+	}
+	return p
+}
+
+func (p *decodePool) start() {
+	p.wg.Add(len(p.tasks))
+	for _, tasks := range p.tasks {
+		go p.work(tasks)
+	}
+}
+
+// stop 等待已经提交的数据包解析完成，调用前需保证不会再有数据包提交
+func (p *decodePool) stop() {
+	for _, tasks := range p.tasks {
+		close(tasks)
+	}
+	p.wg.Wait()
+}
+
+// workerOf 返回设备固定使用的 goroutine 序号
+func (p *decodePool) workerOf(device string) int {
+	h := fnv.New32a()
+	h.Write([]byte(device))
+	return int(h.Sum32() % uint32(len(p.tasks)))
+}
+
+func (p *decodePool) submit(t decodeTask) {
+	var i int
+	if p.preserveOrder {
+		i = t.device.worker
+	} else {
+		i = int(atomic.AddUint64(&p.next, 1) % uint64(len(p.tasks)))
+	}
+	p.tasks[i] <- t
+}
+
+func (p *decodePool) work(tasks chan decodeTask) {
+	defer p.wg.Done()
+	// Decoder 不能并发使用，每个 goroutine 为每个设备单独创建
+	decoders := make(map[string]*netdata.Decoder)
+	linkTypes := make(map[string]layers.LinkType)
+	for t := range tasks {
+		d := t.device
+		decoder, ok := decoders[d.device]
+		if !ok || linkTypes[d.device] != d.linkType {
+			decoder = netdata.NewDecoder(d.device, d.linkType, p.handler.DecodeOptions)
+			decoders[d.device] = decoder
+			linkTypes[d.device] = d.linkType
+		}
+		netData := decoder.Decode(p.handler.IDGenerater.GenerateID(), t.ci, t.data)
+		select {
+		case p.handler.packet <- netData:
+		default:
+			// 管道已满，记录一次等待后阻塞发送
+			atomic.AddUint64(&d.stats.stalls, 1)
+			p.handler.packet <- netData
+		}
+		atomic.AddUint64(&d.stats.handled, 1)
+		netdata.Add(1)
+		netdata.AddSize(uint64(netData.PackSize))
+	}
+}
@@ -0,0 +1,100 @@
+package input
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"traffic-statistics/input/netdata"
+)
+
+// benchIDGenerater 为不写文件的 ID 生成器
+type benchIDGenerater struct {
+	id uint64
+}
+
+func (g *benchIDGenerater) Start() error       { return nil }
+func (g *benchIDGenerater) Stop() error        { return nil }
+func (g *benchIDGenerater) GenerateID() uint64 { return atomic.AddUint64(&g.id, 1) }
+
+// syntheticPackets 生成 n 个以太网 IPv4 TCP 数据包，地址和端口各不相同
+func syntheticPackets(b *testing.B, n int) [][]byte {
+	packets := make([][]byte, n)
+	payload := gopacket.Payload(make([]byte, 512))
+	for i := range packets {
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP,
+			SrcIP: net.IPv4(10, 0, byte(i>>8), byte(i)), DstIP: net.IPv4(10, 1, byte(i>>8), byte(i))}
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(1024 + i), DstPort: 443, Seq: uint32(i), ACK: true}
+		tcp.SetNetworkLayerForChecksum(ip)
+		eth := &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+			DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, payload); err != nil {
+			b.Fatalf("serialize packet: %v", err)
+		}
+		packets[i] = append([]byte(nil), buf.Bytes()...)
+	}
+	return packets
+}
+
+func BenchmarkDecodePool(b *testing.B) {
+	for _, preserveOrder := range []bool{false, true} {
+		for _, workers := range []int{1, 4} {
+			name := fmt.Sprintf("preserve_order=%v/workers=%d", preserveOrder, workers)
+			b.Run(name, func(b *testing.B) {
+				benchmarkDecodePool(b, workers, preserveOrder)
+			})
+		}
+	}
+}
+
+// benchmarkDecodePool 模拟 4 个设备交替提交数据包，统计从提交到解析结果交给 PacketHandler 的吞吐
+func benchmarkDecodePool(b *testing.B, workers int, preserveOrder bool) {
+	packets := syntheticPackets(b, 1024)
+	handler := &PacketHandler{
+		packet:        make(chan netdata.NetData, 1024),
+		DecodeOptions: netdata.Options{MTU: netdata.DefaultMTU},
+		IDGenerater:   &benchIDGenerater{},
+	}
+	pool := newDecodePool(handler, workers, preserveOrder, 1024)
+	devices := make([]*deviceCapturer, 4)
+	for i := range devices {
+		name := fmt.Sprintf("bench%d", i)
+		devices[i] = &deviceCapturer{device: name, linkType: layers.LinkTypeEthernet, worker: pool.workerOf(name)}
+	}
+	received := make(chan int)
+	go func() {
+		n := 0
+		for range handler.packet {
+			n++
+		}
+		received <- n
+	}()
+	now := time.Now()
+	b.SetBytes(int64(len(packets[0])))
+	b.ReportAllocs()
+	b.ResetTimer()
+	pool.start()
+	for i := 0; i < b.N; i++ {
+		data := packets[i%len(packets)]
+		pool.submit(decodeTask{
+			device: devices[i%len(devices)],
+			ci:     gopacket.CaptureInfo{Timestamp: now, CaptureLength: len(data), Length: len(data)},
+			data:   data,
+		})
+	}
+	pool.stop()
+	close(handler.packet)
+	if n := <-received; n != b.N {
+		b.Fatalf("received %d packets, want %d", n, b.N)
+	}
+}
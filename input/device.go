@@ -0,0 +1,82 @@
+package input
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/google/gopacket/pcap"
+)
+
+const (
+	// deviceTypeWhite 设备为白名单
+	deviceTypeWhite = "white"
+	// deviceTypeBlack 设备为黑名单
+	deviceTypeBlack = "black"
+)
+
+// 以该前缀开头的设备名按正则表达式匹配，否则按 glob 匹配（不含通配符时即为精确匹配）
+const deviceRegexPrefix = "regex:"
+
+type devicePattern struct {
+	glob   string
+	regexp *regexp.Regexp
+}
+
+func (p devicePattern) match(device string) bool {
+	if p.regexp != nil {
+		return p.regexp.MatchString(device)
+	}
+	matched, _ := path.Match(p.glob, device)
+	return matched
+}
+
+func compileDevicePatterns(devices []string) ([]devicePattern, error) {
+	patterns := make([]devicePattern, 0, len(devices))
+	for _, v := range devices {
+		if strings.HasPrefix(v, deviceRegexPrefix) {
+			r, err := regexp.Compile(strings.TrimPrefix(v, deviceRegexPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("invalid device pattern (%s): (%v)", v, err)
+			}
+			patterns = append(patterns, devicePattern{regexp: r})
+			continue
+		}
+		if _, err := path.Match(v, ""); err != nil {
+			return nil, fmt.Errorf("invalid device pattern (%s): (%v)", v, err)
+		}
+		patterns = append(patterns, devicePattern{glob: v})
+	}
+	return patterns, nil
+}
+
+// selectDevices 按白名单或黑名单从 allDevices 中选出需要处理的设备
+func selectDevices(deviceType string, patterns []devicePattern, allDevices []string) []string {
+	selected := make([]string, 0, len(allDevices))
+	for _, v := range allDevices {
+		matched := false
+		for _, p := range patterns {
+			if p.match(v) {
+				matched = true
+				break
+			}
+		}
+		if (deviceType == deviceTypeWhite && matched) || (deviceType == deviceTypeBlack && !matched) {
+			selected = append(selected, v)
+		}
+	}
+	return selected
+}
+
+func deviceToCapture(deviceType string, patterns []devicePattern) ([]string, error) {
+	allDevices, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(allDevices))
+	for _, v := range allDevices {
+		names = append(names, v.Name)
+	}
+	return selectDevices(deviceType, patterns, names), nil
+}
@@ -0,0 +1,30 @@
+package input
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"traffic-statistics/codec"
+	"traffic-statistics/input/conntrack"
+	"traffic-statistics/input/flow"
+	"traffic-statistics/input/netdata"
+	"traffic-statistics/input/netflow"
+)
+
+// eventFieldTypes 为各个 input 输出的事件字段的类型，JSON 格式的事件按此还原，
+// 使 filter 和 output 得到与抓包相同的类型，如 create_time 为 time.Time，pack_size 为 int32
+var eventFieldTypes = codec.FieldTypes("json", netdata.NetData{}, flow.Record{}, netflow.Flow{}, conntrack.Record{})
+
+// decodeEvent 解析一行 JSON 并还原字段类型
+func decodeEvent(line []byte) (map[string]interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(line))
+	d.UseNumber()
+	var event map[string]interface{}
+	if err := d.Decode(&event); err != nil {
+		return nil, err
+	}
+	if err := codec.Restore(event, eventFieldTypes); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
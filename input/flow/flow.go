@@ -0,0 +1,400 @@
+package flow
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"traffic-statistics/input/netdata"
+)
+
+// RecordType 为流记录事件的 type 字段
+const RecordType = "flow"
+
+// 流结束的原因
+const (
+	EndReasonIdle     = "idle"     // 超过 idle_timeout 没有数据包
+	EndReasonActive   = "active"   // 持续时间超过 active_timeout，之后的数据包作为新的流记录
+	EndReasonFIN      = "fin"      // 双方都发送了 FIN
+	EndReasonRST      = "rst"      // 任意一方发送了 RST
+	EndReasonEvicted  = "evicted"  // 流的数量达到 max_flows，最久没有数据包的流被提前输出
+	EndReasonShutdown = "shutdown" // 数据读取结束，输出所有未结束的流
+)
+
+// Record 为一条流记录，src 为流的发起方：第一个数据包的源地址，第一个数据包为 SYN+ACK 时为其目的地址
+type Record struct {
+	Type       string    `json:"type"`
+	Device     string    `json:"device"`
+	CreateTime time.Time `json:"create_time"` // 与 last_seen 相同，用于按时间统计
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+
+	SrcIP     string `json:"src_ip"`
+	DstIP     string `json:"dst_ip"`
+	SrcPort   uint16 `json:"src_port"`
+	DstPort   uint16 `json:"dst_port"`
+	IPVersion uint8  `json:"ip_version"`
+	Protocol  uint8  `json:"protocol"`
+
+	// src 到 dst 方向的字节数和数据包数，字节数为线路长度
+	Bytes   int64 `json:"bytes"`
+	Packets int64 `json:"packets"`
+	// dst 到 src 方向的字节数和数据包数
+	ReverseBytes   int64 `json:"reverse_bytes"`
+	ReversePackets int64 `json:"reverse_packets"`
+
+	TCPFlags  uint8  `json:"tcp_flags"` // 两个方向所有数据包 TCP 标志位的并集
+	EndReason string `json:"end_reason"`
+
+	// 以下字段在开启 tcp_metrics 后填充，为两个方向之和
+	HandshakeRTT    int64 `json:"handshake_rtt_us"` // 从 SYN 到三次握手最后一个 ACK 的时间，单位为微秒
+	Retransmissions int64 `json:"retransmissions"`  // 与已经收到的数据重叠的数据包
+	OutOfOrder      int64 `json:"out_of_order"`     // 先于前面的数据到达的数据包
+	MissingBytes    int64 `json:"missing_bytes"`    // 一直没有抓到的数据，通常由丢包引起
+	ZeroWindows     int64 `json:"zero_windows"`
+	Resets          int64 `json:"resets"`
+}
+
+// Options 为流表的配置
+type Options struct {
+	ActiveTimeout time.Duration
+	IdleTimeout   time.Duration
+	// 双方都发送 FIN 或者任意一方发送 RST 后，等待该时间再输出，使最后的 ACK 计入同一条流
+	CloseTimeout time.Duration
+	MaxFlows     int
+	// 开启后使用 TCP 重组统计连接质量，数据包需要按顺序到达，否则会误判为乱序
+	TCPMetrics bool
+}
+
+// key 为双向流的标识，两个端点按大小排序，两个方向的数据包使用同一个 key
+type key struct {
+	device   string
+	protocol uint8
+	ipA, ipB string
+	portA    uint16
+	portB    uint16
+}
+
+type endpoint struct {
+	ip   string
+	port uint16
+}
+
+func newKey(n *netdata.NetData) (key, endpoint) {
+	src := endpoint{ip: n.SrcIP, port: n.SrcPort}
+	dst := endpoint{ip: n.DstIP, port: n.DstPort}
+	k := key{device: n.Device, protocol: n.Protocol}
+	if src.ip < dst.ip || (src.ip == dst.ip && src.port <= dst.port) {
+		k.ipA, k.portA, k.ipB, k.portB = src.ip, src.port, dst.ip, dst.port
+	} else {
+		k.ipA, k.portA, k.ipB, k.portB = dst.ip, dst.port, src.ip, src.port
+	}
+	return k, src
+}
+
+type entry struct {
+	key    key
+	record Record
+	// finSrc、finDst 分别表示 src、dst 是否发送了 FIN
+	finSrc, finDst bool
+	closedAt       time.Time
+	element        *list.Element // 在 Table.lru 中的位置
+}
+
+// Table 为双向流表，数据包按 5 元组和设备聚合为流记录，流结束时通过 emit 输出，
+// 超时按数据包的时间判断，没有数据包时按实际经过的时间推进，回放历史文件时也能正确超时
+type Table struct {
+	options Options
+	emit    func(Record)
+
+	lock  sync.Mutex
+	flows map[key]*entry
+	// lru 按最后一个数据包的时间排序，最久没有数据包的流在最前面
+	lru *list.List
+	// closing 为已经结束、等待 CloseTimeout 后输出的流
+	closing map[key]*entry
+	// evicted 为开启 tcp_metrics 时被提前输出的 TCP 流，已经不在 flows 中，
+	// 下一次 Expire 处理重组中等待的数据后再输出，避免每次淘汰都遍历设备上所有的连接
+	evicted map[key]*entry
+
+	clock     time.Time // 最新的数据包时间
+	clockWall time.Time // 更新 clock 时的实际时间
+
+	trackers map[string]*tcpTracker // 按设备区分，同一连接经过多个设备时分别重组
+}
+
+func NewTable(o Options, emit func(Record)) *Table {
+	return &Table{
+		options:  o,
+		emit:     emit,
+		flows:    make(map[key]*entry),
+		lru:      list.New(),
+		closing:  make(map[key]*entry),
+		evicted:  make(map[key]*entry),
+		trackers: make(map[string]*tcpTracker),
+	}
+}
+
+// Add 将一个数据包计入所属的流，不是 IP 数据包时忽略
+func (t *Table) Add(n *netdata.NetData) {
+	if n.SrcIP == "" || n.DstIP == "" {
+		return
+	}
+	var emits []Record
+	t.lock.Lock()
+	if n.CreateTime.After(t.clock) {
+		t.clock = n.CreateTime
+		t.clockWall = time.Now()
+	}
+	k, src := newKey(n)
+	e := t.flows[k]
+	if e != nil && n.CreateTime.Sub(e.record.FirstSeen) >= t.options.ActiveTimeout {
+		emits = append(emits, t.remove(e, EndReasonActive))
+		e = nil
+	}
+	if e == nil {
+		if len(t.flows) >= t.options.MaxFlows {
+			if r, ok := t.evict(t.lru.Front().Value.(*entry)); ok {
+				emits = append(emits, r)
+			}
+		}
+		e = t.newEntry(k, src, n)
+	}
+	e.update(src, n)
+	if t.options.TCPMetrics && n.Protocol == uint8(layers.IPProtocolTCP) {
+		t.tracker(n.Device).add(n, t, k)
+	}
+	t.lru.MoveToBack(e.element)
+	if e.closedAt.IsZero() && e.closed() {
+		e.closedAt = n.CreateTime
+		t.closing[k] = e
+	}
+	t.lock.Unlock()
+	for _, r := range emits {
+		t.emit(r)
+	}
+}
+
+func (t *Table) newEntry(k key, src endpoint, n *netdata.NetData) *entry {
+	// 第一个数据包为 SYN+ACK 时，发起方为其目的地址
+	if n.TCPFlags&(netdata.TCPFlagSYN|netdata.TCPFlagACK) == netdata.TCPFlagSYN|netdata.TCPFlagACK {
+		src = endpoint{ip: n.DstIP, port: n.DstPort}
+	}
+	e := &entry{
+		key: k,
+		record: Record{
+			Type:      RecordType,
+			Device:    n.Device,
+			FirstSeen: n.CreateTime,
+			SrcIP:     src.ip,
+			SrcPort:   src.port,
+			IPVersion: n.IPVersion,
+			Protocol:  n.Protocol,
+		},
+	}
+	if src.ip == n.SrcIP && src.port == n.SrcPort {
+		e.record.DstIP, e.record.DstPort = n.DstIP, n.DstPort
+	} else {
+		e.record.DstIP, e.record.DstPort = n.SrcIP, n.SrcPort
+	}
+	e.element = t.lru.PushBack(e)
+	t.flows[k] = e
+	return e
+}
+
+func (e *entry) update(src endpoint, n *netdata.NetData) {
+	r := &e.record
+	forward := src.ip == r.SrcIP && src.port == r.SrcPort
+	if forward {
+		r.Bytes += int64(n.WireBytes)
+		r.Packets++
+	} else {
+		r.ReverseBytes += int64(n.WireBytes)
+		r.ReversePackets++
+	}
+	if n.CreateTime.After(r.LastSeen) {
+		r.LastSeen = n.CreateTime
+	}
+	r.TCPFlags |= n.TCPFlags
+	if n.TCPFlags&netdata.TCPFlagFIN != 0 {
+		if forward {
+			e.finSrc = true
+		} else {
+			e.finDst = true
+		}
+	}
+}
+
+func (e *entry) closed() bool {
+	if e.record.Protocol != uint8(layers.IPProtocolTCP) {
+		return false
+	}
+	return e.record.TCPFlags&netdata.TCPFlagRST != 0 || (e.finSrc && e.finDst)
+}
+
+// endReason 返回流结束的原因，已经结束的 TCP 流使用 FIN 或 RST，否则使用 reason
+func (e *entry) endReason(reason string) string {
+	if e.closedAt.IsZero() {
+		return reason
+	}
+	if e.record.TCPFlags&netdata.TCPFlagRST != 0 {
+		return EndReasonRST
+	}
+	return EndReasonFIN
+}
+
+// detach 从流表中删除流，调用方需持有锁
+func (t *Table) detach(e *entry) {
+	delete(t.flows, e.key)
+	delete(t.closing, e.key)
+	t.lru.Remove(e.element)
+}
+
+// remove 从流表中删除流并返回流记录，调用方需持有锁
+func (t *Table) remove(e *entry, reason string) Record {
+	t.detach(e)
+	return e.finish(reason)
+}
+
+func (e *entry) finish(reason string) Record {
+	e.record.EndReason = reason
+	e.record.CreateTime = e.record.LastSeen
+	return e.record
+}
+
+// evict 提前输出最久没有数据包的流，调用方需持有锁。开启 tcp_metrics 时 TCP 流放入 evicted 等待下一次 Expire，
+// 返回的 bool 为 false；同一 key 的流再次被淘汰时，之前等待的流直接输出
+func (t *Table) evict(e *entry) (Record, bool) {
+	if !t.options.TCPMetrics || e.record.Protocol != uint8(layers.IPProtocolTCP) {
+		return t.remove(e, EndReasonEvicted), true
+	}
+	t.detach(e)
+	old, ok := t.evicted[e.key]
+	t.evicted[e.key] = e
+	if ok {
+		return old.finish(EndReasonEvicted), true
+	}
+	return Record{}, false
+}
+
+// lookup 返回 key 对应的流，包括等待输出的被淘汰的流，调用方需持有锁
+func (t *Table) lookup(k key) *entry {
+	if e, ok := t.flows[k]; ok {
+		return e
+	}
+	return t.evicted[k]
+}
+
+// flushTCP 在输出流之前处理这些流在重组中等待的数据，使统计结果计入这些流，调用方需持有锁。
+// reassembly 只能按时间 flush 整个设备，每个设备只 flush 一次，早于这些流最后一个数据包的乱序数据会一起处理，
+// 因此只用于被提前输出的流（最久没有数据包）和已经结束的流（不会再有数据）。
+// 达到 active_timeout 的流不需要处理，之后的数据包和等待的数据按 key 计入同一连接的新流
+func (t *Table) flushTCP(entries []*entry) {
+	if !t.options.TCPMetrics {
+		return
+	}
+	last := make(map[string]time.Time)
+	for _, e := range entries {
+		if e.record.Protocol == uint8(layers.IPProtocolTCP) && e.record.LastSeen.After(last[e.key.device]) {
+			last[e.key.device] = e.record.LastSeen
+		}
+	}
+	for device, t0 := range last {
+		if tracker, ok := t.trackers[device]; ok {
+			tracker.flushBefore(t0.Add(time.Nanosecond))
+		}
+	}
+}
+
+// evictedEntries 返回等待输出的被淘汰的流，按最后一个数据包的时间排序，调用方需持有锁
+func (t *Table) evictedEntries() []*entry {
+	entries := make([]*entry, 0, len(t.evicted))
+	for _, e := range t.evicted {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].record.LastSeen.Before(entries[j].record.LastSeen)
+	})
+	return entries
+}
+
+// emitEvicted 输出等待输出的被淘汰的流，调用方需持有锁，并且已经处理了这些流在重组中等待的数据
+func (t *Table) emitEvicted(entries []*entry, emits []Record) []Record {
+	for _, e := range entries {
+		delete(t.evicted, e.key)
+		emits = append(emits, e.finish(EndReasonEvicted))
+	}
+	return emits
+}
+
+// now 返回流表的当前时间，最后一个数据包之后经过的实际时间也计算在内
+func (t *Table) now() time.Time {
+	if t.clock.IsZero() {
+		return t.clock
+	}
+	return t.clock.Add(time.Since(t.clockWall))
+}
+
+func (t *Table) tracker(device string) *tcpTracker {
+	tracker, ok := t.trackers[device]
+	if !ok {
+		tracker = newTCPTracker()
+		t.trackers[device] = tracker
+	}
+	return tracker
+}
+
+// Expire 输出已经超时或结束的流，需要定期调用
+func (t *Table) Expire() {
+	var emits []Record
+	t.lock.Lock()
+	now := t.now()
+	// 先处理重组中等待的数据，使统计结果计入即将输出的流
+	for _, tracker := range t.trackers {
+		tracker.flush(now.Add(-t.options.CloseTimeout), now.Add(-t.options.IdleTimeout))
+	}
+	evicted := t.evictedEntries()
+	closed := make([]*entry, 0)
+	for _, e := range t.closing {
+		if now.Sub(e.closedAt) >= t.options.CloseTimeout {
+			closed = append(closed, e)
+		}
+	}
+	t.flushTCP(append(closed, evicted...))
+	emits = t.emitEvicted(evicted, emits)
+	for _, e := range closed {
+		emits = append(emits, t.remove(e, e.endReason(EndReasonIdle)))
+	}
+	for t.lru.Len() > 0 {
+		e := t.lru.Front().Value.(*entry)
+		if now.Sub(e.record.LastSeen) < t.options.IdleTimeout {
+			break
+		}
+		emits = append(emits, t.remove(e, e.endReason(EndReasonIdle)))
+	}
+	t.lock.Unlock()
+	for _, r := range emits {
+		t.emit(r)
+	}
+}
+
+// Flush 输出所有流
+func (t *Table) Flush() {
+	var emits []Record
+	t.lock.Lock()
+	for _, tracker := range t.trackers {
+		tracker.flushAll()
+	}
+	emits = t.emitEvicted(t.evictedEntries(), emits)
+	for t.lru.Len() > 0 {
+		e := t.lru.Front().Value.(*entry)
+		emits = append(emits, t.remove(e, e.endReason(EndReasonShutdown)))
+	}
+	t.lock.Unlock()
+	for _, r := range emits {
+		t.emit(r)
+	}
+}
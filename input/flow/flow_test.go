@@ -0,0 +1,227 @@
+package flow
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"traffic-statistics/input/netdata"
+)
+
+var testStart = time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC)
+
+const (
+	client = "10.0.0.1"
+	server = "10.0.0.2"
+)
+
+// packet 返回 eth0 上 at 毫秒时的数据包，flags 为 0 时为 UDP 数据包
+func packet(at int, src string, sport uint16, dst string, dport uint16, flags uint8) *netdata.NetData {
+	n := &netdata.NetData{
+		Device: "eth0", CreateTime: testStart.Add(time.Duration(at) * time.Millisecond),
+		SrcIP: src, DstIP: dst, SrcPort: sport, DstPort: dport, IPVersion: 4,
+		Protocol: uint8(layers.IPProtocolUDP), WireBytes: 100,
+	}
+	if flags != 0 {
+		n.Protocol = uint8(layers.IPProtocolTCP)
+		n.TCPFlags = flags
+	}
+	return n
+}
+
+const (
+	syn    = netdata.TCPFlagSYN
+	synAck = netdata.TCPFlagSYN | netdata.TCPFlagACK
+	ack    = netdata.TCPFlagACK
+	finAck = netdata.TCPFlagFIN | netdata.TCPFlagACK
+	rst    = netdata.TCPFlagRST
+)
+
+// step 为一个数据包，或者 packet 为 nil 时调用 Expire，flush 为 true 时调用 Flush
+type step struct {
+	packet *netdata.NetData
+	flush  bool
+}
+
+// summary 为测试关心的流记录字段
+type summary struct {
+	SrcIP          string
+	SrcPort        uint16
+	DstPort        uint16
+	Packets        int64
+	ReversePackets int64
+	ReverseBytes   int64
+	EndReason      string
+	LastSeen       int // 毫秒
+}
+
+func summarize(r Record) summary {
+	return summary{
+		SrcIP: r.SrcIP, SrcPort: r.SrcPort, DstPort: r.DstPort,
+		Packets: r.Packets, ReversePackets: r.ReversePackets, ReverseBytes: r.ReverseBytes,
+		EndReason: r.EndReason, LastSeen: int(r.LastSeen.Sub(testStart) / time.Millisecond),
+	}
+}
+
+func TestTable(t *testing.T) {
+	options := Options{
+		ActiveTimeout: time.Minute,
+		IdleTimeout:   15 * time.Second,
+		CloseTimeout:  2 * time.Second,
+		MaxFlows:      3,
+	}
+	expire := step{}
+	flush := step{flush: true}
+	tests := []struct {
+		name  string
+		steps []step
+		want  []summary
+	}{
+		{
+			name: "active timeout",
+			steps: []step{
+				{packet: packet(0, client, 1000, server, 53, 0)},
+				{packet: packet(30000, server, 53, client, 1000, 0)},
+				// 持续时间达到 active_timeout，之前的数据输出，该数据包开始新的流记录
+				{packet: packet(60000, client, 1000, server, 53, 0)},
+				flush,
+			},
+			want: []summary{
+				{SrcIP: client, SrcPort: 1000, DstPort: 53, Packets: 1, ReversePackets: 1, ReverseBytes: 100,
+					EndReason: EndReasonActive, LastSeen: 30000},
+				{SrcIP: client, SrcPort: 1000, DstPort: 53, Packets: 1, EndReason: EndReasonShutdown, LastSeen: 60000},
+			},
+		},
+		{
+			name: "idle timeout",
+			steps: []step{
+				{packet: packet(0, client, 1000, server, 53, 0)},
+				{packet: packet(10000, client, 1001, server, 53, 0)},
+				// 另一条流的数据包推进时间，第一条流超过 idle_timeout
+				{packet: packet(15000, client, 1002, server, 53, 0)},
+				expire,
+				{packet: packet(25000, client, 1002, server, 53, 0)},
+				expire,
+			},
+			want: []summary{
+				{SrcIP: client, SrcPort: 1000, DstPort: 53, Packets: 1, EndReason: EndReasonIdle, LastSeen: 0},
+				{SrcIP: client, SrcPort: 1001, DstPort: 53, Packets: 1, EndReason: EndReasonIdle, LastSeen: 10000},
+			},
+		},
+		{
+			name: "fin with close timeout",
+			steps: []step{
+				{packet: packet(0, client, 40000, server, 443, syn)},
+				{packet: packet(10, server, 443, client, 40000, synAck)},
+				{packet: packet(20, client, 40000, server, 443, ack)},
+				{packet: packet(1000, client, 40000, server, 443, finAck)},
+				{packet: packet(1010, server, 443, client, 40000, finAck)},
+				// 双方 FIN 之后等待 close_timeout，最后的 ACK 计入同一条流
+				{packet: packet(1020, client, 40000, server, 443, ack)},
+				{packet: packet(2500, client, 1000, server, 53, 0)},
+				expire,
+				{packet: packet(3100, client, 1000, server, 53, 0)},
+				expire,
+			},
+			want: []summary{
+				{SrcIP: client, SrcPort: 40000, DstPort: 443, Packets: 4, ReversePackets: 2, ReverseBytes: 200,
+					EndReason: EndReasonFIN, LastSeen: 1020},
+			},
+		},
+		{
+			name: "rst",
+			steps: []step{
+				{packet: packet(0, client, 40000, server, 443, syn)},
+				{packet: packet(10, server, 443, client, 40000, rst)},
+				{packet: packet(3000, client, 1000, server, 53, 0)},
+				expire,
+			},
+			want: []summary{
+				{SrcIP: client, SrcPort: 40000, DstPort: 443, Packets: 1, ReversePackets: 1, ReverseBytes: 100,
+					EndReason: EndReasonRST, LastSeen: 10},
+			},
+		},
+		{
+			name: "syn ack first",
+			steps: []step{
+				// 没有抓到 SYN，SYN+ACK 的目的地址为发起方
+				{packet: packet(0, server, 443, client, 40000, synAck)},
+				{packet: packet(10, client, 40000, server, 443, ack)},
+				flush,
+			},
+			want: []summary{
+				{SrcIP: client, SrcPort: 40000, DstPort: 443, Packets: 1, ReversePackets: 1, ReverseBytes: 100,
+					EndReason: EndReasonShutdown, LastSeen: 10},
+			},
+		},
+		{
+			name: "lru eviction",
+			steps: []step{
+				{packet: packet(0, client, 1000, server, 53, 0)},
+				{packet: packet(10, client, 1001, server, 53, 0)},
+				{packet: packet(20, client, 1002, server, 53, 0)},
+				// 1000 有了新的数据包，最久没有数据包的是 1001
+				{packet: packet(30, server, 53, client, 1000, 0)},
+				{packet: packet(40, client, 1003, server, 53, 0)},
+				flush,
+			},
+			want: []summary{
+				{SrcIP: client, SrcPort: 1001, DstPort: 53, Packets: 1, EndReason: EndReasonEvicted, LastSeen: 10},
+				{SrcIP: client, SrcPort: 1002, DstPort: 53, Packets: 1, EndReason: EndReasonShutdown, LastSeen: 20},
+				{SrcIP: client, SrcPort: 1000, DstPort: 53, Packets: 1, ReversePackets: 1, ReverseBytes: 100,
+					EndReason: EndReasonShutdown, LastSeen: 30},
+				{SrcIP: client, SrcPort: 1003, DstPort: 53, Packets: 1, EndReason: EndReasonShutdown, LastSeen: 40},
+			},
+		},
+		{
+			name: "flush closing flow",
+			steps: []step{
+				{packet: packet(0, client, 40000, server, 443, syn)},
+				{packet: packet(10, server, 443, client, 40000, rst)},
+				// 还在等待 close_timeout 的流使用 FIN 或 RST 作为结束原因
+				flush,
+				flush,
+			},
+			want: []summary{
+				{SrcIP: client, SrcPort: 40000, DstPort: 443, Packets: 1, ReversePackets: 1, ReverseBytes: 100,
+					EndReason: EndReasonRST, LastSeen: 10},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []summary
+			table := NewTable(options, func(r Record) {
+				if r.Type != RecordType || r.Device != "eth0" || !r.CreateTime.Equal(r.LastSeen) {
+					t.Errorf("record = %+v", r)
+				}
+				got = append(got, summarize(r))
+			})
+			for _, s := range tt.steps {
+				switch {
+				case s.packet != nil:
+					table.Add(s.packet)
+				case s.flush:
+					table.Flush()
+				default:
+					table.Expire()
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("records:\n got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTableIgnoresNonIP(t *testing.T) {
+	table := NewTable(Options{MaxFlows: 1}, func(r Record) {
+		t.Errorf("unexpected record %+v", r)
+	})
+	table.Add(&netdata.NetData{Device: "eth0", CreateTime: testStart, SrcMAC: "02:00:00:00:00:01"})
+	if len(table.flows) != 0 {
+		t.Errorf("table has %d flows, want 0", len(table.flows))
+	}
+}
@@ -0,0 +1,167 @@
+package flow
+
+import (
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+
+	"traffic-statistics/input/netdata"
+)
+
+const (
+	// 乱序数据包最多缓存的页数，超过后跳过缺失的数据，避免占用过多内存
+	maxBufferedPagesTotal         = 4096
+	maxBufferedPagesPerConnection = 16
+)
+
+// zeroPayload 为 TCP 负载的占位，NetData 中只有负载长度，重组只依赖序列号和长度，不需要实际内容
+var zeroPayload = make([]byte, 256*1024)
+
+// tcpContext 随数据包传给 reassembly，回调中通过它找到数据包所属的流。
+// 乱序的数据可能在之后的数据包或 flush 时才交给回调，此时携带的仍然是放入缓存时的数据包的 context，
+// 因此在回调时按 key 查找流，而不是保存放入时的流，流已经输出时为 nil
+type tcpContext struct {
+	ci    gopacket.CaptureInfo
+	table *Table
+	key   key
+}
+
+func (c *tcpContext) GetCaptureInfo() gopacket.CaptureInfo {
+	return c.ci
+}
+
+func (c *tcpContext) entry() *entry {
+	return c.table.lookup(c.key)
+}
+
+// tcpTracker 使用 gopacket 的 reassembly 重组一个设备的 TCP 流，统计握手时延、重传、乱序、零窗口和 RST，
+// 统计结果写入数据包所属的流记录，Assembler 不能并发使用，调用方需持有 Table 的锁
+type tcpTracker struct {
+	assembler *reassembly.Assembler
+	tcp       layers.TCP
+}
+
+func newTCPTracker() *tcpTracker {
+	assembler := reassembly.NewAssembler(reassembly.NewStreamPool(&tcpStreamFactory{}))
+	assembler.MaxBufferedPagesTotal = maxBufferedPagesTotal
+	assembler.MaxBufferedPagesPerConnection = maxBufferedPagesPerConnection
+	return &tcpTracker{assembler: assembler}
+}
+
+// add 将 TCP 数据包交给 reassembly，NetData 中的 TCP 字段还原为 layers.TCP
+func (t *tcpTracker) add(n *netdata.NetData, table *Table, k key) {
+	src, dst := net.ParseIP(n.SrcIP), net.ParseIP(n.DstIP)
+	endpointType := layers.EndpointIPv6
+	if n.IPVersion == netdata.IPVersion4 {
+		src, dst = src.To4(), dst.To4()
+		endpointType = layers.EndpointIPv4
+	}
+	if src == nil || dst == nil {
+		return
+	}
+	payloadLength := int(n.PayloadLength)
+	if payloadLength > len(zeroPayload) {
+		payloadLength = len(zeroPayload)
+	}
+	t.tcp = layers.TCP{
+		SrcPort: layers.TCPPort(n.SrcPort),
+		DstPort: layers.TCPPort(n.DstPort),
+		Seq:     n.TCPSeq,
+		Ack:     n.TCPAck,
+		Window:  n.TCPWindow,
+		FIN:     n.TCPFlags&netdata.TCPFlagFIN != 0,
+		SYN:     n.TCPFlags&netdata.TCPFlagSYN != 0,
+		RST:     n.TCPFlags&netdata.TCPFlagRST != 0,
+		PSH:     n.TCPFlags&netdata.TCPFlagPSH != 0,
+		ACK:     n.TCPFlags&netdata.TCPFlagACK != 0,
+		URG:     n.TCPFlags&netdata.TCPFlagURG != 0,
+		ECE:     n.TCPFlags&netdata.TCPFlagECE != 0,
+		CWR:     n.TCPFlags&netdata.TCPFlagCWR != 0,
+	}
+	t.tcp.Payload = zeroPayload[:payloadLength]
+	netFlow := gopacket.NewFlow(endpointType, src, dst)
+	ci := gopacket.CaptureInfo{Timestamp: n.CreateTime}
+	t.assembler.AssembleWithContext(netFlow, &t.tcp, &tcpContext{ci: ci, table: table, key: k})
+}
+
+// flush 不再等待 before 之前缺失的数据，closeBefore 之后没有数据包的连接关闭
+func (t *tcpTracker) flush(before, closeBefore time.Time) {
+	t.assembler.FlushWithOptions(reassembly.FlushOptions{T: before, TC: closeBefore})
+}
+
+// flushBefore 不再等待 before 之前缺失的数据，不关闭连接
+func (t *tcpTracker) flushBefore(before time.Time) {
+	t.assembler.FlushWithOptions(reassembly.FlushOptions{T: before})
+}
+
+func (t *tcpTracker) flushAll() {
+	t.assembler.FlushAll()
+}
+
+type tcpStreamFactory struct{}
+
+func (f *tcpStreamFactory) New(netFlow, tcpFlow gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
+	return &tcpStream{}
+}
+
+// tcpStream 为一个 TCP 连接，记录三次握手的时间
+type tcpStream struct {
+	// entry 为握手状态所属的流，5 元组被新的流复用时重新记录
+	entry       *entry
+	synTime     time.Time
+	synAckSeen  bool
+	rttReported bool
+}
+
+func (s *tcpStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	// 抓包开始时已经建立的连接没有 SYN，强制开始重组
+	*start = true
+	e := ac.(*tcpContext).entry()
+	if e == nil {
+		return true
+	}
+	if s.entry != e {
+		s.entry = e
+		s.synTime, s.synAckSeen, s.rttReported = time.Time{}, false, false
+	}
+	r := &e.record
+	switch {
+	case tcp.SYN && !tcp.ACK:
+		if s.synTime.IsZero() {
+			s.synTime = ci.Timestamp
+		}
+	case tcp.SYN && tcp.ACK:
+		s.synAckSeen = !s.synTime.IsZero()
+	case tcp.ACK && !tcp.RST && s.synAckSeen && !s.rttReported:
+		// 三次握手的最后一个 ACK，时延包括抓包点到两端的往返时间
+		r.HandshakeRTT = ci.Timestamp.Sub(s.synTime).Microseconds()
+		s.rttReported = true
+	}
+	if tcp.RST {
+		r.Resets++
+	} else if tcp.Window == 0 && !tcp.SYN && !tcp.FIN {
+		r.ZeroWindows++
+	}
+	return true
+}
+
+func (s *tcpStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
+	e := ac.(*tcpContext).entry()
+	if e == nil {
+		return
+	}
+	r := &e.record
+	stats := sg.Stats()
+	r.Retransmissions += int64(stats.OverlapPackets)
+	r.OutOfOrder += int64(stats.QueuedPackets)
+	if _, _, _, skip := sg.Info(); skip > 0 {
+		r.MissingBytes += int64(skip)
+	}
+}
+
+func (s *tcpStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
+	return true
+}
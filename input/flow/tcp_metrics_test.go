@@ -0,0 +1,173 @@
+package flow
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"traffic-statistics/input/netdata"
+)
+
+// tcpSegment 为测试中的一个 TCP 数据包，fromClient 为 false 时由 server 发出
+type tcpSegment struct {
+	at         int // 毫秒
+	fromClient bool
+	sport      uint16
+	seq, ack   uint32
+	flags      uint8
+	window     uint16
+	payload    int
+}
+
+// decodeSegment 使用 gopacket 构造以太网数据包，再按抓包时的流程解析为 NetData
+func decodeSegment(t *testing.T, s tcpSegment) *netdata.NetData {
+	t.Helper()
+	src, dst := client, server
+	sport, dport := s.sport, uint16(443)
+	if !s.fromClient {
+		src, dst, sport, dport = dst, src, dport, sport
+	}
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP,
+		SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(sport), DstPort: layers.TCPPort(dport),
+		Seq: s.seq, Ack: s.ack, Window: s.window,
+		FIN: s.flags&netdata.TCPFlagFIN != 0,
+		SYN: s.flags&netdata.TCPFlagSYN != 0,
+		RST: s.flags&netdata.TCPFlagRST != 0,
+		ACK: s.flags&netdata.TCPFlagACK != 0,
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(make([]byte, s.payload))); err != nil {
+		t.Fatalf("serialize packet: %v", err)
+	}
+	data := buf.Bytes()
+	ci := gopacket.CaptureInfo{
+		Timestamp:     testStart.Add(time.Duration(s.at) * time.Millisecond),
+		CaptureLength: len(data),
+		Length:        len(data),
+	}
+	n := netdata.NewDecoder("eth0", layers.LinkTypeEthernet, netdata.Options{}).Decode(1, ci, data)
+	return &n
+}
+
+// metrics 为测试关心的 TCP 统计字段
+type metrics struct {
+	SrcPort         uint16
+	EndReason       string
+	HandshakeRTT    int64
+	Retransmissions int64
+	OutOfOrder      int64
+	MissingBytes    int64
+	ZeroWindows     int64
+	Resets          int64
+}
+
+func TestTableTCPMetrics(t *testing.T) {
+	const window = 65535
+	// client 以 100、server 以 500 为初始序列号完成三次握手，握手时延为 30ms
+	handshake := []tcpSegment{
+		{at: 0, fromClient: true, sport: 40000, seq: 100, flags: syn, window: window},
+		{at: 10, sport: 40000, seq: 500, ack: 101, flags: synAck, window: window},
+		{at: 30, fromClient: true, sport: 40000, seq: 101, ack: 501, flags: ack, window: window},
+	}
+	tests := []struct {
+		name     string
+		segments []tcpSegment
+		flush    bool // 为 false 时调用 Expire
+		want     metrics
+	}{
+		{
+			name:     "handshake rtt",
+			segments: handshake,
+			flush:    true,
+			want:     metrics{SrcPort: 40000, EndReason: EndReasonShutdown, HandshakeRTT: 30000},
+		},
+		{
+			name: "retransmission",
+			segments: append(handshake[:3:3],
+				tcpSegment{at: 40, fromClient: true, sport: 40000, seq: 101, ack: 501, flags: ack, window: window, payload: 100},
+				tcpSegment{at: 240, fromClient: true, sport: 40000, seq: 101, ack: 501, flags: ack, window: window, payload: 100},
+				// 完全重复的数据包不会交给回调，重传次数随之后的数据一起统计
+				tcpSegment{at: 250, fromClient: true, sport: 40000, seq: 201, ack: 501, flags: ack, window: window, payload: 100},
+			),
+			flush: true,
+			want:  metrics{SrcPort: 40000, EndReason: EndReasonShutdown, HandshakeRTT: 30000, Retransmissions: 1},
+		},
+		{
+			name: "zero window",
+			segments: append(handshake[:3:3],
+				tcpSegment{at: 40, fromClient: true, sport: 40000, seq: 101, ack: 501, flags: ack, window: window, payload: 100},
+				tcpSegment{at: 50, sport: 40000, seq: 501, ack: 201, flags: ack, window: 0},
+				tcpSegment{at: 60, sport: 40000, seq: 501, ack: 201, flags: ack, window: 0},
+			),
+			flush: true,
+			want:  metrics{SrcPort: 40000, EndReason: EndReasonShutdown, HandshakeRTT: 30000, ZeroWindows: 2},
+		},
+		{
+			name: "rst",
+			segments: append(handshake[:3:3],
+				tcpSegment{at: 40, sport: 40000, seq: 501, ack: 101, flags: rst},
+				// 另一个连接推进时间，RST 之后超过 close_timeout
+				tcpSegment{at: 3000, fromClient: true, sport: 40001, seq: 1000, flags: syn, window: window},
+			),
+			want: metrics{SrcPort: 40000, EndReason: EndReasonRST, HandshakeRTT: 30000, Resets: 1},
+		},
+		{
+			name: "evicted with queued data",
+			segments: append(handshake[:3:3],
+				// 缺少 101 开始的 100 字节，之后的数据在重组中等待
+				tcpSegment{at: 40, fromClient: true, sport: 40000, seq: 201, ack: 501, flags: ack, window: window, payload: 100},
+				// max_flows 为 1，新的连接淘汰第一个连接，等待的数据在 Expire 时计入被淘汰的流
+				tcpSegment{at: 50, fromClient: true, sport: 40001, seq: 1000, flags: syn, window: window},
+			),
+			want: metrics{SrcPort: 40000, EndReason: EndReasonEvicted, HandshakeRTT: 30000, OutOfOrder: 1, MissingBytes: 100},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxFlows := 10
+			if tt.want.EndReason == EndReasonEvicted {
+				maxFlows = 1
+			}
+			var got []metrics
+			table := NewTable(Options{
+				ActiveTimeout: time.Minute,
+				IdleTimeout:   15 * time.Second,
+				CloseTimeout:  2 * time.Second,
+				MaxFlows:      maxFlows,
+				TCPMetrics:    true,
+			}, func(r Record) {
+				got = append(got, metrics{
+					SrcPort: r.SrcPort, EndReason: r.EndReason, HandshakeRTT: r.HandshakeRTT,
+					Retransmissions: r.Retransmissions, OutOfOrder: r.OutOfOrder, MissingBytes: r.MissingBytes,
+					ZeroWindows: r.ZeroWindows, Resets: r.Resets,
+				})
+			})
+			for _, s := range tt.segments {
+				table.Add(decodeSegment(t, s))
+			}
+			if tt.flush {
+				table.Flush()
+			} else {
+				if len(got) != 0 {
+					t.Fatalf("records %+v before Expire", got)
+				}
+				table.Expire()
+			}
+			if len(got) == 0 || got[0] != tt.want {
+				t.Errorf("records = %+v, want first %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package input
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+
+	"traffic-statistics/pkg/log"
+	"traffic-statistics/topology"
+)
+
+// 网卡计数事件的 type 字段取值
+const eventTypeInterfaceStats = "interface_stats"
+
+// interfaceCounters 为 statistics 目录下读取的计数器
+var interfaceCounters = []string{
+	"rx_bytes", "tx_bytes",
+	"rx_packets", "tx_packets",
+	"rx_errors", "tx_errors",
+	"rx_dropped", "tx_dropped",
+}
+
+type interfaceStatsConfig struct {
+	// 读取网卡计数的目录，每个设备一个子目录，计数在子目录的 statistics 下，默认为 /sys/class/net
+	SysfsRoot string `mapstructure:"sysfs_root"`
+	Interval  string `mapstructure:"interval"` // 采样间隔，默认为 10s
+	// 与 Packet input 的 capture 相同，设备名支持 glob 通配符，以 regex: 开头时按正则表达式匹配
+	DeviceType  string   `mapstructure:"device_type"`
+	Device      []string `mapstructure:"device"`
+	ChannelSize int      `mapstructure:"channel_size"`
+}
+
+// interfaceStatsInput 定时读取网卡的计数，输出每个采样间隔的增量和每秒速率，用于核对抓包统计的流量，
+// 每次采样时重新列出设备，第一次出现的设备和计数器回退（如设备重建）时只记录不输出
+type interfaceStatsInput struct {
+	config   interfaceStatsConfig
+	patterns []devicePattern
+	interval time.Duration
+	// last 为每个设备上次采样的时间和计数，只在 sample 所在的 goroutine 中使用
+	last   map[string]interfaceSample
+	events chan map[string]interface{}
+	done   chan struct{}
+}
+
+type interfaceSample struct {
+	time     time.Time
+	counters map[string]uint64
+}
+
+func init() {
+	register("InterfaceStats", newInterfaceStatsInput)
+}
+
+func newInterfaceStatsInput(config map[interface{}]interface{}) topology.InputWorker {
+	c := interfaceStatsConfig{
+		SysfsRoot:   "/sys/class/net",
+		Interval:    "10s",
+		DeviceType:  deviceTypeBlack,
+		ChannelSize: 1024,
+	}
+	if err := mapstructure.Decode(config, &c); err != nil {
+		log.Fatalw("decode interface stats config failed", "error", err)
+	}
+	if c.DeviceType != deviceTypeWhite && c.DeviceType != deviceTypeBlack {
+		log.Fatalw("invalid device_type in interface stats config", "device_type", c.DeviceType)
+	}
+	patterns, err := compileDevicePatterns(c.Device)
+	if err != nil {
+		log.Fatalw("invalid device in interface stats config", "error", err)
+	}
+	interval, err := time.ParseDuration(c.Interval)
+	if err != nil || interval <= 0 {
+		log.Fatalw("invalid interval in interface stats config", "interval", c.Interval)
+	}
+	p := &interfaceStatsInput{
+		config:   c,
+		patterns: patterns,
+		interval: interval,
+		last:     make(map[string]interfaceSample),
+		events:   make(chan map[string]interface{}, c.ChannelSize),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *interfaceStatsInput) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	p.sample(time.Now())
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-ticker.C:
+			for _, event := range p.sample(now) {
+				select {
+				case p.events <- event:
+				case <-p.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+// sample 读取所有选中设备的计数，返回与上次采样相比的事件，已经消失的设备不再记录
+func (p *interfaceStatsInput) sample(now time.Time) []map[string]interface{} {
+	devices, err := p.devices()
+	if err != nil {
+		log.Errorw("list interfaces failed", "sysfs_root", p.config.SysfsRoot, "error", err)
+		return nil
+	}
+	var events []map[string]interface{}
+	current := make(map[string]interfaceSample, len(devices))
+	for _, device := range devices {
+		counters, err := p.readCounters(device)
+		if err != nil {
+			log.Warnw("read interface counters failed", "device", device, "error", err)
+			continue
+		}
+		s := interfaceSample{time: now, counters: counters}
+		current[device] = s
+		if last, ok := p.last[device]; ok {
+			if event := interfaceStatsEvent(device, last, s); event != nil {
+				events = append(events, event)
+			}
+		}
+	}
+	p.last = current
+	return events
+}
+
+// devices 列出 sysfs_root 下按 device_type 和 device 选中的设备
+func (p *interfaceStatsInput) devices() ([]string, error) {
+	entries, err := os.ReadDir(p.config.SysfsRoot)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		// /sys/class/net 下的设备为指向 /sys/devices 的符号链接
+		if e.IsDir() || e.Type()&os.ModeSymlink != 0 {
+			names = append(names, e.Name())
+		}
+	}
+	return selectDevices(p.config.DeviceType, p.patterns, names), nil
+}
+
+func (p *interfaceStatsInput) readCounters(device string) (map[string]uint64, error) {
+	dir := filepath.Join(p.config.SysfsRoot, device, "statistics")
+	counters := make(map[string]uint64, len(interfaceCounters))
+	for _, name := range interfaceCounters {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		counters[name] = v
+	}
+	return counters, nil
+}
+
+// interfaceStatsEvent 计算两次采样之间的增量和每秒速率，如 rx_bytes 和 rx_bytes_rate，
+// 任一计数器回退时说明计数被重置，返回 nil
+func interfaceStatsEvent(device string, last, current interfaceSample) map[string]interface{} {
+	seconds := current.time.Sub(last.time).Seconds()
+	if seconds <= 0 {
+		return nil
+	}
+	event := map[string]interface{}{
+		"type":        eventTypeInterfaceStats,
+		"device":      device,
+		"create_time": current.time,
+		"interval":    seconds,
+	}
+	for _, name := range interfaceCounters {
+		if current.counters[name] < last.counters[name] {
+			log.Infow("interface counters reset", "device", device, "counter", name)
+			return nil
+		}
+		delta := current.counters[name] - last.counters[name]
+		event[name] = int64(delta)
+		event[name+"_rate"] = float64(delta) / seconds
+	}
+	return event
+}
+
+func (p *interfaceStatsInput) ReadOneEvent() map[string]interface{} {
+	select {
+	case <-p.done:
+		return nil
+	case event := <-p.events:
+		return event
+	}
+}
+
+func (p *interfaceStatsInput) Shutdown() {
+	close(p.done)
+}
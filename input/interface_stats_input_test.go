@@ -0,0 +1,105 @@
+package input
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testdata/interface_stats 下 t0、t1 为两次采样时的 sysfs：
+// eth0 的计数增加，eth1 的计数回退（设备重建），lo 的计数增加，bonding_masters 为普通文件
+const interfaceStatsTestdata = "testdata/interface_stats"
+
+func newTestInterfaceStatsInput(t *testing.T, deviceType string, devices ...string) *interfaceStatsInput {
+	t.Helper()
+	patterns, err := compileDevicePatterns(devices)
+	if err != nil {
+		t.Fatalf("compile device patterns: %v", err)
+	}
+	return &interfaceStatsInput{
+		config:   interfaceStatsConfig{SysfsRoot: interfaceStatsTestdata + "/t0", DeviceType: deviceType, Device: devices},
+		patterns: patterns,
+		last:     make(map[string]interfaceSample),
+	}
+}
+
+func TestInterfaceStatsDevices(t *testing.T) {
+	tests := []struct {
+		name       string
+		deviceType string
+		devices    []string
+		want       []string
+	}{
+		{"black empty", deviceTypeBlack, nil, []string{"eth0", "eth1", "lo"}},
+		{"black lo", deviceTypeBlack, []string{"lo"}, []string{"eth0", "eth1"}},
+		{"white glob", deviceTypeWhite, []string{"eth*"}, []string{"eth0", "eth1"}},
+		{"white regex", deviceTypeWhite, []string{"regex:^(lo|eth1)$"}, []string{"eth1", "lo"}},
+		{"white empty", deviceTypeWhite, nil, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestInterfaceStatsInput(t, tt.deviceType, tt.devices...)
+			got, err := p.devices()
+			if err != nil {
+				t.Fatalf("devices: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("devices = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInterfaceStatsSample(t *testing.T) {
+	initTestLogger()
+	p := newTestInterfaceStatsInput(t, deviceTypeBlack, "lo")
+	t0 := time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC)
+	// 第一次采样只记录
+	if events := p.sample(t0); len(events) != 0 {
+		t.Fatalf("first sample returned %d events", len(events))
+	}
+	p.config.SysfsRoot = interfaceStatsTestdata + "/t1"
+	t1 := t0.Add(10 * time.Second)
+	events := p.sample(t1)
+	// eth1 的计数回退，不输出
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1: %v", len(events), events)
+	}
+	event := events[0]
+	want := map[string]interface{}{
+		"type":            eventTypeInterfaceStats,
+		"device":          "eth0",
+		"create_time":     t1,
+		"interval":        10.0,
+		"rx_bytes":        int64(10000),
+		"rx_bytes_rate":   1000.0,
+		"tx_bytes":        int64(500),
+		"tx_bytes_rate":   50.0,
+		"rx_packets":      int64(100),
+		"rx_packets_rate": 10.0,
+		"tx_packets":      int64(5),
+		"tx_packets_rate": 0.5,
+		"rx_errors":       int64(1),
+		"rx_errors_rate":  0.1,
+		"tx_errors":       int64(0),
+		"tx_errors_rate":  0.0,
+		"rx_dropped":      int64(2),
+		"rx_dropped_rate": 0.2,
+		"tx_dropped":      int64(0),
+		"tx_dropped_rate": 0.0,
+	}
+	if !reflect.DeepEqual(event, want) {
+		t.Errorf("event = %v, want %v", event, want)
+	}
+
+	// 回退后的计数作为新的基准，之后的采样正常输出
+	events = p.sample(t1.Add(10 * time.Second))
+	if len(events) != 2 {
+		t.Fatalf("got %d events after reset, want 2: %v", len(events), events)
+	}
+	for _, e := range events {
+		if e["rx_bytes"] != int64(0) {
+			t.Errorf("%s rx_bytes = %v, want 0", e["device"], e["rx_bytes"])
+		}
+	}
+}
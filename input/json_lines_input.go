@@ -0,0 +1,335 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+
+	"traffic-statistics/pkg/log"
+	"traffic-statistics/topology"
+)
+
+// stdinPath 表示从标准输入读取
+const stdinPath = "-"
+
+type jsonLinesConfig struct {
+	// 读取的文件，支持 glob 通配符，按文件名顺序读取，为空或为 - 时读取标准输入
+	Paths []string `mapstructure:"paths"`
+	// 读到文件末尾后继续等待新写入的数据，并按 paths 发现新的文件，文件被轮转、重新创建或截断后从头读取新的文件，
+	// 类似 tail -F
+	Follow       bool   `mapstructure:"follow"`
+	PollInterval string `mapstructure:"poll_interval"` // follow 时检查新数据的间隔，默认为 1s
+	// 每秒最多输出的事件数，为 0 则不限制
+	Rate        float64 `mapstructure:"rate"`
+	ChannelSize int     `mapstructure:"channel_size"`
+}
+
+// jsonLinesInput 读取每行一个 JSON 事件的文件或标准输入，用于测试和回放 filter、output，
+// 文件读取结束后 ReadOneEvent 返回 nil
+type jsonLinesInput struct {
+	config       jsonLinesConfig
+	pollInterval time.Duration
+	events       chan map[string]interface{}
+	done         chan struct{}
+}
+
+func init() {
+	register("JSONLines", newJSONLinesInput)
+}
+
+func newJSONLinesInput(config map[interface{}]interface{}) topology.InputWorker {
+	c := jsonLinesConfig{
+		PollInterval: "1s",
+		ChannelSize:  1024,
+	}
+	if err := mapstructure.Decode(config, &c); err != nil {
+		log.Fatalw("decode json lines config failed", "error", err)
+	}
+	pollInterval, err := time.ParseDuration(c.PollInterval)
+	if err != nil || pollInterval <= 0 {
+		log.Fatalw("invalid poll_interval in json lines config", "poll_interval", c.PollInterval)
+	}
+	if c.Rate < 0 {
+		log.Fatalw("invalid rate in json lines config", "rate", c.Rate)
+	}
+	for _, p := range c.Paths {
+		if _, err := filepath.Match(p, ""); err != nil {
+			log.Fatalw("invalid path in json lines config", "path", p, "error", err)
+		}
+	}
+	p := &jsonLinesInput{
+		config:       c,
+		pollInterval: pollInterval,
+		events:       make(chan map[string]interface{}, c.ChannelSize),
+		done:         make(chan struct{}),
+	}
+	go p.read()
+	return p
+}
+
+func (p *jsonLinesInput) read() {
+	defer close(p.events)
+	limiter := newRateLimiter(p.config.Rate)
+	emit := func(line []byte) bool {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			return true
+		}
+		event, err := decodeEvent(line)
+		if err != nil {
+			log.Warnw("decode json line failed", "line", string(line), "error", err)
+			return true
+		}
+		if !limiter.wait(p.done) {
+			return false
+		}
+		select {
+		case p.events <- event:
+			return true
+		case <-p.done:
+			return false
+		}
+	}
+	if len(p.config.Paths) == 0 || (len(p.config.Paths) == 1 && p.config.Paths[0] == stdinPath) {
+		p.readStdin(emit)
+		return
+	}
+	p.readFiles(emit)
+}
+
+// readStdin 读取标准输入直到结束，follow 对标准输入没有作用
+func (p *jsonLinesInput) readStdin(emit func([]byte) bool) {
+	r := bufio.NewReader(os.Stdin)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && !emit(line) {
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Errorw("read stdin failed", "error", err)
+			}
+			return
+		}
+	}
+}
+
+// tailedFile 为正在读取的文件，partial 为 follow 时还没有写完的最后一行
+type tailedFile struct {
+	file    *os.File
+	reader  *bufio.Reader
+	offset  int64
+	partial []byte
+}
+
+// readFiles 按顺序读取 paths 匹配的文件，follow 时读完后定期检查文件的新数据和新文件
+func (p *jsonLinesInput) readFiles(emit func([]byte) bool) {
+	files := make(map[string]*tailedFile)
+	defer func() {
+		for _, f := range files {
+			f.file.Close()
+		}
+	}()
+	for {
+		read := false
+		matched := p.match()
+		current := make(map[string]bool, len(matched))
+		for _, name := range matched {
+			current[name] = true
+			f, ok := files[name]
+			if ok && p.config.Follow && f.replaced(name) {
+				log.Infow("json lines file replaced, read the new file from the beginning", "file", name)
+				delete(files, name)
+				n, ok := p.drainFile(name, f, emit)
+				if !ok {
+					return
+				}
+				read = read || n > 0
+				f = nil
+			}
+			if f == nil {
+				file, err := os.Open(name)
+				if err != nil {
+					log.Errorw("open json lines file failed", "file", name, "error", err)
+					continue
+				}
+				f = &tailedFile{file: file, reader: bufio.NewReader(file)}
+				files[name] = f
+			}
+			n, ok := p.readFile(name, f, emit)
+			if !ok {
+				return
+			}
+			read = read || n > 0
+		}
+		// 被删除或者轮转为其他文件名的文件读完剩余的数据后关闭
+		for name, f := range files {
+			if current[name] {
+				continue
+			}
+			delete(files, name)
+			n, ok := p.drainFile(name, f, emit)
+			if !ok {
+				return
+			}
+			read = read || n > 0
+		}
+		if !p.config.Follow {
+			return
+		}
+		if !read {
+			select {
+			case <-p.done:
+				return
+			case <-time.After(p.pollInterval):
+			}
+		}
+	}
+}
+
+// replaced 返回 name 是否已经指向另一个文件，即文件被轮转或者删除后重新创建
+func (f *tailedFile) replaced(name string) bool {
+	info, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	opened, err := f.file.Stat()
+	if err != nil {
+		return false
+	}
+	return !os.SameFile(info, opened)
+}
+
+// drainFile 读取不再使用的文件剩余的数据后关闭文件，没有换行符的最后一行也输出
+func (p *jsonLinesInput) drainFile(name string, f *tailedFile, emit func([]byte) bool) (int, bool) {
+	defer f.file.Close()
+	n, ok := p.readFile(name, f, emit)
+	if !ok {
+		return n, false
+	}
+	if len(f.partial) > 0 {
+		if !emit(f.partial) {
+			return n, false
+		}
+		n++
+	}
+	return n, true
+}
+
+// readFile 读取文件中新的完整行，返回读取的行数，收到 Shutdown 时返回 false
+func (p *jsonLinesInput) readFile(name string, f *tailedFile, emit func([]byte) bool) (int, bool) {
+	// 文件被截断后从头读取
+	if info, err := f.file.Stat(); err == nil && info.Size() < f.offset {
+		log.Infow("json lines file truncated, read from the beginning", "file", name)
+		if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+			log.Errorw("seek json lines file failed", "file", name, "error", err)
+			return 0, true
+		}
+		f.reader.Reset(f.file)
+		f.offset, f.partial = 0, nil
+	}
+	n := 0
+	for {
+		line, err := f.reader.ReadBytes('\n')
+		f.offset += int64(len(line))
+		if err == nil {
+			if len(f.partial) > 0 {
+				line = append(f.partial, line...)
+				f.partial = nil
+			}
+			if !emit(line) {
+				return n, false
+			}
+			n++
+			continue
+		}
+		if err != io.EOF {
+			log.Errorw("read json lines file failed", "file", name, "error", err)
+			return n, true
+		}
+		// follow 时最后一行可能还没有写完，等待换行符；不 follow 时文件末尾没有换行符的行也输出
+		f.partial = append(f.partial, line...)
+		if !p.config.Follow && len(f.partial) > 0 {
+			if !emit(f.partial) {
+				return n, false
+			}
+			f.partial = nil
+			n++
+		}
+		return n, true
+	}
+}
+
+// match 返回 paths 匹配的文件，每个 path 内按文件名排序，同一个文件只出现一次
+func (p *jsonLinesInput) match() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, pattern := range p.config.Paths {
+		matches, _ := filepath.Glob(pattern)
+		sort.Strings(matches)
+		for _, name := range matches {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func (p *jsonLinesInput) ReadOneEvent() map[string]interface{} {
+	select {
+	case <-p.done:
+		return nil
+	case event, ok := <-p.events:
+		if !ok {
+			return nil
+		}
+		return event
+	}
+}
+
+func (p *jsonLinesInput) Shutdown() {
+	close(p.done)
+}
+
+// rateLimiter 限制每秒输出的事件数，按事件数计算下一个事件的时间，短时间的落后会在之后追上
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return &rateLimiter{}
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// wait 等待到下一个事件可以输出，收到 done 时返回 false
+func (l *rateLimiter) wait(done chan struct{}) bool {
+	if l.interval == 0 {
+		return true
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		// 落后超过一秒时不再追赶，避免长时间没有事件后突然输出大量事件
+		if now.Sub(l.next) > time.Second {
+			l.next = now
+		}
+	} else {
+		select {
+		case <-time.After(l.next.Sub(now)):
+		case <-done:
+			return false
+		}
+	}
+	l.next = l.next.Add(l.interval)
+	return true
+}
@@ -0,0 +1,80 @@
+package input
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// appendLines 在文件末尾追加 JSON 行，每行为 {"n":x}
+func appendLines(t *testing.T, name string, ns ...int) {
+	t.Helper()
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, n := range ns {
+		if _, err := fmt.Fprintf(f, "{\"n\":%d}\n", n); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// expectEvents 依次读取事件并检查 n 字段
+func expectEvents(t *testing.T, p *jsonLinesInput, ns ...int) {
+	t.Helper()
+	for _, n := range ns {
+		if event := readEventWithTimeout(t, p); fmt.Sprint(event["n"]) != fmt.Sprint(n) {
+			t.Fatalf("event = %v, want n=%d", event, n)
+		}
+	}
+}
+
+func newTestJSONLinesInput(t *testing.T, paths ...string) *jsonLinesInput {
+	t.Helper()
+	initTestLogger()
+	p := newJSONLinesInput(map[interface{}]interface{}{
+		"paths":         paths,
+		"follow":        true,
+		"poll_interval": "10ms",
+	}).(*jsonLinesInput)
+	t.Cleanup(p.Shutdown)
+	return p
+}
+
+func TestJSONLinesFollow(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "events.log")
+	appendLines(t, name, 1, 2)
+	p := newTestJSONLinesInput(t, name)
+	expectEvents(t, p, 1, 2)
+
+	// 轮转：旧文件改名后写入的数据仍然输出，之后从头读取新创建的文件
+	appendLines(t, name, 3)
+	expectEvents(t, p, 3)
+	if err := os.Rename(name, name+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendLines(t, name+".1", 4)
+	appendLines(t, name, 5, 6)
+	expectEvents(t, p, 4, 5, 6)
+
+	// 删除后重新创建
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	appendLines(t, name, 7)
+	expectEvents(t, p, 7)
+
+	// 截断后从头读取
+	time.Sleep(50 * time.Millisecond)
+	if err := os.Truncate(name, 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	appendLines(t, name, 8)
+	expectEvents(t, p, 8)
+}
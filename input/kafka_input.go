@@ -0,0 +1,196 @@
+package input
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/mitchellh/mapstructure"
+
+	"traffic-statistics/pkg/log"
+	"traffic-statistics/topology"
+)
+
+type kafkaConfig struct {
+	Addrs    []string `mapstructure:"addrs"`
+	Topics   []string `mapstructure:"topics"`
+	Group    string   `mapstructure:"group"`
+	ClientID string   `mapstructure:"client_id"`
+	Version  string   `mapstructure:"version"` // Kafka 版本，consumer group 需要 0.10.2.0 以上，默认为 2.1.0
+	// 消费组没有已提交的 offset 时从哪里开始消费，oldest 或 newest，默认为 newest
+	InitialOffset  string `mapstructure:"initial_offset"`
+	CommitInterval string `mapstructure:"commit_interval"` // 提交已处理 offset 的间隔，默认为 1s
+}
+
+// kafkaInput 以 consumer group 消费其他实例发送到 Kafka 的 JSON 事件，用于集中运行 filter 和 SizeRecord 聚合。
+// 消息只有在 pipeline 处理完成后（即下一次调用 ReadOneEvent 时）才标记为已消费，
+// 进程退出时正在处理的消息会被重新消费，保证至少一次
+type kafkaInput struct {
+	group    sarama.ConsumerGroup
+	topics   []string
+	messages chan kafkaMessage
+	// processing 为上一次 ReadOneEvent 返回的消息，只在调用 ReadOneEvent 的 goroutine 中使用
+	processing *kafkaMessage
+	ctx        context.Context
+	cancel     func()
+	wg         sync.WaitGroup
+}
+
+// kafkaMessage 记录消息所属的 session，标记 offset 时需要使用
+type kafkaMessage struct {
+	session sarama.ConsumerGroupSession
+	message *sarama.ConsumerMessage
+}
+
+func init() {
+	register("Kafka", newKafkaInput)
+}
+
+func newKafkaInput(config map[interface{}]interface{}) topology.InputWorker {
+	c := kafkaConfig{
+		ClientID:       "traffic-statistics",
+		Version:        "2.1.0",
+		InitialOffset:  "newest",
+		CommitInterval: "1s",
+	}
+	if err := mapstructure.Decode(config, &c); err != nil {
+		log.Fatalw("decode kafka config failed", "error", err)
+	}
+	if len(c.Addrs) == 0 || len(c.Topics) == 0 || c.Group == "" {
+		log.Fatal("addrs, topics and group are required in kafka config")
+	}
+	version, err := sarama.ParseKafkaVersion(c.Version)
+	if err != nil {
+		log.Fatalw("invalid version in kafka config", "version", c.Version, "error", err)
+	}
+	commitInterval, err := time.ParseDuration(c.CommitInterval)
+	if err != nil || commitInterval <= 0 {
+		log.Fatalw("invalid commit_interval in kafka config", "commit_interval", c.CommitInterval)
+	}
+	saramaConfig := sarama.NewConfig()
+	saramaConfig.ClientID = c.ClientID
+	saramaConfig.Version = version
+	saramaConfig.Consumer.Return.Errors = true
+	saramaConfig.Consumer.Offsets.AutoCommit.Enable = true
+	saramaConfig.Consumer.Offsets.AutoCommit.Interval = commitInterval
+	switch c.InitialOffset {
+	case "oldest":
+		saramaConfig.Consumer.Offsets.Initial = sarama.OffsetOldest
+	case "newest":
+		saramaConfig.Consumer.Offsets.Initial = sarama.OffsetNewest
+	default:
+		log.Fatalw("invalid initial_offset in kafka config", "initial_offset", c.InitialOffset)
+	}
+	group, err := sarama.NewConsumerGroup(c.Addrs, c.Group, saramaConfig)
+	if err != nil {
+		log.Fatalw("create kafka consumer group failed", "addrs", c.Addrs, "group", c.Group, "error", err)
+	}
+	return newKafkaInputWithGroup(group, c.Topics)
+}
+
+// newKafkaInputWithGroup 使用已经创建的 consumer group 消费 topics，
+// 测试时传入实现 sarama.ConsumerGroup 接口的 fake consumer group，不需要连接 kafka
+func newKafkaInputWithGroup(group sarama.ConsumerGroup, topics []string) *kafkaInput {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &kafkaInput{
+		group:  group,
+		topics: topics,
+		// 不缓存消息，rebalance 后不会继续输出已经不属于本实例的分区的消息
+		messages: make(chan kafkaMessage),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	p.wg.Add(2)
+	go p.consume()
+	go p.logErrors()
+	return p
+}
+
+// consume 加入消费组并消费分配到的分区，rebalance 后 Consume 返回，需要重新调用
+func (p *kafkaInput) consume() {
+	defer p.wg.Done()
+	for {
+		if err := p.group.Consume(p.ctx, p.topics, p); err != nil {
+			if errors.Is(err, sarama.ErrClosedConsumerGroup) {
+				return
+			}
+			log.Errorw("consume kafka topics failed", "topics", p.topics, "error", err)
+			select {
+			case <-p.ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+		if p.ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (p *kafkaInput) logErrors() {
+	defer p.wg.Done()
+	for err := range p.group.Errors() {
+		log.Errorw("kafka consumer error", "error", err)
+	}
+}
+
+func (p *kafkaInput) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (p *kafkaInput) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim 将分区的消息交给 ReadOneEvent，session 结束（rebalance 或 Shutdown）时返回
+func (p *kafkaInput) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for {
+		select {
+		case <-session.Context().Done():
+			return nil
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			select {
+			case p.messages <- kafkaMessage{session: session, message: msg}:
+			case <-session.Context().Done():
+				return nil
+			}
+		}
+	}
+}
+
+// ReadOneEvent 标记上一条消息已处理，返回下一条消息解析后的事件，无法解析的消息跳过
+func (p *kafkaInput) ReadOneEvent() map[string]interface{} {
+	if p.processing != nil {
+		p.processing.session.MarkMessage(p.processing.message, "")
+		p.processing = nil
+	}
+	for {
+		select {
+		case <-p.ctx.Done():
+			return nil
+		case m := <-p.messages:
+			event, err := decodeEvent(m.message.Value)
+			if err != nil {
+				log.Warnw("decode kafka message failed", "topic", m.message.Topic,
+					"partition", m.message.Partition, "offset", m.message.Offset, "error", err)
+				m.session.MarkMessage(m.message, "")
+				continue
+			}
+			p.processing = &m
+			return event
+		}
+	}
+}
+
+// Shutdown 离开消费组，并提交已经标记的 offset
+func (p *kafkaInput) Shutdown() {
+	p.cancel()
+	if err := p.group.Close(); err != nil {
+		log.Errorw("close kafka consumer group failed", "error", err)
+	}
+	p.wg.Wait()
+}
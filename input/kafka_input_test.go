@@ -0,0 +1,227 @@
+package input
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	"traffic-statistics/pkg/log"
+	"traffic-statistics/topology"
+)
+
+var testLoggerOnce sync.Once
+
+// initTestLogger 将测试中的日志写到临时目录
+func initTestLogger() {
+	testLoggerOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "traffic-statistics-test-log")
+		if err != nil {
+			panic(err)
+		}
+		log.NewLogger(map[string]interface{}{"log": map[interface{}]interface{}{"log_dir": dir}})
+	})
+}
+
+// fakeConsumerGroup 将 messages 作为一个分区交给 handler，直到 ctx 结束或 Close
+type fakeConsumerGroup struct {
+	session  *fakeSession
+	claim    *fakeClaim
+	errors   chan error
+	closed   chan struct{}
+	closeOne sync.Once
+}
+
+func newFakeConsumerGroup() *fakeConsumerGroup {
+	return &fakeConsumerGroup{
+		session: &fakeSession{},
+		claim:   &fakeClaim{messages: make(chan *sarama.ConsumerMessage, 16)},
+		errors:  make(chan error),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (g *fakeConsumerGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	select {
+	case <-g.closed:
+		return sarama.ErrClosedConsumerGroup
+	default:
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-g.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	g.session.setContext(ctx)
+	if err := handler.Setup(g.session); err != nil {
+		return err
+	}
+	err := handler.ConsumeClaim(g.session, g.claim)
+	<-ctx.Done()
+	if cleanupErr := handler.Cleanup(g.session); err == nil {
+		err = cleanupErr
+	}
+	return err
+}
+
+func (g *fakeConsumerGroup) Errors() <-chan error {
+	return g.errors
+}
+
+func (g *fakeConsumerGroup) Close() error {
+	g.closeOne.Do(func() {
+		close(g.closed)
+		close(g.errors)
+	})
+	return nil
+}
+
+// fakeSession 记录标记为已消费的 offset
+type fakeSession struct {
+	lock   sync.Mutex
+	ctx    context.Context
+	marked []int64
+}
+
+func (s *fakeSession) setContext(ctx context.Context) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ctx = ctx
+}
+
+func (s *fakeSession) markedOffsets() []int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]int64(nil), s.marked...)
+}
+
+func (s *fakeSession) Claims() map[string][]int32 { return nil }
+func (s *fakeSession) MemberID() string           { return "fake" }
+func (s *fakeSession) GenerationID() int32        { return 1 }
+func (s *fakeSession) Commit()                    {}
+
+func (s *fakeSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.marked = append(s.marked, offset)
+}
+
+func (s *fakeSession) ResetOffset(topic string, partition int32, offset int64, metadata string) {}
+
+func (s *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+
+func (s *fakeSession) Context() context.Context {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ctx
+}
+
+type fakeClaim struct {
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c *fakeClaim) Topic() string                            { return "traffic" }
+func (c *fakeClaim) Partition() int32                         { return 0 }
+func (c *fakeClaim) InitialOffset() int64                     { return 0 }
+func (c *fakeClaim) HighWaterMarkOffset() int64               { return 0 }
+func (c *fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+func (c *fakeClaim) send(offset int64, value string) {
+	c.messages <- &sarama.ConsumerMessage{Topic: "traffic", Partition: 0, Offset: offset, Value: []byte(value)}
+}
+
+func TestKafkaInputRestoresFieldTypes(t *testing.T) {
+	initTestLogger()
+	group := newFakeConsumerGroup()
+	p := newKafkaInputWithGroup(group, []string{"traffic"})
+	defer p.Shutdown()
+
+	group.claim.send(0, `{"id":42,"device":"eth0","create_time":"2021-06-01T08:00:00.123456789Z",`+
+		`"pack_size":1514,"src_ip":"10.0.0.1","dst_ip":"10.0.0.2","src_port":443,"protocol":6,"ip_fragment":true}`)
+	event := readEventWithTimeout(t, p)
+
+	wantTime := time.Date(2021, 6, 1, 8, 0, 0, 123456789, time.UTC)
+	if v, ok := event["create_time"].(time.Time); !ok || !v.Equal(wantTime) {
+		t.Errorf("create_time = %#v, want time.Time %v", event["create_time"], wantTime)
+	}
+	checks := map[string]interface{}{
+		"id":          uint64(42),
+		"device":      "eth0",
+		"pack_size":   int32(1514),
+		"src_ip":      "10.0.0.1",
+		"src_port":    uint16(443),
+		"protocol":    uint8(6),
+		"ip_fragment": true,
+	}
+	for field, want := range checks {
+		if got := event[field]; got != want {
+			t.Errorf("%s = %#v (%T), want %#v (%T)", field, got, got, want, want)
+		}
+	}
+}
+
+func TestKafkaInputMarksMessageOnNextRead(t *testing.T) {
+	initTestLogger()
+	group := newFakeConsumerGroup()
+	p := newKafkaInputWithGroup(group, []string{"traffic"})
+	defer p.Shutdown()
+
+	group.claim.send(10, `{"device":"eth0"}`)
+	group.claim.send(11, `not json`)
+	group.claim.send(12, `{"device":"eth1"}`)
+
+	if event := readEventWithTimeout(t, p); event["device"] != "eth0" {
+		t.Fatalf("first event = %v", event)
+	}
+	// 第一条消息还在 pipeline 中处理，不能标记
+	if marked := group.session.markedOffsets(); len(marked) != 0 {
+		t.Fatalf("marked %v before the next ReadOneEvent", marked)
+	}
+
+	// 下一次读取时标记第一条，无法解析的消息直接标记，第三条在处理中
+	if event := readEventWithTimeout(t, p); event["device"] != "eth1" {
+		t.Fatalf("second event = %v", event)
+	}
+	if marked := group.session.markedOffsets(); !equalOffsets(marked, []int64{11, 12}) {
+		t.Fatalf("marked offsets = %v, want [11 12]", marked)
+	}
+}
+
+func readEventWithTimeout(t *testing.T, p topology.InputWorker) map[string]interface{} {
+	t.Helper()
+	events := make(chan map[string]interface{}, 1)
+	go func() {
+		events <- p.ReadOneEvent()
+	}()
+	select {
+	case event := <-events:
+		if event == nil {
+			t.Fatal("ReadOneEvent returned nil")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for ReadOneEvent")
+		return nil
+	}
+}
+
+func equalOffsets(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -6,7 +6,7 @@ type AtomicCounter struct {
 	number uint64
 }
 
-var Counter *AtomicCounter
+var Counter = &AtomicCounter{0}
 
 func Init() {
 	Counter = &AtomicCounter{0}
@@ -26,7 +26,7 @@ type AtomicSizeCounter struct {
 	number uint64
 }
 
-var SizeCounter *AtomicSizeCounter
+var SizeCounter = &AtomicSizeCounter{0}
 
 func InitSize() {
 	SizeCounter = &AtomicSizeCounter{0}
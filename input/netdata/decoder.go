@@ -0,0 +1,315 @@
+package netdata
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Decoder 使用 DecodingLayerParser 将数据包解析为 NetData，每层协议的结构体只分配一次，
+// 解析时复用，因此 Decoder 不能在多个 goroutine 中同时使用
+type Decoder struct {
+	device   string
+	linkType layers.LinkType
+	mtu      int
+	parsers  map[gopacket.LayerType]*gopacket.DecodingLayerParser
+	decoded  []gopacket.LayerType
+
+	eth   layers.Ethernet
+	sll   layers.LinuxSLL
+	loop  layers.Loopback
+	dot1q vlanTags
+	ip4   ipv4Layer
+	ip6   ipv6Layer
+	ip6ex ipv6Extensions
+	frag6 ipv6Fragment
+	tcp   layers.TCP
+	udp   layers.UDP
+
+	// 隧道解封装
+	decap      map[string]bool
+	vxlanPorts map[uint16]bool
+	vxlan      layers.VXLAN
+	geneve     layers.Geneve
+	gre        layers.GRE
+	inner      innerLayers
+}
+
+// vlanTags 解析 802.1Q 和 QinQ 标签，并按从外到内的顺序记录 VLAN ID
+type vlanTags struct {
+	layers.Dot1Q
+	ids   [2]uint16
+	count int
+}
+
+func (v *vlanTags) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if err := v.Dot1Q.DecodeFromBytes(data, df); err != nil {
+		return err
+	}
+	if v.count < len(v.ids) {
+		v.ids[v.count] = v.VLANIdentifier
+	}
+	v.count++
+	return nil
+}
+
+// ipv6Extensions 跳过 IPv6 扩展头，并记录扩展头的总长度
+type ipv6Extensions struct {
+	layers.IPv6ExtensionSkipper
+	length int
+}
+
+func (e *ipv6Extensions) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if err := e.IPv6ExtensionSkipper.DecodeFromBytes(data, df); err != nil {
+		return err
+	}
+	e.length += len(e.Contents)
+	return nil
+}
+
+func (e *ipv6Extensions) NextLayerType() gopacket.LayerType {
+	return stopAtIPInIP(e.NextHeader, e.IPv6ExtensionSkipper.NextLayerType())
+}
+
+// ipv6Fragment 解析 IPv6 分片扩展头，gopacket 的 IPv6Fragment 没有实现 DecodingLayer，
+// 和 ipv4Layer 一样，只有第一个分片继续解析传输层
+type ipv6Fragment struct {
+	layers.BaseLayer
+	NextHeader     layers.IPProtocol
+	FragmentOffset uint16
+	MoreFragments  bool
+}
+
+func (f *ipv6Fragment) LayerType() gopacket.LayerType {
+	return layers.LayerTypeIPv6Fragment
+}
+
+func (f *ipv6Fragment) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeIPv6Fragment
+}
+
+func (f *ipv6Fragment) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < ipv6FragmentHeaderLength {
+		df.SetTruncated()
+		return fmt.Errorf("invalid ipv6 fragment header, length %d less than %d", len(data), ipv6FragmentHeaderLength)
+	}
+	f.NextHeader = layers.IPProtocol(data[0])
+	f.FragmentOffset = binary.BigEndian.Uint16(data[2:4]) >> 3
+	f.MoreFragments = data[3]&0x1 != 0
+	f.BaseLayer = layers.BaseLayer{Contents: data[:ipv6FragmentHeaderLength], Payload: data[ipv6FragmentHeaderLength:]}
+	return nil
+}
+
+func (f *ipv6Fragment) NextLayerType() gopacket.LayerType {
+	if f.FragmentOffset != 0 {
+		return gopacket.LayerTypeFragment
+	}
+	return stopAtIPInIP(f.NextHeader, f.NextHeader.LayerType())
+}
+
+// NewDecoder 创建解析某个设备数据包的 Decoder，linkType 为抓包设备或 pcap 文件的链路类型，
+// o 需要事先通过 Validate 检查
+func NewDecoder(device string, linkType layers.LinkType, o Options) *Decoder {
+	d := &Decoder{
+		device:     device,
+		linkType:   linkType,
+		mtu:        o.mtuOf(device),
+		parsers:    make(map[gopacket.LayerType]*gopacket.DecodingLayerParser, 1),
+		decoded:    make([]gopacket.LayerType, 0, 8),
+		decap:      make(map[string]bool, len(o.Decap)),
+		vxlanPorts: make(map[uint16]bool, len(o.VXLANPorts)),
+	}
+	for _, v := range o.Decap {
+		d.decap[v] = true
+	}
+	for _, v := range o.VXLANPorts {
+		d.vxlanPorts[v] = true
+	}
+	if len(d.vxlanPorts) == 0 {
+		d.vxlanPorts[VXLANPort] = true
+	}
+	return d
+}
+
+// firstLayerType 根据链路类型返回解析的第一层协议，原始 IP 链路需根据 IP 版本号判断
+func (d *Decoder) firstLayerType(data []byte) gopacket.LayerType {
+	switch d.linkType {
+	case layers.LinkTypeLinuxSLL:
+		return layers.LayerTypeLinuxSLL
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		return layers.LayerTypeLoopback
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+		if len(data) > 0 && data[0]>>4 == IPVersion6 {
+			return layers.LayerTypeIPv6
+		}
+		return layers.LayerTypeIPv4
+	}
+	return layers.LayerTypeEthernet
+}
+
+func (d *Decoder) parser(first gopacket.LayerType) *gopacket.DecodingLayerParser {
+	if p, ok := d.parsers[first]; ok {
+		return p
+	}
+	p := gopacket.NewDecodingLayerParser(first,
+		&d.eth, &d.sll, &d.loop, &d.dot1q, &d.ip4, &d.ip6, &d.ip6ex, &d.frag6, &d.tcp, &d.udp)
+	// 不需要解析的协议（如 ICMP、应用层协议）直接结束解析
+	p.IgnoreUnsupported = true
+	d.parsers[first] = p
+	return p
+}
+
+// Decode 解析一个数据包，data 在返回后不再被引用
+func (d *Decoder) Decode(uID uint64, ci gopacket.CaptureInfo, data []byte) NetData {
+	n := NetData{
+		ID:            uID,
+		Device:        d.device,
+		CreateTime:    ci.Timestamp,
+		CapturedBytes: int32(ci.CaptureLength),
+	}
+	d.ip6ex.length = 0
+	d.dot1q.count = 0
+	// 截断或格式错误的数据包仍然使用已经成功解析的层
+	_ = d.parser(d.firstLayerType(data)).DecodeLayers(data, &d.decoded)
+	var tcp *layers.TCP
+	var udp *layers.UDP
+	var ipPayload []byte
+	// l2Length 为 IP 头在数据包中的偏移，ipHeaderLength 为 IP 头（含选项、扩展头）长度，用于计算线路长度
+	var l2Length, ipHeaderLength int
+	// ipPayloadLength 为 IP 头（含 IPv6 扩展头）之后的长度，按 IP 头中的长度字段计算，不受截断影响
+	var ipPayloadLength int
+	for _, typ := range d.decoded {
+		switch typ {
+		case layers.LayerTypeEthernet:
+			n.SrcMAC = d.eth.SrcMAC.String()
+			n.DstMAC = d.eth.DstMAC.String()
+			n.EtherType = uint16(d.eth.EthernetType)
+		case layers.LayerTypeLinuxSLL:
+			if len(d.sll.Addr) == 6 {
+				n.SrcMAC = d.sll.Addr.String()
+			}
+			n.EtherType = uint16(d.sll.EthernetType)
+		case layers.LayerTypeDot1Q:
+			n.EtherType = uint16(d.dot1q.Type)
+			n.VLANID = d.dot1q.ids[0]
+			if d.dot1q.count > 1 {
+				n.InnerVLANID = d.dot1q.ids[1]
+			}
+		case layers.LayerTypeIPv4:
+			n.SrcIP = d.ip4.SrcIP.String()
+			n.DstIP = d.ip4.DstIP.String()
+			n.IPVersion = IPVersion4
+			n.Protocol = uint8(d.ip4.Protocol)
+			n.TTL = d.ip4.TTL
+			n.DSCP = d.ip4.TOS >> 2
+			n.ECN = d.ip4.TOS & 0x03
+			ipPayloadLength = int(d.ip4.Length) - int(d.ip4.IHL)*4
+			ipPayload = d.ip4.Payload
+			l2Length = cap(data) - cap(d.ip4.Contents)
+			ipHeaderLength = int(d.ip4.IHL) * 4
+			n.IPFragment = d.ip4.fragment()
+		case layers.LayerTypeIPv6:
+			n.SrcIP = d.ip6.SrcIP.String()
+			n.DstIP = d.ip6.DstIP.String()
+			n.IPVersion = IPVersion6
+			n.Protocol = uint8(d.ip6.NextHeader)
+			n.TTL = d.ip6.HopLimit
+			n.DSCP = d.ip6.TrafficClass >> 2
+			n.ECN = d.ip6.TrafficClass & 0x03
+			ipPayloadLength = int(d.ip6.Length)
+			ipPayload = d.ip6.Payload
+			l2Length = cap(data) - cap(d.ip6.Contents)
+			ipHeaderLength = len(d.ip6.Contents)
+			if d.ip6.HopByHop != nil {
+				n.Protocol = uint8(d.ip6.HopByHop.NextHeader)
+				ipPayloadLength -= d.ip6.HopByHop.ActualLength
+				ipHeaderLength += d.ip6.HopByHop.ActualLength
+			}
+		case layers.LayerTypeIPv6Destination, layers.LayerTypeIPv6Routing:
+			n.Protocol = uint8(d.ip6ex.NextHeader)
+			ipPayload = d.ip6ex.Payload
+		case layers.LayerTypeIPv6Fragment:
+			n.Protocol = uint8(d.frag6.NextHeader)
+			ipPayload = d.frag6.Payload
+			ipPayloadLength -= ipv6FragmentHeaderLength
+			n.IPFragment = true
+		case layers.LayerTypeTCP:
+			tcp = &d.tcp
+			n.SrcPort = uint16(d.tcp.SrcPort)
+			n.DstPort = uint16(d.tcp.DstPort)
+			n.TCPFlags = tcpFlags(&d.tcp)
+			n.TCPSeq = d.tcp.Seq
+			n.TCPAck = d.tcp.Ack
+			n.TCPWindow = d.tcp.Window
+		case layers.LayerTypeUDP:
+			udp = &d.udp
+			n.SrcPort = uint16(d.udp.SrcPort)
+			n.DstPort = uint16(d.udp.DstPort)
+		}
+	}
+	ipPayloadLength -= d.ip6ex.length
+	ipHeaderLength += d.ip6ex.length
+	switch {
+	case tcp != nil:
+		n.PayloadLength = int32(ipPayloadLength - int(tcp.DataOffset)*4)
+	case udp != nil && n.IPFragment:
+		// 第一个分片中只有部分 UDP 负载
+		n.PayloadLength = int32(ipPayloadLength) - 8
+	case udp != nil:
+		n.PayloadLength = int32(udp.Length) - 8
+	default:
+		n.PayloadLength = int32(ipPayloadLength)
+	}
+	if n.PayloadLength < 0 {
+		n.PayloadLength = 0
+	}
+	// 分片中的隧道数据不完整，不解封装
+	if len(d.decap) > 0 && !n.IPFragment {
+		d.decapsulate(&n, ipPayload, udp)
+	}
+	n.WireBytes = int32(wireLength(ci.Length, l2Length, ipHeaderLength, n.IPVersion, tcp, n.IPFragment, d.mtu))
+	n.PackSize = n.WireBytes
+	return n
+}
+
+const (
+	TCPFlagFIN = 1 << iota
+	TCPFlagSYN
+	TCPFlagRST
+	TCPFlagPSH
+	TCPFlagACK
+	TCPFlagURG
+	TCPFlagECE
+	TCPFlagCWR
+)
+
+func tcpFlags(tcp *layers.TCP) uint8 {
+	var flags uint8
+	if tcp.FIN {
+		flags |= TCPFlagFIN
+	}
+	if tcp.SYN {
+		flags |= TCPFlagSYN
+	}
+	if tcp.RST {
+		flags |= TCPFlagRST
+	}
+	if tcp.PSH {
+		flags |= TCPFlagPSH
+	}
+	if tcp.ACK {
+		flags |= TCPFlagACK
+	}
+	if tcp.URG {
+		flags |= TCPFlagURG
+	}
+	if tcp.ECE {
+		flags |= TCPFlagECE
+	}
+	if tcp.CWR {
+		flags |= TCPFlagCWR
+	}
+	return flags
+}
@@ -0,0 +1,30 @@
+package netdata
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func BenchmarkDecoderDecode(b *testing.B) {
+	for _, payloadSize := range []int{64, 1400} {
+		b.Run(fmt.Sprintf("payload=%d", payloadSize), func(b *testing.B) {
+			packets := syntheticPackets(b, 1024, payloadSize)
+			d := NewDecoder("bench0", layers.LinkTypeEthernet, Options{MTU: DefaultMTU})
+			now := time.Now()
+			b.SetBytes(int64(len(packets[0])))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				data := packets[i%len(packets)]
+				ci := gopacket.CaptureInfo{Timestamp: now, CaptureLength: len(data), Length: len(data)}
+				if n := d.Decode(uint64(i), ci, data); n.SrcIP == "" {
+					b.Fatalf("packet %d is not decoded", i)
+				}
+			}
+		})
+	}
+}
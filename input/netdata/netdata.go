@@ -1,6 +1,7 @@
 package netdata
 
 import (
+	"reflect"
 	"time"
 
 	"github.com/google/gopacket"
@@ -12,71 +13,80 @@ type NetData struct {
 	Device string `json:"device"`
 
 	CreateTime time.Time `json:"create_time"` // RFC3339 格式
-	PackSize   int32     `json:"pack_size"`
+	PackSize   int32     `json:"pack_size"`   // 与 wire_bytes 相同
 
 	SrcIP string `json:"src_ip"`
 	DstIP string `json:"dst_ip"`
-}
 
-func NetDataFromPacket(device string, uID uint64, packet gopacket.Packet) NetData {
-	d := NetData{
-		ID:         uID,
-		Device:     device,
-		CreateTime: packet.Metadata().Timestamp,
-		PackSize:   int32(packet.Metadata().Length),
-	}
-	netLayerUpdate(packet, &d)
-	updateLength(packet, &d)
-	return d
-}
+	// 以下字段需要在 Packet input 的 fields 中配置后才会输出
+	IPVersion     uint8  `json:"ip_version"`
+	Protocol      uint8  `json:"protocol"` // IP 协议号，IPv6 为扩展头之后的协议号
+	SrcPort       uint16 `json:"src_port"`
+	DstPort       uint16 `json:"dst_port"`
+	TCPFlags      uint8  `json:"tcp_flags"` // 按 TCP 头中的位排列，FIN 为 0x01，SYN 为 0x02，以此类推
+	TCPSeq        uint32 `json:"tcp_seq"`
+	TCPAck        uint32 `json:"tcp_ack"`
+	TCPWindow     uint16 `json:"tcp_window"` // 未按窗口扩大选项换算
+	TTL           uint8  `json:"ttl"`        // IPv6 为 hop limit
+	DSCP          uint8  `json:"dscp"`
+	ECN           uint8  `json:"ecn"`
+	PayloadLength int32  `json:"payload_length"` // 传输层负载长度，非 TCP 和 UDP 时为 IP 负载长度
+	// 线路上的实际长度，GRO/TSO 合并的大包按 MTU 还原为多个数据包的长度之和
+	WireBytes     int32 `json:"wire_bytes"`
+	CapturedBytes int32 `json:"captured_bytes"` // 实际抓到的长度，受 snapshot_len 限制
+	IPFragment    bool  `json:"ip_fragment"`    // 是否为 IP 分片，只有第一个分片有端口信息
 
-const (
-	IPVersion4 = 4
-	IPVersion6 = 6
-)
+	SrcMAC      string `json:"src_mac"`
+	DstMAC      string `json:"dst_mac"`
+	EtherType   uint16 `json:"ether_type"`    // VLAN 标签之后的 EtherType，802.3 帧为 0
+	VLANID      uint16 `json:"vlan_id"`       // 外层 VLAN ID
+	InnerVLANID uint16 `json:"inner_vlan_id"` // QinQ 的内层 VLAN ID
 
-func netLayerUpdate(packet gopacket.Packet, d *NetData) {
-	if iPv4Layer := packet.Layer(layers.LayerTypeIPv4); iPv4Layer != nil {
-		l, _ := iPv4Layer.(*layers.IPv4)
-		d.SrcIP = l.SrcIP.String()
-		d.DstIP = l.DstIP.String()
-	}
-	if iPv6Layer := packet.Layer(layers.LayerTypeIPv6); iPv6Layer != nil {
-		l, _ := iPv6Layer.(*layers.IPv6)
-		d.SrcIP = l.SrcIP.String()
-		d.DstIP = l.DstIP.String()
-	}
+	// 以下字段在配置 decap 解封装隧道后填充，src_ip、dst_ip 等字段仍为外层数据包的值
+	TunnelType    string `json:"tunnel_type"`
+	VNI           uint32 `json:"vni"` // VXLAN、Geneve 的 VNI，GRE 的 key，NVGRE 的 VSID
+	InnerSrcIP    string `json:"inner_src_ip"`
+	InnerDstIP    string `json:"inner_dst_ip"`
+	InnerProtocol uint8  `json:"inner_protocol"`
+	InnerSrcPort  uint16 `json:"inner_src_port"`
+	InnerDstPort  uint16 `json:"inner_dst_port"`
 }
 
-const (
-	MSS                 = 1460
-	NotTCPPayloadLength = 46 // 以太网 18 + IP头 20 + UDP头 8
-)
+// BaseFields 为默认输出的字段，其他字段需要配置后输出，避免影响依赖原有数据格式的输出端
+var BaseFields = []string{"id", "device", "create_time", "pack_size", "src_ip", "dst_ip"}
 
-func updateLength(packet gopacket.Packet, d *NetData) {
-	if packet.Metadata().Length <= 1518 {
-		return
-	}
-	var paylodLength int
-	var headerLength int
-	// TODO: MTU 的 1500 好像是对 IP层限制的，而不是TCP层限制的
-	if packet.Layer(layers.LayerTypeTCP) != nil {
-		tcpLayer := packet.Layer(layers.LayerTypeTCP)
-		l, _ := tcpLayer.(*layers.TCP)
+// NonIPFields 为非 IP 数据包总是输出的链路层字段，SizeRecord 的 non_ip_table 按这些字段聚合
+var NonIPFields = []string{"src_mac", "dst_mac", "ether_type"}
 
-		paylodLength = len(l.BaseLayer.Payload)
-		// TCP 层及更底层的所有协议层的Header之和
-		headerLength = packet.Metadata().Length - paylodLength
-		headerLength += 4
-	} else {
-		headerLength = NotTCPPayloadLength
-		paylodLength = packet.Metadata().Length - headerLength
+// FieldNames 返回 NetData 所有字段的 json 名称
+func FieldNames() []string {
+	t := reflect.TypeOf(NetData{})
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if tag := t.Field(i).Tag.Get("json"); tag != "" {
+			names = append(names, tag)
+		}
 	}
+	return names
+}
 
-	reassemblyPacketCount := paylodLength / MSS
-	if paylodLength%MSS != 0 {
-		reassemblyPacketCount++
+// NetDataFromPacket 解析已经创建的数据包，数据包的第一层作为解析的起点
+func NetDataFromPacket(device string, uID uint64, packet gopacket.Packet) NetData {
+	linkType := layers.LinkTypeEthernet
+	if l := packet.LinkLayer(); l != nil {
+		switch l.LayerType() {
+		case layers.LayerTypeLinuxSLL:
+			linkType = layers.LinkTypeLinuxSLL
+		case layers.LayerTypeLoopback:
+			linkType = layers.LinkTypeNull
+		}
+	} else if packet.NetworkLayer() != nil {
+		linkType = layers.LinkTypeRaw
 	}
-	d.PackSize += int32(headerLength * (reassemblyPacketCount - 1))
-
+	return NewDecoder(device, linkType, Options{}).Decode(uID, packet.Metadata().CaptureInfo, packet.Data())
 }
+
+const (
+	IPVersion4 = 4
+	IPVersion6 = 6
+)
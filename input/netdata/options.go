@@ -0,0 +1,55 @@
+package netdata
+
+import (
+	"fmt"
+	"net"
+)
+
+// DefaultMTU 为无法获取设备 MTU 时使用的值
+const DefaultMTU = 1500
+
+// Options 为 Decoder 的解析选项
+type Options struct {
+	// 需要解封装的隧道类型，为空则不解封装，只记录外层数据包
+	Decap []string
+	// VXLAN 使用的 UDP 目的端口，为空则使用 4789，flannel 等默认使用 8472
+	VXLANPorts []uint16
+	// 计算线路长度使用的 MTU，DeviceMTU 优先，都未配置时读取设备的 MTU，读取失败则为 1500
+	MTU       int
+	DeviceMTU map[string]int
+}
+
+// Validate 检查隧道类型是否支持以及 MTU 是否合法
+func (o Options) Validate() error {
+	for _, v := range o.Decap {
+		switch v {
+		case TunnelVXLAN, TunnelGRE, TunnelGeneve, TunnelIPIP:
+		default:
+			return fmt.Errorf("unsupported tunnel type (%s)", v)
+		}
+	}
+	if o.MTU < 0 {
+		return fmt.Errorf("invalid mtu (%d)", o.MTU)
+	}
+	for device, mtu := range o.DeviceMTU {
+		if mtu <= 0 {
+			return fmt.Errorf("invalid mtu (%d) of device (%s)", mtu, device)
+		}
+	}
+	return nil
+}
+
+// mtuOf 返回设备的 MTU
+func (o Options) mtuOf(device string) int {
+	if mtu, ok := o.DeviceMTU[device]; ok {
+		return mtu
+	}
+	if o.MTU > 0 {
+		return o.MTU
+	}
+	// 上传文件时设备可能已经不存在，此时使用默认值
+	if iface, err := net.InterfaceByName(device); err == nil && iface.MTU > 0 {
+		return iface.MTU
+	}
+	return DefaultMTU
+}
@@ -0,0 +1,124 @@
+package netdata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+var (
+	testSrcMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	testDstMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+)
+
+// serialize 将各层协议序列化为数据包，自动计算长度和校验和
+func serialize(tb testing.TB, ls ...gopacket.SerializableLayer) []byte {
+	tb.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+		tb.Fatalf("serialize packet: %v", err)
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+func ethernet(t layers.EthernetType) *layers.Ethernet {
+	return &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: t}
+}
+
+func ipv4(src, dst string, protocol layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: protocol, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+}
+
+func ipv6(src, dst string, next layers.IPProtocol) *layers.IPv6 {
+	return &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: next, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+}
+
+// ipv6FragmentHeader 构造 IPv6 分片扩展头，offset 为以 8 字节为单位的分片偏移
+func ipv6FragmentHeader(next layers.IPProtocol, offset uint16, more bool) []byte {
+	h := make([]byte, ipv6FragmentHeaderLength)
+	h[0] = byte(next)
+	v := offset << 3
+	if more {
+		v |= 1
+	}
+	binary.BigEndian.PutUint16(h[2:4], v)
+	binary.BigEndian.PutUint32(h[4:8], 0x1234)
+	return h
+}
+
+// craftedPacket 为写入 pcap 的数据包，snaplen 大于 0 时按 snaplen 截断
+type craftedPacket struct {
+	data    []byte
+	snaplen int
+}
+
+// writePcap 将数据包写入内存中的 pcap 文件，截断的数据包保留原始长度，与抓包时 snapshot_len 的效果相同
+func writePcap(tb testing.TB, linkType layers.LinkType, packets ...craftedPacket) *bytes.Buffer {
+	tb.Helper()
+	var buf bytes.Buffer
+	w := pcapgo.NewWriter(&buf)
+	if err := w.WriteFileHeader(65535, linkType); err != nil {
+		tb.Fatalf("write pcap header: %v", err)
+	}
+	ts := time.Unix(1600000000, 0)
+	for _, p := range packets {
+		data := p.data
+		if p.snaplen > 0 && p.snaplen < len(data) {
+			data = data[:p.snaplen]
+		}
+		ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(data), Length: len(p.data)}
+		if err := w.WritePacket(ci, data); err != nil {
+			tb.Fatalf("write pcap packet: %v", err)
+		}
+	}
+	return &buf
+}
+
+// decodePcap 读取 pcap 文件并解析其中的所有数据包
+func decodePcap(tb testing.TB, device string, o Options, buf *bytes.Buffer) []NetData {
+	tb.Helper()
+	r, err := pcapgo.NewReader(buf)
+	if err != nil {
+		tb.Fatalf("read pcap header: %v", err)
+	}
+	d := NewDecoder(device, r.LinkType(), o)
+	var result []NetData
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			return result
+		}
+		result = append(result, d.Decode(uint64(len(result)+1), ci, data))
+	}
+}
+
+// syntheticPackets 生成 n 个以太网 IPv4 数据包，TCP 和 UDP 交替，地址和端口各不相同，负载为 payloadSize 字节
+func syntheticPackets(tb testing.TB, n, payloadSize int) [][]byte {
+	tb.Helper()
+	payload := gopacket.Payload(make([]byte, payloadSize))
+	packets := make([][]byte, n)
+	for i := range packets {
+		src := net.IPv4(10, 0, byte(i>>8), byte(i)).String()
+		dst := net.IPv4(10, 1, byte(i>>8), byte(i)).String()
+		port := layers.TCPPort(1024 + i%60000)
+		if i%2 == 0 {
+			ip := ipv4(src, dst, layers.IPProtocolTCP)
+			tcp := &layers.TCP{SrcPort: port, DstPort: 443, Seq: uint32(i), ACK: true, PSH: true, Window: 512}
+			tcp.SetNetworkLayerForChecksum(ip)
+			packets[i] = serialize(tb, ethernet(layers.EthernetTypeIPv4), ip, tcp, payload)
+		} else {
+			ip := ipv4(src, dst, layers.IPProtocolUDP)
+			udp := &layers.UDP{SrcPort: layers.UDPPort(port), DstPort: 53}
+			udp.SetNetworkLayerForChecksum(ip)
+			packets[i] = serialize(tb, ethernet(layers.EthernetTypeIPv4), ip, udp, payload)
+		}
+	}
+	return packets
+}
@@ -0,0 +1,226 @@
+package netdata
+
+import (
+	"math"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// 支持解封装的隧道类型
+const (
+	TunnelVXLAN  = "vxlan"
+	TunnelGRE    = "gre"
+	TunnelGeneve = "geneve"
+	TunnelIPIP   = "ipip" // IPv4 或 IPv6 直接封装在 IP 中，包括 6in4、4in6
+)
+
+const (
+	VXLANPort  = 4789
+	GenevePort = 6081
+)
+
+// geneveHeaderLength 为 Geneve 选项之前的固定头部长度
+const geneveHeaderLength = 8
+
+// TunnelFields 为解封装后填充的字段，配置了 decap 时默认输出
+var TunnelFields = []string{"tunnel_type", "vni", "inner_src_ip", "inner_dst_ip"}
+
+// ipv4Layer 在遇到 IP-in-IP 时结束解析，避免内层 IP 头覆盖外层 IP 头，
+// 第一个分片包含传输层头部，继续解析，其他分片不再解析
+type ipv4Layer struct {
+	layers.IPv4
+}
+
+func (ip *ipv4Layer) NextLayerType() gopacket.LayerType {
+	if ip.FragOffset != 0 {
+		return gopacket.LayerTypeFragment
+	}
+	return stopAtIPInIP(ip.Protocol, ip.Protocol.LayerType())
+}
+
+func (ip *ipv4Layer) fragment() bool {
+	return ip.Flags&layers.IPv4MoreFragments != 0 || ip.FragOffset != 0
+}
+
+// ipv6Layer 在遇到 IP-in-IP 时结束解析，避免内层 IP 头覆盖外层 IP 头
+type ipv6Layer struct {
+	layers.IPv6
+}
+
+func (ip *ipv6Layer) NextLayerType() gopacket.LayerType {
+	next := ip.NextHeader
+	if ip.HopByHop != nil {
+		next = ip.HopByHop.NextHeader
+	}
+	return stopAtIPInIP(next, ip.IPv6.NextLayerType())
+}
+
+func stopAtIPInIP(protocol layers.IPProtocol, next gopacket.LayerType) gopacket.LayerType {
+	if protocol == layers.IPProtocolIPv4 || protocol == layers.IPProtocolIPv6 {
+		return gopacket.LayerTypeZero
+	}
+	return next
+}
+
+// innerLayers 解析隧道内层的数据包，与外层使用不同的结构体，外层的解析结果不会被覆盖
+type innerLayers struct {
+	parsers map[gopacket.LayerType]*gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+
+	eth   layers.Ethernet
+	dot1q layers.Dot1Q
+	ip4   ipv4Layer
+	ip6   ipv6Layer
+	ip6ex ipv6Extensions
+	frag6 ipv6Fragment
+	tcp   layers.TCP
+	udp   layers.UDP
+}
+
+func (l *innerLayers) parser(first gopacket.LayerType) *gopacket.DecodingLayerParser {
+	if l.parsers == nil {
+		l.parsers = make(map[gopacket.LayerType]*gopacket.DecodingLayerParser, 1)
+	}
+	if p, ok := l.parsers[first]; ok {
+		return p
+	}
+	p := gopacket.NewDecodingLayerParser(first,
+		&l.eth, &l.dot1q, &l.ip4, &l.ip6, &l.ip6ex, &l.frag6, &l.tcp, &l.udp)
+	p.IgnoreUnsupported = true
+	l.parsers[first] = p
+	return p
+}
+
+func (l *innerLayers) decode(first gopacket.LayerType, data []byte, n *NetData) {
+	_ = l.parser(first).DecodeLayers(data, &l.decoded)
+	for _, typ := range l.decoded {
+		switch typ {
+		case layers.LayerTypeIPv4:
+			n.InnerSrcIP = l.ip4.SrcIP.String()
+			n.InnerDstIP = l.ip4.DstIP.String()
+			n.InnerProtocol = uint8(l.ip4.Protocol)
+		case layers.LayerTypeIPv6:
+			n.InnerSrcIP = l.ip6.SrcIP.String()
+			n.InnerDstIP = l.ip6.DstIP.String()
+			n.InnerProtocol = uint8(l.ip6.NextHeader)
+			if l.ip6.HopByHop != nil {
+				n.InnerProtocol = uint8(l.ip6.HopByHop.NextHeader)
+			}
+		case layers.LayerTypeIPv6Destination, layers.LayerTypeIPv6Routing:
+			n.InnerProtocol = uint8(l.ip6ex.NextHeader)
+		case layers.LayerTypeIPv6Fragment:
+			n.InnerProtocol = uint8(l.frag6.NextHeader)
+		case layers.LayerTypeTCP:
+			n.InnerSrcPort = uint16(l.tcp.SrcPort)
+			n.InnerDstPort = uint16(l.tcp.DstPort)
+		case layers.LayerTypeUDP:
+			n.InnerSrcPort = uint16(l.udp.SrcPort)
+			n.InnerDstPort = uint16(l.udp.DstPort)
+		}
+	}
+}
+
+// decapsulate 识别隧道协议并解析内层数据包，只解封装一层，ipPayload 为外层 IP 头之后的数据
+func (d *Decoder) decapsulate(n *NetData, ipPayload []byte, udp *layers.UDP) {
+	var first gopacket.LayerType
+	var payload []byte
+	switch {
+	case udp != nil && d.decap[TunnelVXLAN] && d.vxlanPorts[uint16(udp.DstPort)]:
+		if err := d.vxlan.DecodeFromBytes(udp.Payload, gopacket.NilDecodeFeedback); err != nil {
+			return
+		}
+		n.TunnelType, n.VNI = TunnelVXLAN, d.vxlan.VNI
+		first, payload = layers.LayerTypeEthernet, d.vxlan.Payload
+	case udp != nil && d.decap[TunnelGeneve] && udp.DstPort == GenevePort:
+		if !validGeneve(udp.Payload) {
+			return
+		}
+		// layers.Geneve 每次解析都追加选项，复用前需要清空
+		d.geneve.Options = d.geneve.Options[:0]
+		if err := d.geneve.DecodeFromBytes(udp.Payload, gopacket.NilDecodeFeedback); err != nil {
+			return
+		}
+		var ok bool
+		if first, ok = innerLayerType(d.geneve.Protocol); !ok {
+			return
+		}
+		n.TunnelType, n.VNI = TunnelGeneve, d.geneve.VNI
+		// layers.Geneve 只按 4 位解析单个选项的长度，按头部中的选项总长度确定内层数据包的位置
+		payload = udp.Payload[geneveHeaderLength+int(d.geneve.OptionsLength):]
+	case n.Protocol == uint8(layers.IPProtocolGRE) && d.decap[TunnelGRE]:
+		if !validGRE(ipPayload) {
+			return
+		}
+		if err := d.gre.DecodeFromBytes(ipPayload, gopacket.NilDecodeFeedback); err != nil {
+			return
+		}
+		var ok bool
+		if first, ok = innerLayerType(d.gre.Protocol); !ok {
+			return
+		}
+		n.TunnelType = TunnelGRE
+		if d.gre.KeyPresent {
+			n.VNI = d.gre.Key
+			// NVGRE 的 VSID 为 key 的高 24 位
+			if d.gre.Protocol == layers.EthernetTypeTransparentEthernetBridging {
+				n.VNI = d.gre.Key >> 8
+			}
+		}
+		payload = d.gre.Payload
+	case n.Protocol == uint8(layers.IPProtocolIPv4) && d.decap[TunnelIPIP]:
+		n.TunnelType = TunnelIPIP
+		first, payload = layers.LayerTypeIPv4, ipPayload
+	case n.Protocol == uint8(layers.IPProtocolIPv6) && d.decap[TunnelIPIP]:
+		n.TunnelType = TunnelIPIP
+		first, payload = layers.LayerTypeIPv6, ipPayload
+	default:
+		return
+	}
+	d.inner.decode(first, payload, n)
+}
+
+// innerLayerType 返回 GRE、Geneve 中的协议类型对应的内层协议
+func innerLayerType(t layers.EthernetType) (gopacket.LayerType, bool) {
+	switch t {
+	case layers.EthernetTypeTransparentEthernetBridging:
+		return layers.LayerTypeEthernet, true
+	case layers.EthernetTypeIPv4:
+		return layers.LayerTypeIPv4, true
+	case layers.EthernetTypeIPv6:
+		return layers.LayerTypeIPv6, true
+	}
+	return gopacket.LayerTypeZero, false
+}
+
+// validGRE 检查 GRE 头的长度，layers.GRE 解析前不检查长度，截断的数据包会导致 panic，
+// 已经废弃的 routing 字段不支持
+func validGRE(data []byte) bool {
+	if len(data) < 4 || data[0]&0x40 != 0 {
+		return false
+	}
+	size := 4
+	if data[0]&0x80 != 0 {
+		size += 4
+	}
+	if data[0]&0x20 != 0 {
+		size += 4
+	}
+	if data[0]&0x10 != 0 {
+		size += 4
+	}
+	if data[1]&0x80 != 0 {
+		size += 4
+	}
+	return len(data) >= size
+}
+
+// validGeneve 检查 Geneve 头（RFC 8926）的版本和长度，layers.Geneve 解析前只检查固定头部的长度，
+// 截断的选项会导致 panic，选项和固定头部超过 255 字节时其中的 uint8 偏移会溢出，也不支持
+func validGeneve(data []byte) bool {
+	if len(data) < geneveHeaderLength || data[0]>>6 != 0 {
+		return false
+	}
+	size := geneveHeaderLength + int(data[0]&0x3f)*4
+	return size <= math.MaxUint8 && len(data) >= size
+}
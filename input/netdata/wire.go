@@ -0,0 +1,41 @@
+package netdata
+
+import (
+	"github.com/google/gopacket/layers"
+)
+
+const ipv6FragmentHeaderLength = 8
+
+// wireLength 计算数据包在线路上的实际长度。
+// 开启 GRO/TSO 时抓到的数据包是网卡合并或尚未分段的大包，IP 包长度超过 MTU，需要按线路上的分段还原：
+// TCP 按 MSS 分段，每段都带有链路层、IP（含选项和扩展头）和 TCP（含选项）头部；
+// 其他协议按 IP 分片计算，分片负载为 8 字节的整数倍，IPv6 每个分片还带有分片扩展头。
+// 数据包本身是 IP 分片，或者不是 IP 包时，抓到的长度就是线路长度。
+// l2Length 为链路层头部长度（含 VLAN 标签），ipHeaderLength 为 IP 头部长度，非 IP 包为 0
+func wireLength(length, l2Length, ipHeaderLength int, ipVersion uint8, tcp *layers.TCP, fragment bool, mtu int) int {
+	l3Length := length - l2Length
+	if ipHeaderLength == 0 || fragment || l3Length <= mtu {
+		return length
+	}
+	payloadLength := l3Length - ipHeaderLength
+	if tcp != nil {
+		tcpHeaderLength := int(tcp.DataOffset) * 4
+		mss := mtu - ipHeaderLength - tcpHeaderLength
+		payloadLength -= tcpHeaderLength
+		if mss <= 0 || payloadLength <= 0 {
+			return length
+		}
+		segments := (payloadLength + mss - 1) / mss
+		return segments*(l2Length+ipHeaderLength+tcpHeaderLength) + payloadLength
+	}
+	fragmentHeaderLength := 0
+	if ipVersion == IPVersion6 {
+		fragmentHeaderLength = ipv6FragmentHeaderLength
+	}
+	maxFragmentPayload := (mtu - ipHeaderLength - fragmentHeaderLength) &^ 7
+	if maxFragmentPayload <= 0 {
+		return length
+	}
+	fragments := (payloadLength + maxFragmentPayload - 1) / maxFragmentPayload
+	return fragments*(l2Length+ipHeaderLength+fragmentHeaderLength) + payloadLength
+}
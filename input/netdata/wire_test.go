@@ -0,0 +1,222 @@
+package netdata
+
+import (
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func tcpPacket(tb testing.TB, payloadSize int) []byte {
+	ip := ipv4("10.0.0.1", "10.0.0.2", layers.IPProtocolTCP)
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, Seq: 1, ACK: true}
+	tcp.SetNetworkLayerForChecksum(ip)
+	return serialize(tb, ethernet(layers.EthernetTypeIPv4), ip, tcp, gopacket.Payload(make([]byte, payloadSize)))
+}
+
+func udpPacket(tb testing.TB, payloadSize int) []byte {
+	ip := ipv4("10.0.0.1", "10.0.0.2", layers.IPProtocolUDP)
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+	return serialize(tb, ethernet(layers.EthernetTypeIPv4), ip, udp, gopacket.Payload(make([]byte, payloadSize)))
+}
+
+func udp6Packet(tb testing.TB, payloadSize int) []byte {
+	ip := ipv6("2001:db8::1", "2001:db8::2", layers.IPProtocolUDP)
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+	return serialize(tb, ethernet(layers.EthernetTypeIPv6), ip, udp, gopacket.Payload(make([]byte, payloadSize)))
+}
+
+// udp6Fragment 构造 IPv6 UDP 数据报的一个分片，第一个分片包含 UDP 头
+func udp6Fragment(tb testing.TB, offset uint16, more bool, payloadSize int) []byte {
+	ip := ipv6("2001:db8::1", "2001:db8::2", layers.IPProtocolIPv6Fragment)
+	payload := make([]byte, payloadSize)
+	if offset == 0 {
+		udp := &layers.UDP{SrcPort: 40000, DstPort: 53, Length: 3008}
+		udp.SetNetworkLayerForChecksum(ip)
+		payload = append(serialize(tb, udp), payload...)
+	}
+	return serialize(tb, ethernet(layers.EthernetTypeIPv6), ip,
+		gopacket.Payload(append(ipv6FragmentHeader(layers.IPProtocolUDP, offset, more), payload...)))
+}
+
+func TestDecodeCraftedPcap(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  craftedPacket
+		options Options
+		want    NetData
+	}{
+		{
+			name:    "tcp",
+			packet:  craftedPacket{data: tcpPacket(t, 100)},
+			options: Options{MTU: 1500},
+			want: NetData{SrcIP: "10.0.0.1", DstIP: "10.0.0.2", IPVersion: 4, Protocol: 6, SrcPort: 40000, DstPort: 443,
+				PayloadLength: 100, WireBytes: 154, CapturedBytes: 154},
+		},
+		{
+			name:    "tcp truncated by snaplen",
+			packet:  craftedPacket{data: tcpPacket(t, 1000), snaplen: 64},
+			options: Options{MTU: 1500},
+			want: NetData{SrcIP: "10.0.0.1", DstIP: "10.0.0.2", IPVersion: 4, Protocol: 6, SrcPort: 40000, DstPort: 443,
+				PayloadLength: 1000, WireBytes: 1054, CapturedBytes: 64},
+		},
+		{
+			name:    "truncated in ip header",
+			packet:  craftedPacket{data: tcpPacket(t, 1000), snaplen: 24},
+			options: Options{MTU: 1500},
+			want:    NetData{WireBytes: 1054, CapturedBytes: 24},
+		},
+		{
+			// 4000 字节负载按 MSS 1460 分为 3 段，每段都有 14+20+20 字节的头部
+			name:    "tcp gro with mtu",
+			packet:  craftedPacket{data: tcpPacket(t, 4000), snaplen: 128},
+			options: Options{MTU: 1500},
+			want: NetData{SrcIP: "10.0.0.1", DstIP: "10.0.0.2", IPVersion: 4, Protocol: 6, SrcPort: 40000, DstPort: 443,
+				PayloadLength: 4000, WireBytes: 3*54 + 4000, CapturedBytes: 128},
+		},
+		{
+			name:    "device mtu overrides mtu",
+			packet:  craftedPacket{data: tcpPacket(t, 4000), snaplen: 128},
+			options: Options{MTU: 1500, DeviceMTU: map[string]int{"test0": 9000}},
+			want: NetData{SrcIP: "10.0.0.1", DstIP: "10.0.0.2", IPVersion: 4, Protocol: 6, SrcPort: 40000, DstPort: 443,
+				PayloadLength: 4000, WireBytes: 4054, CapturedBytes: 128},
+		},
+		{
+			name:    "mtu of other device is not used",
+			packet:  craftedPacket{data: tcpPacket(t, 4000), snaplen: 128},
+			options: Options{MTU: 1500, DeviceMTU: map[string]int{"test1": 9000}},
+			want: NetData{SrcIP: "10.0.0.1", DstIP: "10.0.0.2", IPVersion: 4, Protocol: 6, SrcPort: 40000, DstPort: 443,
+				PayloadLength: 4000, WireBytes: 3*54 + 4000, CapturedBytes: 128},
+		},
+		{
+			// UDP 头和 3000 字节负载按 1480 字节分为 3 个 IPv4 分片
+			name:    "udp larger than mtu",
+			packet:  craftedPacket{data: udpPacket(t, 3000), snaplen: 128},
+			options: Options{MTU: 1500},
+			want: NetData{SrcIP: "10.0.0.1", DstIP: "10.0.0.2", IPVersion: 4, Protocol: 17, SrcPort: 40000, DstPort: 53,
+				PayloadLength: 3000, WireBytes: 3*34 + 3008, CapturedBytes: 128},
+		},
+		{
+			// IPv6 分片负载为 (1500-40-8)&^7 = 1448 字节，每个分片还有 8 字节的分片扩展头
+			name:    "ipv6 udp larger than mtu",
+			packet:  craftedPacket{data: udp6Packet(t, 3000), snaplen: 128},
+			options: Options{MTU: 1500},
+			want: NetData{SrcIP: "2001:db8::1", DstIP: "2001:db8::2", IPVersion: 6, Protocol: 17, SrcPort: 40000, DstPort: 53,
+				PayloadLength: 3000, WireBytes: 3*62 + 3008, CapturedBytes: 128},
+		},
+		{
+			name:    "ipv6 first fragment",
+			packet:  craftedPacket{data: udp6Fragment(t, 0, true, 1440)},
+			options: Options{MTU: 1500},
+			want: NetData{SrcIP: "2001:db8::1", DstIP: "2001:db8::2", IPVersion: 6, Protocol: 17, SrcPort: 40000, DstPort: 53,
+				PayloadLength: 1440, WireBytes: 1510, CapturedBytes: 1510, IPFragment: true},
+		},
+		{
+			name:    "ipv6 later fragment",
+			packet:  craftedPacket{data: udp6Fragment(t, 181, false, 1560)},
+			options: Options{MTU: 1500},
+			want: NetData{SrcIP: "2001:db8::1", DstIP: "2001:db8::2", IPVersion: 6, Protocol: 17,
+				PayloadLength: 1560, WireBytes: 1622, CapturedBytes: 1622, IPFragment: true},
+		},
+		{
+			name:    "ipv6 fragment header truncated",
+			packet:  craftedPacket{data: udp6Fragment(t, 0, true, 1440), snaplen: 58},
+			options: Options{MTU: 1500},
+			want: NetData{SrcIP: "2001:db8::1", DstIP: "2001:db8::2", IPVersion: 6, Protocol: 44,
+				PayloadLength: 1456, WireBytes: 1510, CapturedBytes: 58},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := decodePcap(t, "test0", tt.options, writePcap(t, layers.LinkTypeEthernet, tt.packet))
+			if len(result) != 1 {
+				t.Fatalf("decoded %d packets, want 1", len(result))
+			}
+			got := result[0]
+			// 只比较与网络层、传输层和长度相关的字段
+			got.ID, got.Device, got.CreateTime, got.PackSize = 0, "", tt.want.CreateTime, 0
+			got.SrcMAC, got.DstMAC, got.EtherType = "", "", 0
+			got.TTL, got.TCPFlags, got.TCPSeq, got.TCPAck, got.TCPWindow = 0, 0, 0, 0, 0
+			if got != tt.want {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+			if result[0].PackSize != tt.want.WireBytes {
+				t.Errorf("pack_size %d, want %d", result[0].PackSize, tt.want.WireBytes)
+			}
+		})
+	}
+}
+
+func TestOptionsMTUOf(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		device  string
+		want    int
+	}{
+		{"device mtu", Options{MTU: 1400, DeviceMTU: map[string]int{"eth1": 9000}}, "eth1", 9000},
+		{"global mtu", Options{MTU: 1400, DeviceMTU: map[string]int{"eth1": 9000}}, "eth2", 1400},
+		{"default for unknown device", Options{}, "no-such-device0", DefaultMTU},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.options.mtuOf(tt.device); got != tt.want {
+				t.Errorf("mtuOf(%s) = %d, want %d", tt.device, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		wantErr bool
+	}{
+		{"empty", Options{}, false},
+		{"tunnels", Options{Decap: []string{TunnelVXLAN, TunnelGRE, TunnelGeneve, TunnelIPIP}}, false},
+		{"unknown tunnel", Options{Decap: []string{"mpls"}}, true},
+		{"negative mtu", Options{MTU: -1}, true},
+		{"zero device mtu", Options{DeviceMTU: map[string]int{"eth0": 0}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.options.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWireLength(t *testing.T) {
+	tcp := &layers.TCP{DataOffset: 8} // 带 12 字节选项
+	tests := []struct {
+		name           string
+		length         int
+		l2Length       int
+		ipHeaderLength int
+		ipVersion      uint8
+		tcp            *layers.TCP
+		fragment       bool
+		mtu            int
+		want           int
+	}{
+		{"not larger than mtu", 1514, 14, 20, IPVersion4, tcp, false, 1500, 1514},
+		{"not ip", 9000, 14, 0, 0, nil, false, 1500, 9000},
+		{"fragment is not split", 9014, 14, 20, IPVersion4, nil, true, 1500, 9014},
+		// 负载 9014-18-20-32 = 8944，MSS 为 1448，分为 7 段
+		{"tcp with options", 9014, 18, 20, IPVersion4, tcp, false, 1500, 7*(18+20+32) + 8944},
+		{"mss not positive", 9014, 14, 60, IPVersion4, &layers.TCP{DataOffset: 15}, false, 100, 9014},
+		{"ipv6 with extension headers", 3054, 14, 48, IPVersion6, nil, false, 1500, 3*(14+48+8) + 2992},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := wireLength(tt.length, tt.l2Length, tt.ipHeaderLength, tt.ipVersion, tt.tcp, tt.fragment, tt.mtu)
+			if got != tt.want {
+				t.Errorf("wireLength() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
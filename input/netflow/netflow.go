@@ -0,0 +1,228 @@
+package netflow
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// RecordType 与 Packet input 输出的流记录相同，SizeRecord 按 bytes 和 packets 统计
+const RecordType = "flow"
+
+const (
+	Version5     = 5
+	Version9     = 9
+	VersionIPFIX = 10
+)
+
+var errShortPacket = errors.New("packet too short")
+
+const (
+	// maxTemplatesPerDomain 为每个 exporter 的每个 source id 最多缓存的模板数量，超过后忽略新的模板
+	maxTemplatesPerDomain = 1024
+	// templateTimeout 为模板没有刷新后保留的时间，exporter 超过该时间没有报文时同时删除它上报的采样率
+	templateTimeout = 30 * time.Minute
+	// expireInterval 为检查模板是否过期的间隔
+	expireInterval = time.Minute
+)
+
+// Flow 为解析后的一条流记录，字段名与 NetData 和 Packet input 的流记录保持一致，
+// bytes 和 packets 已经按采样率换算为实际流量
+type Flow struct {
+	Type       string    `json:"type"`
+	Device     string    `json:"device"` // exporter 的地址和输入接口的 ifIndex，如 10.0.0.1:3
+	CreateTime time.Time `json:"create_time"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+
+	SrcIP     string `json:"src_ip"`
+	DstIP     string `json:"dst_ip"`
+	SrcPort   uint16 `json:"src_port"`
+	DstPort   uint16 `json:"dst_port"`
+	IPVersion uint8  `json:"ip_version"`
+	Protocol  uint8  `json:"protocol"`
+	TCPFlags  uint8  `json:"tcp_flags"`
+	DSCP      uint8  `json:"dscp"`
+	ECN       uint8  `json:"ecn"`
+	VLANID    uint16 `json:"vlan_id"`
+
+	Bytes   int64 `json:"bytes"`
+	Packets int64 `json:"packets"`
+
+	Exporter        string `json:"exporter"`
+	InputInterface  uint32 `json:"input_interface"`
+	OutputInterface uint32 `json:"output_interface"`
+	SamplingRate    uint32 `json:"sampling_rate"` // bytes 和 packets 乘以的倍数
+}
+
+// Decoder 解析 NetFlow v5、v9 和 IPFIX 报文，v9 和 IPFIX 的模板按 exporter 和 source id 缓存，
+// 超过 templateTimeout 没有刷新的模板被删除，Decoder 不能在多个 goroutine 中同时使用
+type Decoder struct {
+	// samplingRate 大于 0 时忽略 exporter 上报的采样率
+	samplingRate uint32
+	domains      map[domainKey]*domain
+	lastExpire   time.Time
+	now          func() time.Time
+}
+
+type domainKey struct {
+	exporter string
+	domain   uint32 // v9 的 source id，IPFIX 的 observation domain id
+}
+
+// domain 为一个 exporter 的一个 source id 的模板和通过 options 数据记录上报的采样率
+type domain struct {
+	templates map[uint16]*template
+	sampling  uint32
+	lastSeen  time.Time // 最后一个报文的接收时间
+}
+
+func NewDecoder(samplingRate uint32) *Decoder {
+	return &Decoder{
+		samplingRate: samplingRate,
+		domains:      make(map[domainKey]*domain),
+		now:          time.Now,
+	}
+}
+
+// domain 返回 exporter 的 source id 对应的状态，不存在时创建
+func (d *Decoder) domain(key domainKey, now time.Time) *domain {
+	s, ok := d.domains[key]
+	if !ok {
+		s = &domain{templates: make(map[uint16]*template)}
+		d.domains[key] = s
+	}
+	s.lastSeen = now
+	return s
+}
+
+// expire 删除超过 templateTimeout 没有刷新的模板，以及超过 templateTimeout 没有报文的 exporter
+func (d *Decoder) expire(now time.Time) {
+	if now.Sub(d.lastExpire) < expireInterval {
+		return
+	}
+	d.lastExpire = now
+	for key, s := range d.domains {
+		if now.Sub(s.lastSeen) >= templateTimeout {
+			delete(d.domains, key)
+			continue
+		}
+		for id, t := range s.templates {
+			if now.Sub(t.updated) >= templateTimeout {
+				delete(s.templates, id)
+			}
+		}
+	}
+}
+
+// Decode 解析 exporter 发送的一个报文，只包含模板的报文返回空
+func (d *Decoder) Decode(exporter string, data []byte) ([]Flow, error) {
+	if len(data) < 2 {
+		return nil, errShortPacket
+	}
+	d.expire(d.now())
+	switch version := binary.BigEndian.Uint16(data); version {
+	case Version5:
+		return d.decodeV5(exporter, data)
+	case Version9:
+		return d.decodeV9(exporter, data)
+	case VersionIPFIX:
+		return d.decodeIPFIX(exporter, data)
+	default:
+		return nil, fmt.Errorf("unsupported version (%d)", version)
+	}
+}
+
+const (
+	v5HeaderLength = 24
+	v5RecordLength = 48
+)
+
+func (d *Decoder) decodeV5(exporter string, data []byte) ([]Flow, error) {
+	if len(data) < v5HeaderLength {
+		return nil, errShortPacket
+	}
+	count := int(binary.BigEndian.Uint16(data[2:]))
+	sysUptime := binary.BigEndian.Uint32(data[4:])
+	unixSecs := binary.BigEndian.Uint32(data[8:])
+	unixNsecs := binary.BigEndian.Uint32(data[12:])
+	// 高 2 位为采样模式，低 14 位为采样间隔
+	samplingInterval := uint32(binary.BigEndian.Uint16(data[22:]) & 0x3fff)
+	if len(data) < v5HeaderLength+count*v5RecordLength {
+		return nil, errShortPacket
+	}
+	boot := time.Unix(int64(unixSecs), int64(unixNsecs)).Add(-time.Duration(sysUptime) * time.Millisecond)
+	flows := make([]Flow, 0, count)
+	for i := 0; i < count; i++ {
+		b := data[v5HeaderLength+i*v5RecordLength:]
+		r := record{
+			srcIP:     net.IP(b[0:4]),
+			dstIP:     net.IP(b[4:8]),
+			input:     uint32(binary.BigEndian.Uint16(b[12:])),
+			output:    uint32(binary.BigEndian.Uint16(b[14:])),
+			packets:   uint64(binary.BigEndian.Uint32(b[16:])),
+			bytes:     uint64(binary.BigEndian.Uint32(b[20:])),
+			srcPort:   binary.BigEndian.Uint16(b[32:]),
+			dstPort:   binary.BigEndian.Uint16(b[34:]),
+			tcpFlags:  b[37],
+			protocol:  b[38],
+			tos:       b[39],
+			ipVersion: 4,
+			sampling:  uint64(samplingInterval),
+			firstSeen: boot.Add(time.Duration(binary.BigEndian.Uint32(b[24:])) * time.Millisecond),
+			lastSeen:  boot.Add(time.Duration(binary.BigEndian.Uint32(b[28:])) * time.Millisecond),
+		}
+		flows = append(flows, d.flow(exporter, r, 0))
+	}
+	return flows, nil
+}
+
+// flow 将解析出的字段转换为 Flow，并按采样率换算流量
+func (d *Decoder) flow(exporter string, r record, exporterRate uint32) Flow {
+	rate := d.samplingRate
+	if rate == 0 {
+		rate = r.samplingRate()
+	}
+	if rate == 0 {
+		rate = exporterRate
+	}
+	if rate == 0 {
+		rate = 1
+	}
+	f := Flow{
+		Type:            RecordType,
+		Device:          fmt.Sprintf("%s:%d", exporter, r.input),
+		FirstSeen:       r.firstSeen,
+		LastSeen:        r.lastSeen,
+		SrcPort:         r.srcPort,
+		DstPort:         r.dstPort,
+		IPVersion:       r.ipVersion,
+		Protocol:        r.protocol,
+		TCPFlags:        r.tcpFlags,
+		DSCP:            r.tos >> 2,
+		ECN:             r.tos & 0x03,
+		VLANID:          r.vlanID,
+		Bytes:           int64(r.bytes) * int64(rate),
+		Packets:         int64(r.packets) * int64(rate),
+		Exporter:        exporter,
+		InputInterface:  r.input,
+		OutputInterface: r.output,
+		SamplingRate:    rate,
+	}
+	if r.srcIP != nil {
+		f.SrcIP = r.srcIP.String()
+	}
+	if r.dstIP != nil {
+		f.DstIP = r.dstIP.String()
+	}
+	if f.IPVersion == 0 && len(r.srcIP) > 0 {
+		f.IPVersion = 6
+		if len(r.srcIP) == net.IPv4len {
+			f.IPVersion = 4
+		}
+	}
+	f.CreateTime = f.LastSeen
+	return f
+}
@@ -0,0 +1,208 @@
+package netflow
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportTime 为测试报文头中的时间 2021-06-01T08:00:00Z
+var exportTime = time.Unix(1622534400, 0)
+
+// readHex 读取 testdata 中的报文，每行为空格分隔的十六进制字节，# 之后为注释
+func readHex(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		b.WriteString(strings.Join(strings.Fields(line), ""))
+	}
+	packet, err := hex.DecodeString(b.String())
+	if err != nil {
+		t.Fatalf("decode %s: %v", name, err)
+	}
+	return packet
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want []Flow
+	}{
+		{
+			name: "v5",
+			file: "v5.hex",
+			// 设备启动时间为 exportTime 之前 10s，采样间隔为 10
+			want: []Flow{
+				{
+					Type: RecordType, Device: "10.0.0.100:3",
+					CreateTime: exportTime.Add(-time.Second), LastSeen: exportTime.Add(-time.Second),
+					FirstSeen: exportTime.Add(-6 * time.Second), SrcIP: "10.0.0.1", DstIP: "10.0.0.2",
+					SrcPort: 40000, DstPort: 443, IPVersion: 4, Protocol: 6,
+					TCPFlags: 0x1b, DSCP: 46, Bytes: 15000, Packets: 50,
+					Exporter: "10.0.0.100", InputInterface: 3, OutputInterface: 4, SamplingRate: 10,
+				},
+				{
+					Type: RecordType, Device: "10.0.0.100:3",
+					CreateTime: exportTime.Add(-500 * time.Millisecond), LastSeen: exportTime.Add(-500 * time.Millisecond),
+					FirstSeen: exportTime.Add(-500 * time.Millisecond), SrcIP: "10.0.0.3", DstIP: "8.8.8.8",
+					SrcPort: 5353, DstPort: 53, IPVersion: 4, Protocol: 17,
+					Bytes: 800, Packets: 10, Exporter: "10.0.0.100", InputInterface: 3, OutputInterface: 5, SamplingRate: 10,
+				},
+			},
+		},
+		{
+			name: "v9",
+			file: "v9.hex",
+			// 设备启动时间为 exportTime 之前 120s，采样率来自 options 数据记录
+			want: []Flow{
+				{
+					Type: RecordType, Device: "10.0.0.100:7",
+					CreateTime: exportTime.Add(-59 * time.Second), LastSeen: exportTime.Add(-59 * time.Second),
+					FirstSeen: exportTime.Add(-60 * time.Second), SrcIP: "192.168.1.10", DstIP: "192.168.1.20",
+					SrcPort: 50000, DstPort: 80, IPVersion: 4, Protocol: 6,
+					Bytes: 400000, Packets: 1000, Exporter: "10.0.0.100", InputInterface: 7, SamplingRate: 100,
+				},
+				{
+					Type: RecordType, Device: "10.0.0.100:7",
+					CreateTime: exportTime.Add(-59100 * time.Millisecond), LastSeen: exportTime.Add(-59100 * time.Millisecond),
+					FirstSeen: exportTime.Add(-59500 * time.Millisecond), SrcIP: "192.168.1.11", DstIP: "192.168.1.20",
+					SrcPort: 50001, DstPort: 80, IPVersion: 4, Protocol: 6,
+					Bytes: 60000, Packets: 200, Exporter: "10.0.0.100", InputInterface: 7, SamplingRate: 100,
+				},
+			},
+		},
+		{
+			name: "ipfix",
+			file: "ipfix.hex",
+			// 变长字段和企业字段被跳过，采样率为 (1 + 9) / 1
+			want: []Flow{
+				{
+					Type: RecordType, Device: "10.0.0.100:12",
+					CreateTime: time.UnixMilli(exportTime.UnixMilli() + 2000), LastSeen: time.UnixMilli(exportTime.UnixMilli() + 2000),
+					FirstSeen: time.UnixMilli(exportTime.UnixMilli() + 1000), SrcIP: "2001:db8::1", DstIP: "2001:db8::2",
+					SrcPort: 40000, DstPort: 443, IPVersion: 6, Protocol: 6,
+					Bytes: 90000, Packets: 60, Exporter: "10.0.0.100", InputInterface: 12, SamplingRate: 10,
+				},
+				{
+					Type: RecordType, Device: "10.0.0.100:12",
+					CreateTime: time.UnixMilli(exportTime.UnixMilli() + 3000), LastSeen: time.UnixMilli(exportTime.UnixMilli() + 3000),
+					FirstSeen: time.UnixMilli(exportTime.UnixMilli() + 3000), SrcIP: "2001:db8::3", DstIP: "2001:db8::2",
+					SrcPort: 40001, DstPort: 53, IPVersion: 6, Protocol: 17,
+					Bytes: 1200, Packets: 10, Exporter: "10.0.0.100", InputInterface: 12, SamplingRate: 10,
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flows, err := NewDecoder(0).Decode("10.0.0.100", readHex(t, tt.file))
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !reflect.DeepEqual(flows, tt.want) {
+				t.Errorf("flows:\n got %+v\nwant %+v", flows, tt.want)
+			}
+		})
+	}
+}
+
+// v9DataOnly 返回 v9.hex 中只保留数据 flowset 的报文，模板和 options 依次占 48、24、16 字节
+func v9DataOnly(t *testing.T) []byte {
+	t.Helper()
+	packet := readHex(t, "v9.hex")
+	data := append([]byte(nil), packet[:v9HeaderLength]...)
+	binary.BigEndian.PutUint16(data[2:], 1)
+	return append(data, packet[v9HeaderLength+48+24+16:]...)
+}
+
+func TestDecodeWithoutTemplate(t *testing.T) {
+	d := NewDecoder(0)
+	flows, err := d.Decode("10.0.0.100", v9DataOnly(t))
+	if err != nil || len(flows) != 0 {
+		t.Fatalf("Decode = %v, %v, want no flows before template", flows, err)
+	}
+	// 其他 exporter 的模板不能用于解析
+	if _, err := d.Decode("10.0.0.200", readHex(t, "v9.hex")); err != nil {
+		t.Fatal(err)
+	}
+	if flows, _ := d.Decode("10.0.0.100", v9DataOnly(t)); len(flows) != 0 {
+		t.Errorf("decoded %d flows with template of another exporter", len(flows))
+	}
+}
+
+func TestTemplateExpiry(t *testing.T) {
+	now := exportTime
+	d := NewDecoder(0)
+	d.now = func() time.Time { return now }
+	if _, err := d.Decode("10.0.0.100", readHex(t, "v9.hex")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Decode("10.0.0.200", readHex(t, "v9.hex")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 10.0.0.100 一直发送数据但不刷新模板，超过 templateTimeout 后模板被删除
+	now = now.Add(templateTimeout / 2)
+	if flows, _ := d.Decode("10.0.0.100", v9DataOnly(t)); len(flows) != 2 {
+		t.Fatalf("decoded %d flows before template timeout, want 2", len(flows))
+	}
+	now = now.Add(templateTimeout / 2)
+	flows, err := d.Decode("10.0.0.100", v9DataOnly(t))
+	if err != nil || len(flows) != 0 {
+		t.Errorf("Decode = %v, %v, want no flows after template timeout", flows, err)
+	}
+	// 10.0.0.200 超过 templateTimeout 没有报文，模板和采样率一起删除
+	if len(d.domains) != 1 {
+		t.Errorf("decoder keeps %d domains, want 1", len(d.domains))
+	}
+	if s := d.domains[domainKey{exporter: "10.0.0.100", domain: 1}]; s == nil || len(s.templates) != 0 || s.sampling != 100 {
+		t.Errorf("domain of 10.0.0.100 = %+v", s)
+	}
+}
+
+// ipfixTemplatePacket 返回包含模板 ids 的 IPFIX 报文，每个模板只有一个字段
+func ipfixTemplatePacket(ids ...uint16) []byte {
+	set := make([]byte, 4, 4+len(ids)*8)
+	binary.BigEndian.PutUint16(set, 2)
+	binary.BigEndian.PutUint16(set[2:], uint16(4+len(ids)*8))
+	for _, id := range ids {
+		set = append(set, byte(id>>8), byte(id), 0, 1, 0, 4, 0, 4)
+	}
+	packet := make([]byte, ipfixHeaderLength)
+	binary.BigEndian.PutUint16(packet, VersionIPFIX)
+	binary.BigEndian.PutUint16(packet[2:], uint16(ipfixHeaderLength+len(set)))
+	return append(packet, set...)
+}
+
+func TestTemplateLimit(t *testing.T) {
+	d := NewDecoder(0)
+	ids := make([]uint16, maxTemplatesPerDomain)
+	for i := range ids {
+		ids[i] = uint16(256 + i)
+	}
+	if _, err := d.Decode("10.0.0.100", ipfixTemplatePacket(ids...)); err != nil {
+		t.Fatal(err)
+	}
+	// 已有的模板可以更新，新的模板被忽略
+	if _, err := d.Decode("10.0.0.100", ipfixTemplatePacket(256)); err != nil {
+		t.Errorf("update template: %v", err)
+	}
+	if _, err := d.Decode("10.0.0.100", ipfixTemplatePacket(256+maxTemplatesPerDomain)); err == nil {
+		t.Error("Decode accepted a template over the limit")
+	}
+	if _, err := d.Decode("10.0.0.200", ipfixTemplatePacket(256+maxTemplatesPerDomain)); err != nil {
+		t.Errorf("template of another exporter: %v", err)
+	}
+}
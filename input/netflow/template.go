@@ -0,0 +1,388 @@
+package netflow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"traffic-statistics/pkg/ipfix"
+)
+
+// fieldSpec 为模板中的一个字段，enterprise 不为 0 时为厂商自定义字段，解析时跳过
+type fieldSpec struct {
+	id         uint16
+	enterprise uint32
+	length     uint16
+}
+
+type template struct {
+	fields []fieldSpec
+	// options 模板的数据记录不是流，只用于获取 exporter 的采样率
+	options bool
+	updated time.Time // 最后一次收到该模板的时间
+}
+
+// minLength 为一条数据记录的最小长度，变长字段至少占 1 字节
+func (t *template) minLength() int {
+	n := 0
+	for _, f := range t.fields {
+		if f.length == ipfix.VariableLength {
+			n++
+		} else {
+			n += int(f.length)
+		}
+	}
+	return n
+}
+
+// record 为一条数据记录中需要的字段，IP 地址引用报文的数据，需要在报文被复用前转换为 Flow
+type record struct {
+	bytes, packets   uint64
+	srcIP, dstIP     net.IP
+	srcPort, dstPort uint16
+	protocol         uint8
+	tos              uint8
+	tcpFlags         uint8
+	ipVersion        uint8
+	input, output    uint32
+	vlanID           uint16
+
+	sampling                    uint64
+	packetInterval, packetSpace uint64
+
+	firstSeen, lastSeen time.Time
+	// v9 中以设备启动后的毫秒数表示的时间，需要根据报文头中的 sysUptime 换算
+	startUptime, endUptime uint32
+	hasUptime              bool
+}
+
+// samplingRate 返回数据记录中的采样率，没有时返回 0
+func (r *record) samplingRate() uint32 {
+	if r.sampling > 0 {
+		return uint32(r.sampling)
+	}
+	if r.packetInterval > 0 {
+		return uint32((r.packetInterval + r.packetSpace) / r.packetInterval)
+	}
+	return 0
+}
+
+func (r *record) set(id uint16, v []byte) {
+	switch id {
+	case ipfix.IEOctetDeltaCount:
+		r.bytes = uintOf(v)
+	case ipfix.IEPacketDeltaCount:
+		r.packets = uintOf(v)
+	case ipfix.IEProtocolIdentifier:
+		r.protocol = uint8(uintOf(v))
+	case ipfix.IEIPClassOfService:
+		r.tos = uint8(uintOf(v))
+	case ipfix.IETCPControlBits:
+		r.tcpFlags = uint8(uintOf(v))
+	case ipfix.IESourceTransportPort:
+		r.srcPort = uint16(uintOf(v))
+	case ipfix.IEDestinationTransportPort:
+		r.dstPort = uint16(uintOf(v))
+	case ipfix.IESourceIPv4Address, ipfix.IESourceIPv6Address:
+		r.srcIP = net.IP(v)
+	case ipfix.IEDestinationIPv4Address, ipfix.IEDestinationIPv6Address:
+		r.dstIP = net.IP(v)
+	case ipfix.IEIngressInterface:
+		r.input = uint32(uintOf(v))
+	case ipfix.IEEgressInterface:
+		r.output = uint32(uintOf(v))
+	case ipfix.IEVLANID:
+		r.vlanID = uint16(uintOf(v))
+	case ipfix.IEIPVersion:
+		r.ipVersion = uint8(uintOf(v))
+	case ipfix.IESamplingInterval, ipfix.IESamplerRandomInterval:
+		r.sampling = uintOf(v)
+	case ipfix.IESamplingPacketInterval:
+		r.packetInterval = uintOf(v)
+	case ipfix.IESamplingPacketSpace:
+		r.packetSpace = uintOf(v)
+	case ipfix.IEFlowStartSysUpTime:
+		r.startUptime = uint32(uintOf(v))
+		r.hasUptime = true
+	case ipfix.IEFlowEndSysUpTime:
+		r.endUptime = uint32(uintOf(v))
+		r.hasUptime = true
+	case ipfix.IEFlowStartSeconds:
+		r.firstSeen = time.Unix(int64(uintOf(v)), 0)
+	case ipfix.IEFlowEndSeconds:
+		r.lastSeen = time.Unix(int64(uintOf(v)), 0)
+	case ipfix.IEFlowStartMilliseconds:
+		r.firstSeen = time.UnixMilli(int64(uintOf(v)))
+	case ipfix.IEFlowEndMilliseconds:
+		r.lastSeen = time.UnixMilli(int64(uintOf(v)))
+	}
+}
+
+// uintOf 解析任意长度（不超过 8 字节）的无符号整数，exporter 可能使用缩减长度编码
+func uintOf(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// decode 按模板解析一条数据记录，返回记录和占用的长度
+func (t *template) decode(data []byte) (record, int, bool) {
+	var r record
+	offset := 0
+	for _, f := range t.fields {
+		length := int(f.length)
+		if f.length == ipfix.VariableLength {
+			// IPFIX 变长字段：长度小于 255 时占 1 字节，否则为 255 加上 2 字节的长度
+			if offset >= len(data) {
+				return r, 0, false
+			}
+			length = int(data[offset])
+			offset++
+			if length == 255 {
+				if offset+2 > len(data) {
+					return r, 0, false
+				}
+				length = int(binary.BigEndian.Uint16(data[offset:]))
+				offset += 2
+			}
+		}
+		if offset+length > len(data) {
+			return r, 0, false
+		}
+		if f.enterprise == 0 {
+			r.set(f.id, data[offset:offset+length])
+		}
+		offset += length
+	}
+	return r, offset, true
+}
+
+// parseFields 解析模板中的 count 个字段，ipfix 为 true 时字段编号的最高位表示后面带有企业编号
+func parseFields(data []byte, count int, ipfix bool) ([]fieldSpec, int, error) {
+	fields := make([]fieldSpec, 0, count)
+	offset := 0
+	for i := 0; i < count; i++ {
+		if offset+4 > len(data) {
+			return nil, 0, errShortPacket
+		}
+		f := fieldSpec{
+			id:     binary.BigEndian.Uint16(data[offset:]),
+			length: binary.BigEndian.Uint16(data[offset+2:]),
+		}
+		offset += 4
+		if ipfix && f.id&0x8000 != 0 {
+			if offset+4 > len(data) {
+				return nil, 0, errShortPacket
+			}
+			f.id &= 0x7fff
+			f.enterprise = binary.BigEndian.Uint32(data[offset:])
+			offset += 4
+		}
+		fields = append(fields, f)
+	}
+	return fields, offset, nil
+}
+
+// eachSet 遍历 v9 的 flowset 或 IPFIX 的 set，两者的头部格式相同
+func eachSet(data []byte, f func(id uint16, body []byte) error) error {
+	for len(data) >= 4 {
+		id := binary.BigEndian.Uint16(data)
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if length < 4 || length > len(data) {
+			return fmt.Errorf("invalid set length (%d)", length)
+		}
+		if err := f(id, data[4:length]); err != nil {
+			return err
+		}
+		data = data[length:]
+	}
+	return nil
+}
+
+// exportContext 为报文头中用于换算时间的信息
+type exportContext struct {
+	exporter   string
+	domain     *domain
+	now        time.Time // 接收报文的时间
+	exportTime time.Time
+	boot       time.Time // 设备启动时间，IPFIX 中没有
+}
+
+// setTemplate 缓存收到的模板，模板数量达到 maxTemplatesPerDomain 时忽略新的模板 ID
+func (c exportContext) setTemplate(id uint16, t *template) error {
+	if _, ok := c.domain.templates[id]; !ok && len(c.domain.templates) >= maxTemplatesPerDomain {
+		return fmt.Errorf("too many templates (%d), ignore template %d", maxTemplatesPerDomain, id)
+	}
+	t.updated = c.now
+	c.domain.templates[id] = t
+	return nil
+}
+
+// decodeData 按模板解析数据 set，模板未收到时跳过
+func (d *Decoder) decodeData(c exportContext, id uint16, body []byte, flows []Flow) []Flow {
+	t := c.domain.templates[id]
+	if t == nil {
+		return flows
+	}
+	min := t.minLength()
+	if min == 0 {
+		return flows
+	}
+	for len(body) >= min {
+		r, n, ok := t.decode(body)
+		if !ok {
+			break
+		}
+		body = body[n:]
+		if t.options {
+			if rate := r.samplingRate(); rate > 0 {
+				c.domain.sampling = rate
+			}
+			continue
+		}
+		if r.hasUptime && !c.boot.IsZero() {
+			r.firstSeen = c.boot.Add(time.Duration(r.startUptime) * time.Millisecond)
+			r.lastSeen = c.boot.Add(time.Duration(r.endUptime) * time.Millisecond)
+		}
+		if r.lastSeen.IsZero() {
+			r.lastSeen = c.exportTime
+		}
+		if r.firstSeen.IsZero() {
+			r.firstSeen = r.lastSeen
+		}
+		flows = append(flows, d.flow(c.exporter, r, c.domain.sampling))
+	}
+	return flows
+}
+
+const v9HeaderLength = 20
+
+func (d *Decoder) decodeV9(exporter string, data []byte) ([]Flow, error) {
+	if len(data) < v9HeaderLength {
+		return nil, errShortPacket
+	}
+	sysUptime := binary.BigEndian.Uint32(data[4:])
+	exportTime := time.Unix(int64(binary.BigEndian.Uint32(data[8:])), 0)
+	now := d.now()
+	c := exportContext{
+		exporter:   exporter,
+		domain:     d.domain(domainKey{exporter: exporter, domain: binary.BigEndian.Uint32(data[16:])}, now),
+		now:        now,
+		exportTime: exportTime,
+		boot:       exportTime.Add(-time.Duration(sysUptime) * time.Millisecond),
+	}
+	var flows []Flow
+	err := eachSet(data[v9HeaderLength:], func(id uint16, body []byte) error {
+		switch {
+		case id == 0:
+			return v9Templates(c, body)
+		case id == 1:
+			return v9OptionsTemplates(c, body)
+		case id >= 256:
+			flows = d.decodeData(c, id, body, flows)
+		}
+		return nil
+	})
+	return flows, err
+}
+
+func v9Templates(c exportContext, body []byte) error {
+	for len(body) >= 4 {
+		id := binary.BigEndian.Uint16(body)
+		count := int(binary.BigEndian.Uint16(body[2:]))
+		fields, n, err := parseFields(body[4:], count, false)
+		if err != nil {
+			return err
+		}
+		if err := c.setTemplate(id, &template{fields: fields}); err != nil {
+			return err
+		}
+		body = body[4+n:]
+	}
+	return nil
+}
+
+func v9OptionsTemplates(c exportContext, body []byte) error {
+	// 末尾可能有填充，不足一个模板头时结束
+	for len(body) >= 6 {
+		id := binary.BigEndian.Uint16(body)
+		scopeLength := int(binary.BigEndian.Uint16(body[2:]))
+		optionLength := int(binary.BigEndian.Uint16(body[4:]))
+		if id < 256 {
+			return nil
+		}
+		fields, n, err := parseFields(body[6:], (scopeLength+optionLength)/4, false)
+		if err != nil {
+			return err
+		}
+		if err := c.setTemplate(id, &template{fields: fields, options: true}); err != nil {
+			return err
+		}
+		body = body[6+n:]
+	}
+	return nil
+}
+
+const ipfixHeaderLength = 16
+
+func (d *Decoder) decodeIPFIX(exporter string, data []byte) ([]Flow, error) {
+	if len(data) < ipfixHeaderLength {
+		return nil, errShortPacket
+	}
+	length := int(binary.BigEndian.Uint16(data[2:]))
+	if length < ipfixHeaderLength || length > len(data) {
+		return nil, fmt.Errorf("invalid message length (%d)", length)
+	}
+	now := d.now()
+	c := exportContext{
+		exporter:   exporter,
+		domain:     d.domain(domainKey{exporter: exporter, domain: binary.BigEndian.Uint32(data[12:])}, now),
+		now:        now,
+		exportTime: time.Unix(int64(binary.BigEndian.Uint32(data[4:])), 0),
+	}
+	var flows []Flow
+	err := eachSet(data[ipfixHeaderLength:length], func(id uint16, body []byte) error {
+		switch {
+		case id == 2:
+			return ipfixTemplates(c, body, false)
+		case id == 3:
+			return ipfixTemplates(c, body, true)
+		case id >= 256:
+			flows = d.decodeData(c, id, body, flows)
+		}
+		return nil
+	})
+	return flows, err
+}
+
+func ipfixTemplates(c exportContext, body []byte, options bool) error {
+	headerLength := 4
+	if options {
+		headerLength = 6
+	}
+	for len(body) >= headerLength {
+		id := binary.BigEndian.Uint16(body)
+		count := int(binary.BigEndian.Uint16(body[2:]))
+		if id < 256 {
+			return nil
+		}
+		// 字段数为 0 表示撤销模板
+		if count == 0 {
+			delete(c.domain.templates, id)
+			body = body[4:]
+			continue
+		}
+		fields, n, err := parseFields(body[headerLength:], count, true)
+		if err != nil {
+			return err
+		}
+		if err := c.setTemplate(id, &template{fields: fields, options: options}); err != nil {
+			return err
+		}
+		body = body[headerLength+n:]
+	}
+	return nil
+}
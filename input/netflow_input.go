@@ -0,0 +1,112 @@
+package input
+
+import (
+	"net"
+
+	"github.com/mitchellh/mapstructure"
+
+	"traffic-statistics/codec"
+	"traffic-statistics/input/netflow"
+	"traffic-statistics/pkg/log"
+	"traffic-statistics/topology"
+)
+
+// maxDatagramSize 为 UDP 报文的最大长度
+const maxDatagramSize = 65535
+
+type netFlowConfig struct {
+	Address     string `mapstructure:"address"`      // 监听的 UDP 地址，默认为 :2055
+	ReadBuffer  int    `mapstructure:"read_buffer"`  // socket 接收缓冲区大小，单位为字节，为 0 则使用系统默认值
+	ChannelSize int    `mapstructure:"channel_size"` // 解析后的流记录等待输出的管道大小，默认为 1024
+	// 大于 0 时使用该采样率换算流量，忽略 exporter 上报的采样率
+	SamplingRate uint32 `mapstructure:"sampling_rate"`
+}
+
+// netFlowInput 接收路由器导出的 NetFlow v5、v9 和 IPFIX 报文，输出与 Packet input 流记录字段相同的事件
+type netFlowInput struct {
+	conn    *net.UDPConn
+	decoder codec.Decoder
+	flows   chan netflow.Flow
+	done    chan struct{}
+}
+
+func init() {
+	register("NetFlow", newNetFlowInput)
+}
+
+func newNetFlowInput(config map[interface{}]interface{}) topology.InputWorker {
+	c := netFlowConfig{
+		Address:     ":2055",
+		ChannelSize: 1024,
+	}
+	if err := mapstructure.Decode(config, &c); err != nil {
+		log.Fatalw("decode netflow config failed", "error", err)
+	}
+	addr, err := net.ResolveUDPAddr("udp", c.Address)
+	if err != nil {
+		log.Fatalw("invalid address in netflow config", "address", c.Address, "error", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		log.Fatalw("listen netflow address failed", "address", c.Address, "error", err)
+	}
+	if c.ReadBuffer > 0 {
+		if err := conn.SetReadBuffer(c.ReadBuffer); err != nil {
+			log.Warnw("set netflow read buffer failed", "error", err)
+		}
+	}
+	p := &netFlowInput{
+		conn:    conn,
+		decoder: codec.NewDecoder("json_tag"),
+		flows:   make(chan netflow.Flow, c.ChannelSize),
+		done:    make(chan struct{}),
+	}
+	go p.receive(netflow.NewDecoder(c.SamplingRate))
+	return p
+}
+
+// receive 读取并解析 UDP 报文，模板缓存在 decoder 中，只在该 goroutine 中使用
+func (p *netFlowInput) receive(decoder *netflow.Decoder) {
+	defer close(p.flows)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-p.done:
+			default:
+				log.Errorw("read netflow packet failed", "error", err)
+			}
+			return
+		}
+		// exporter 的源端口可能变化，只使用 IP 区分 exporter
+		flows, err := decoder.Decode(addr.IP.String(), buf[:n])
+		if err != nil {
+			log.Warnw("decode netflow packet failed", "exporter", addr.String(), "error", err)
+		}
+		for _, f := range flows {
+			select {
+			case p.flows <- f:
+			case <-p.done:
+				return
+			}
+		}
+	}
+}
+
+func (p *netFlowInput) ReadOneEvent() map[string]interface{} {
+	select {
+	case <-p.done:
+		return nil
+	case f, ok := <-p.flows:
+		if !ok {
+			return nil
+		}
+		return p.decoder.Decode(&f)
+	}
+}
+
+func (p *netFlowInput) Shutdown() {
+	close(p.done)
+	p.conn.Close()
+}
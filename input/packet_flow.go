@@ -0,0 +1,86 @@
+package input
+
+import (
+	"fmt"
+	"time"
+
+	"traffic-statistics/input/flow"
+)
+
+// flowExpireInterval 为检查流是否超时的间隔
+const flowExpireInterval = time.Second
+
+type flowConfig struct {
+	// 开启后 Packet input 输出流记录而不是每个数据包一条数据，需要开启上传模块
+	Enabled       bool   `mapstructure:"enabled"`
+	ActiveTimeout string `mapstructure:"active_timeout"` // 流持续超过该时间后输出一条记录，默认为 1m
+	IdleTimeout   string `mapstructure:"idle_timeout"`   // 流超过该时间没有数据包后结束，默认为 15s
+	CloseTimeout  string `mapstructure:"close_timeout"`  // TCP 流 FIN 或 RST 之后等待该时间结束，默认为 2s
+	MaxFlows      int    `mapstructure:"max_flows"`      // 流表中流的最大数量，超过时提前输出最久没有数据包的流，默认为 65536
+	// 统计 TCP 握手时延、重传、乱序、零窗口和 RST，建议同时开启 handler 的 preserve_order
+	TCPMetrics bool `mapstructure:"tcp_metrics"`
+}
+
+func (c flowConfig) options() (flow.Options, error) {
+	o := flow.Options{
+		ActiveTimeout: time.Minute,
+		IdleTimeout:   15 * time.Second,
+		CloseTimeout:  2 * time.Second,
+		MaxFlows:      65536,
+		TCPMetrics:    c.TCPMetrics,
+	}
+	for _, v := range []struct {
+		name  string
+		value string
+		d     *time.Duration
+	}{
+		{"active_timeout", c.ActiveTimeout, &o.ActiveTimeout},
+		{"idle_timeout", c.IdleTimeout, &o.IdleTimeout},
+		{"close_timeout", c.CloseTimeout, &o.CloseTimeout},
+	} {
+		if v.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v.value)
+		if err != nil || d <= 0 {
+			return o, fmt.Errorf("invalid %s (%s)", v.name, v.value)
+		}
+		*v.d = d
+	}
+	if c.MaxFlows < 0 {
+		return o, fmt.Errorf("invalid max_flows (%d)", c.MaxFlows)
+	}
+	if c.MaxFlows > 0 {
+		o.MaxFlows = c.MaxFlows
+	}
+	return o, nil
+}
+
+// emitFlow 将流记录交给 ReadOneEvent，只在 trackFlows 所在的 goroutine 中调用
+func (p *packetInput) emitFlow(r flow.Record) {
+	select {
+	case p.flowRecords <- r:
+	case <-p.done:
+	}
+}
+
+// trackFlows 将上传模块的数据计入流表，数据读取结束后输出所有流并关闭 flowRecords
+func (p *packetInput) trackFlows() {
+	defer close(p.flowRecords)
+	ticker := time.NewTicker(flowExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.flows.Expire()
+		case msg, ok := <-p.netData:
+			if !ok {
+				p.flows.Flush()
+				return
+			}
+			p.flows.Add(msg)
+		}
+	}
+}
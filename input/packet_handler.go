@@ -15,8 +15,11 @@ import (
 type PacketHandler struct {
 	fileToHandle chan string // 上传方式为文件的时候使用
 	packet       chan netdata.NetData
+	stats        chan map[string]interface{} // 抓包统计事件
 
 	UploadSource string
+	// 数据包解析为 NetData 的选项，抓包模块和上传模块共用
+	DecodeOptions netdata.Options
 
 	IDGenerater id.IDGenerater
 }
@@ -28,6 +31,8 @@ const (
 	uploadSourceLivePacket = "live_packet"
 )
 
+const statsChannelSize = 16
+
 func newPacketHandler(c packetHandlerConfig, uploadSource string, enableUpload bool) (*PacketHandler, error) {
 	idFile := c.IDFile
 	if idFile == "" {
@@ -45,6 +50,7 @@ func newPacketHandler(c packetHandlerConfig, uploadSource string, enableUpload b
 	f := PacketHandler{
 		UploadSource: uploadSource,
 		IDGenerater:  id.BuildIDGenerater(idFile, d),
+		stats:        make(chan map[string]interface{}, statsChannelSize),
 	}
 	if uploadSource == uploadSourceFile {
 		f.fileToHandle = make(chan string, c.ChannelSize)
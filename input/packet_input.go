@@ -1,9 +1,14 @@
 package input
 
 import (
+	"fmt"
+	"sync"
+
 	"github.com/mitchellh/mapstructure"
 
 	"traffic-statistics/codec"
+	"traffic-statistics/input/flow"
+	"traffic-statistics/input/netdata"
 	"traffic-statistics/pkg/log"
 	"traffic-statistics/topology"
 )
@@ -15,6 +20,10 @@ type livePacketChannel struct {
 type packetHandlerConfig struct {
 	// 上传方式为文件或者实时数据包时，用于将捕获到的信息上传到输出端的管道的大小
 	ChannelSize int32 `mapstructure:"channel_size"`
+	// 实时数据包解析为 NetData 的 goroutine 数量，默认为 1
+	Workers int `mapstructure:"workers"`
+	// 为 true 时同一设备的数据包由同一个 goroutine 解析，保证同一设备的数据顺序
+	PreserveOrder bool `mapstructure:"preserve_order"`
 
 	IDFile        string `mapstructure:"id_file,omitemtpy"`
 	FlushInterval string `mapstructure:"flush_interval,omitemtpy"`
@@ -25,14 +34,38 @@ type outputFile struct {
 	PcapDir         string `mapstructure:"pcap_dir"`
 }
 
+// deviceConfig 为单个设备的抓包配置，未配置的项使用 capture 下的全局配置
+type deviceConfig struct {
+	BPF                string `mapstructure:"bpf"`
+	SnapshotLen        *int32 `mapstructure:"snapshot_len"`
+	Promiscuous        *bool  `mapstructure:"promiscuous"`
+	BufferSize         *int   `mapstructure:"buffer_size"`
+	ImmediateMode      *bool  `mapstructure:"immediate_mode"`
+	TimestampPrecision string `mapstructure:"timestamp_precision"`
+	Timeout            string `mapstructure:"timeout"`
+}
+
 type captureConfig struct {
-	Enabled     bool       `mapstructure:"enabled"`
-	DeviceType  string     `mapstructure:"device_type"`
-	Device      []string   `mapstructure:"device"`
-	SnapshotLen int32      `mapstructure:"snapshot_len"`
-	Promiscuous bool       `mapstructure:"promiscuous"`
-	Output      string     `mapstructure:"output"`
-	OutputFile  outputFile `mapstructure:"output_file"`
+	Enabled    bool   `mapstructure:"enabled"`
+	DeviceType string `mapstructure:"device_type"`
+	// 设备名支持 glob 通配符，以 regex: 开头时按正则表达式匹配
+	Device []string `mapstructure:"device"`
+	// 重新扫描设备的间隔，新出现的设备开始抓包，消失的设备停止抓包，为空则只在启动时扫描一次
+	RescanInterval string `mapstructure:"rescan_interval"`
+	SnapshotLen    int32  `mapstructure:"snapshot_len"`
+	Promiscuous    bool   `mapstructure:"promiscuous"`
+	BufferSize     int    `mapstructure:"buffer_size"` // 内核缓冲区大小，单位为字节，为 0 则使用 libpcap 默认值
+	// 开启后数据包到达即交给程序处理，不在内核缓冲区攒批
+	ImmediateMode bool `mapstructure:"immediate_mode"`
+	// 时间戳精度，可选 micro 或 nano，默认为 micro
+	TimestampPrecision string `mapstructure:"timestamp_precision"`
+	// 读取数据包的超时时间，为空则一直阻塞直到有数据包
+	Timeout      string                  `mapstructure:"timeout"`
+	BPF          string                  `mapstructure:"bpf"` // 全局 BPF 过滤表达式，为空则不过滤
+	DeviceConfig map[string]deviceConfig `mapstructure:"device_config"`
+	Stats        statsConfig             `mapstructure:"stats"`
+	Output       string                  `mapstructure:"output"`
+	OutputFile   outputFile              `mapstructure:"output_file"`
 }
 
 type uploadConfig struct {
@@ -42,6 +75,13 @@ type uploadConfig struct {
 	CursorType   string                 `mapstructure:"cursor_type,omitemty"`
 	CursorConfig map[string]interface{} `mapstructure:"cursor_config,omitemty"`
 	SavePcapFile bool                   `mapstructure:"save_pcap_file"`
+	// 上传文件时使用的 BPF 过滤表达式，用于让文件回放的结果和实时抓包一致
+	BPF       string            `mapstructure:"bpf"`
+	DeviceBPF map[string]string `mapstructure:"device_bpf"` // 按设备名配置的 BPF 过滤表达式，优先于 bpf
+	// 没有开启抓包模块时持续监听 pcap_dir，上传外部程序写入的新文件，否则只上传启动时已有的文件
+	Follow bool `mapstructure:"follow"`
+	// follow 时文件超过该时间没有变化，或者同一设备出现更新的文件后认为已经写完，默认为 10s
+	QuietPeriod string `mapstructure:"quiet_period"`
 }
 
 type Config struct {
@@ -49,13 +89,32 @@ type Config struct {
 	// Handler为Capture和Upload两者之间传输信息工具
 	Handler packetHandlerConfig `mapstructure:"handler"`
 	Upload  uploadConfig        `mapstructure:"upload"`
+	// 除默认字段外需要输出的 NetData 字段，如 protocol、src_port、dst_port、tcp_flags
+	Fields []string `mapstructure:"fields"`
+	// 需要解封装的隧道类型，可选 vxlan、gre、geneve、ipip，配置后默认输出 tunnel_type、vni、inner_src_ip、inner_dst_ip
+	Decap []string `mapstructure:"decap"`
+	// VXLAN 使用的 UDP 端口，默认为 4789
+	VXLANPorts []uint16 `mapstructure:"vxlan_ports"`
+	// 计算线路长度使用的 MTU，未配置时读取设备的 MTU，读取失败则为 1500
+	MTU       int            `mapstructure:"mtu"`
+	DeviceMTU map[string]int `mapstructure:"device_mtu"` // 按设备名配置的 MTU，优先于 mtu
+	Flow      flowConfig     `mapstructure:"flow"`
 }
 
 type packetInput struct {
-	capturer Capturer
-	uploader uploader
-	decoder  codec.Decoder
-	stop     bool
+	capturer      Capturer
+	uploader      uploader
+	packetHandler *PacketHandler
+	decoder       codec.Decoder
+	netData       chan *netdata.NetData // 上传模块读取到的数据，上传结束后关闭
+	fields        map[string]bool       // 需要输出的 NetData 字段
+	flows         *flow.Table           // 开启流记录时使用，此时只输出流记录
+	flowRecords   chan flow.Record
+	// drained 在 ReadOneEvent 读到上传模块的数据结束（netData 或 flowRecords 关闭）后关闭
+	drained     chan struct{}
+	drainedOnce sync.Once
+	done        chan struct{}
+	stop        bool
 }
 
 func init() {
@@ -63,50 +122,184 @@ func init() {
 }
 
 func newPacketInput(config map[interface{}]interface{}) topology.InputWorker {
-	var c Config
+	c := Config{
+		Upload: uploadConfig{QuietPeriod: "10s"},
+	}
 	if err := mapstructure.Decode(config, &c); err != nil {
 		log.Fatalw("decode packet config failed", "error", err)
 	}
+	decodeOptions := netdata.Options{
+		Decap:      c.Decap,
+		VXLANPorts: c.VXLANPorts,
+		MTU:        c.MTU,
+		DeviceMTU:  c.DeviceMTU,
+	}
+	if err := decodeOptions.Validate(); err != nil {
+		log.Fatalw("invalid decode options in packet config", "error", err)
+	}
+	configuredFields := c.Fields
+	if len(c.Decap) > 0 {
+		configuredFields = append(configuredFields, netdata.TunnelFields...)
+	}
+	fields, err := selectedFields(configuredFields)
+	if err != nil {
+		log.Fatalw("invalid fields in packet config", "error", err)
+	}
 	enableCapture := c.Capture.Enabled
 	enableUpload := c.Upload.Enabled
 	if !enableCapture && !enableUpload {
 		log.Fatal("please enable at least one of capture module and capture module")
 	}
+	flowOptions, err := c.Flow.options()
+	if err != nil {
+		log.Fatalw("invalid flow config", "error", err)
+	}
+	if c.Flow.Enabled && !enableUpload {
+		log.Fatal("flow requires the upload module to be enabled")
+	}
 	packetHandler, err := newPacketHandler(c.Handler, c.Upload.UploadSource, enableUpload)
 	if err != nil {
 		log.Fatalw("new file handler error", "error", err)
 	}
+	packetHandler.DecodeOptions = decodeOptions
 	var capturer Capturer
 	var uploader uploader
 	if enableCapture {
-		capturer, err = newCapturer(c.Capture, packetHandler)
+		capturer, err = newCapturer(c.Capture, c.Handler, packetHandler)
 		if err != nil {
 			log.Fatalw("new capturer error", "error", err)
 		}
 		go capturer.Startup()
 	}
 	if enableUpload {
+		if err := validateUploadBPF(c.Upload); err != nil {
+			log.Fatalw("invalid bpf in upload config", "error", err)
+		}
 		uploader = newUploader(c.Upload, packetHandler, enableCapture)
 		go uploader.Startup()
 	}
-	return &packetInput{
-		capturer: capturer,
-		uploader: uploader,
-		decoder:  codec.NewDecoder("json_tag"),
+	var flows *flow.Options
+	if c.Flow.Enabled {
+		flows = &flowOptions
+	}
+	return newPacketInputWith(capturer, uploader, packetHandler, fields, flows)
+}
+
+// newPacketInputWith 使用已经启动的抓包和上传模块创建 packetInput，flows 不为 nil 时输出流记录
+func newPacketInputWith(capturer Capturer, uploader uploader, packetHandler *PacketHandler,
+	fields map[string]bool, flows *flow.Options) *packetInput {
+	p := &packetInput{
+		capturer:      capturer,
+		uploader:      uploader,
+		packetHandler: packetHandler,
+		decoder:       codec.NewDecoder("json_tag"),
+		drained:       make(chan struct{}),
+		done:          make(chan struct{}),
+		fields:        fields,
+	}
+	if uploader == nil {
+		p.setDrained()
+	} else {
+		p.netData = make(chan *netdata.NetData)
+		go p.readNetData()
+	}
+	if flows != nil {
+		p.flows = flow.NewTable(*flows, p.emitFlow)
+		p.flowRecords = make(chan flow.Record)
+		go p.trackFlows()
+	}
+	return p
+}
+
+// readNetData 读取上传模块的数据，使 ReadOneEvent 可以同时等待上传的数据和抓包统计事件
+func (p *packetInput) readNetData() {
+	defer close(p.netData)
+	for {
+		msg := p.uploader.ReadNetData()
+		if msg == nil {
+			return
+		}
+		p.netData <- msg
 	}
 }
 
 func (p *packetInput) ReadOneEvent() map[string]interface{} {
-	if p.uploader == nil {
+	// 开启流记录时上传模块的数据由 trackFlows 读取
+	netData := p.netData
+	if p.flows != nil {
+		netData = nil
+	}
+	select {
+	case <-p.done:
 		return nil
+	case event := <-p.packetHandler.stats:
+		return event
+	case record, ok := <-p.flowRecords:
+		if !ok {
+			p.setDrained()
+			return nil
+		}
+		return p.decoder.Decode(&record)
+	case msg, ok := <-netData:
+		if !ok {
+			p.setDrained()
+			return nil
+		}
+		return netDataEvent(p.decoder, msg, p.fields)
 	}
-	msg := p.uploader.ReadNetData()
-	if msg != nil {
-		return p.decoder.Decode(msg)
+}
+
+// nonIPFields 为非 IP 数据包不受 fields 限制、总是输出的字段
+var nonIPFields = func() map[string]bool {
+	fields := make(map[string]bool, len(netdata.NonIPFields))
+	for _, v := range netdata.NonIPFields {
+		fields[v] = true
+	}
+	return fields
+}()
+
+// netDataEvent 将 NetData 转换为事件，只保留 fields 中的字段，非 IP 数据包总是保留链路层字段
+func netDataEvent(decoder codec.Decoder, msg *netdata.NetData, fields map[string]bool) map[string]interface{} {
+	event := decoder.Decode(msg)
+	nonIP := msg.SrcIP == "" && msg.DstIP == ""
+	for k := range event {
+		if !fields[k] && !(nonIP && nonIPFields[k]) {
+			delete(event, k)
+		}
 	}
-	return nil
+	if nonIP {
+		// 802.3 帧的 ether_type 为 0，编码时会被省略，需要单独输出
+		event["ether_type"] = msg.EtherType
+	}
+	return event
+}
+
+// selectedFields 返回默认字段和配置的字段，配置了 NetData 中不存在的字段时返回错误
+func selectedFields(configured []string) (map[string]bool, error) {
+	all := make(map[string]bool)
+	for _, v := range netdata.FieldNames() {
+		all[v] = true
+	}
+	fields := make(map[string]bool, len(netdata.BaseFields)+len(configured))
+	for _, v := range netdata.BaseFields {
+		fields[v] = true
+	}
+	for _, v := range configured {
+		if !all[v] {
+			return nil, fmt.Errorf("unknown field (%s)", v)
+		}
+		fields[v] = true
+	}
+	return fields, nil
+}
+
+// setDrained 标记上传模块的数据已经全部由 ReadOneEvent 读取
+func (p *packetInput) setDrained() {
+	p.drainedOnce.Do(func() { close(p.drained) })
 }
 
+// Shutdown 先停止抓包和上传，期间 InputBox 继续调用 ReadOneEvent，上传模块剩余的数据和 trackFlows
+// 最后输出的流照常进入 pipeline，ReadOneEvent 读到 channel 关闭后再关闭 done
 func (p *packetInput) Shutdown() {
 	if p.capturer != nil {
 		p.capturer.Stop()
@@ -114,4 +307,6 @@ func (p *packetInput) Shutdown() {
 	if p.uploader != nil {
 		p.uploader.Stop()
 	}
+	<-p.drained
+	close(p.done)
 }
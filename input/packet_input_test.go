@@ -0,0 +1,99 @@
+package input
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"traffic-statistics/input/flow"
+	"traffic-statistics/input/netdata"
+)
+
+// stoppingUploader 在 Stop 时才输出 pending 中的数据，模拟停止时上传的剩余数据
+type stoppingUploader struct {
+	pending []*netdata.NetData
+	data    chan *netdata.NetData
+}
+
+func newStoppingUploader(pending []*netdata.NetData) *stoppingUploader {
+	return &stoppingUploader{pending: pending, data: make(chan *netdata.NetData)}
+}
+
+func (u *stoppingUploader) Startup() {}
+
+func (u *stoppingUploader) Stop() {
+	for _, msg := range u.pending {
+		u.data <- msg
+	}
+	close(u.data)
+}
+
+func (u *stoppingUploader) ReadNetData() *netdata.NetData {
+	return <-u.data
+}
+
+// 每个数据包为一条不同的 UDP 流
+func shutdownTestData(n int) []*netdata.NetData {
+	t0 := time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC)
+	data := make([]*netdata.NetData, n)
+	for i := range data {
+		data[i] = &netdata.NetData{
+			Device: "eth0", CreateTime: t0, SrcIP: "10.0.0.1", DstIP: "10.0.0.2",
+			IPVersion: 4, Protocol: 17, SrcPort: uint16(1000 + i), DstPort: 53, WireBytes: 100,
+		}
+	}
+	return data
+}
+
+// Shutdown 期间上传的数据和最后输出的流仍然由 ReadOneEvent 返回
+func TestPacketInputShutdownDeliversEvents(t *testing.T) {
+	initTestLogger()
+	tests := []struct {
+		name  string
+		flows *flow.Options
+	}{
+		{name: "net data"},
+		{name: "flow", flows: &flow.Options{ActiveTimeout: time.Minute, IdleTimeout: time.Minute, MaxFlows: 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, err := selectedFields([]string{"src_port"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := newPacketInputWith(nil, newStoppingUploader(shutdownTestData(5)), &PacketHandler{}, fields, tt.flows)
+			// 与 InputBox.beat 相同，Shutdown 返回前一直调用 ReadOneEvent
+			var stopped int32
+			events := make(chan map[string]interface{}, 10)
+			readDone := make(chan struct{})
+			go func() {
+				defer close(readDone)
+				for atomic.LoadInt32(&stopped) == 0 {
+					if event := p.ReadOneEvent(); event != nil {
+						events <- event
+					}
+				}
+			}()
+			shutdown := make(chan struct{})
+			go func() {
+				p.Shutdown()
+				atomic.StoreInt32(&stopped, 1)
+				close(shutdown)
+			}()
+			select {
+			case <-shutdown:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Shutdown did not return")
+			}
+			<-readDone
+			close(events)
+			ports := make(map[interface{}]bool)
+			for event := range events {
+				ports[event["src_port"]] = true
+			}
+			if len(ports) != 5 {
+				t.Errorf("got events of %d source ports, want 5: %v", len(ports), ports)
+			}
+		})
+	}
+}
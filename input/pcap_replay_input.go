@@ -0,0 +1,266 @@
+package input
+
+import (
+	"io"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/mitchellh/mapstructure"
+
+	"traffic-statistics/codec"
+	"traffic-statistics/input/netdata"
+	"traffic-statistics/pkg/log"
+	"traffic-statistics/topology"
+)
+
+type pcapReplayConfig struct {
+	// 回放的 pcap 或 pcapng 文件，支持 glob 通配符，按文件名顺序回放
+	Files []string `mapstructure:"files"`
+	// 数据包的设备名，为空时使用 pcapng 中的接口名称，都没有时使用去掉扩展名的文件名
+	Device string `mapstructure:"device"`
+	// 回放速度，为 0 则尽快回放，为 1 则按数据包的原始时间间隔回放，为 2 则以两倍速度回放，以此类推
+	Speed float64 `mapstructure:"speed"`
+	// 所有文件回放结束后从头开始，直到 Shutdown
+	Loop bool `mapstructure:"loop"`
+	// 为 true 时 create_time 使用回放的时间，否则使用数据包的原始时间，
+	// 原始时间早于 SizeRecord 的 timeout 时会被丢弃
+	RewriteTime bool   `mapstructure:"rewrite_time"`
+	BPF         string `mapstructure:"bpf"`
+	ChannelSize int    `mapstructure:"channel_size"`
+	// 以下配置与 Packet input 相同
+	Fields     []string       `mapstructure:"fields"`
+	Decap      []string       `mapstructure:"decap"`
+	VXLANPorts []uint16       `mapstructure:"vxlan_ports"`
+	MTU        int            `mapstructure:"mtu"`
+	DeviceMTU  map[string]int `mapstructure:"device_mtu"`
+}
+
+// pcapReplayInput 回放指定的 pcap 文件，不依赖文件名格式和上传进度，用于压测和回归测试，
+// 回放结束后 ReadOneEvent 返回 nil
+type pcapReplayInput struct {
+	config        pcapReplayConfig
+	decodeOptions netdata.Options
+	fields        map[string]bool
+	decoder       codec.Decoder
+	// 按设备和链路类型区分的 Decoder 和 BPF，只在 replay 所在的 goroutine 中使用
+	decoders map[replayDecoderKey]*netdata.Decoder
+	bpfs     map[layers.LinkType]*pcap.BPF
+	id       uint64
+	netData  chan netdata.NetData
+	done     chan struct{}
+}
+
+type replayDecoderKey struct {
+	device   string
+	linkType layers.LinkType
+}
+
+func init() {
+	register("PcapReplay", newPcapReplayInput)
+}
+
+func newPcapReplayInput(config map[interface{}]interface{}) topology.InputWorker {
+	c := pcapReplayConfig{
+		ChannelSize: 1024,
+	}
+	if err := mapstructure.Decode(config, &c); err != nil {
+		log.Fatalw("decode pcap replay config failed", "error", err)
+	}
+	if c.Speed < 0 {
+		log.Fatalw("invalid speed in pcap replay config", "speed", c.Speed)
+	}
+	decodeOptions := netdata.Options{
+		Decap:      c.Decap,
+		VXLANPorts: c.VXLANPorts,
+		MTU:        c.MTU,
+		DeviceMTU:  c.DeviceMTU,
+	}
+	if err := decodeOptions.Validate(); err != nil {
+		log.Fatalw("invalid decode options in pcap replay config", "error", err)
+	}
+	configuredFields := c.Fields
+	if len(c.Decap) > 0 {
+		configuredFields = append(configuredFields, netdata.TunnelFields...)
+	}
+	fields, err := selectedFields(configuredFields)
+	if err != nil {
+		log.Fatalw("invalid fields in pcap replay config", "error", err)
+	}
+	if c.BPF != "" {
+		if _, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, 65535, c.BPF); err != nil {
+			log.Fatalw("invalid bpf in pcap replay config", "bpf", c.BPF, "error", err)
+		}
+	}
+	p := &pcapReplayInput{
+		config:        c,
+		decodeOptions: decodeOptions,
+		fields:        fields,
+		decoder:       codec.NewDecoder("json_tag"),
+		decoders:      make(map[replayDecoderKey]*netdata.Decoder),
+		bpfs:          make(map[layers.LinkType]*pcap.BPF),
+		netData:       make(chan netdata.NetData, c.ChannelSize),
+		done:          make(chan struct{}),
+	}
+	if len(p.match()) == 0 {
+		log.Fatalw("no file matched in pcap replay config", "files", c.Files)
+	}
+	go p.replay()
+	return p
+}
+
+// match 返回 files 匹配的文件，每个 glob 内按文件名排序，同一个文件只出现一次
+func (p *pcapReplayInput) match() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, pattern := range p.config.Files {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Errorw("invalid file pattern", "pattern", pattern, "error", err)
+			continue
+		}
+		sort.Strings(matches)
+		for _, name := range matches {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func (p *pcapReplayInput) replay() {
+	defer close(p.netData)
+	clock := &replayClock{speed: p.config.Speed}
+	for {
+		names := p.match()
+		if len(names) == 0 {
+			log.Errorw("no file matched, stop replaying", "files", p.config.Files)
+			return
+		}
+		for _, name := range names {
+			if !p.replayFile(name, clock) {
+				return
+			}
+		}
+		if !p.config.Loop {
+			log.Infow("pcap replay complete", "packets", p.id)
+			return
+		}
+	}
+}
+
+// replayFile 回放一个文件，收到 Shutdown 时返回 false
+func (p *pcapReplayInput) replayFile(name string, clock *replayClock) bool {
+	f, err := openReplayFile(name)
+	if err != nil {
+		log.Errorw("open pcap file error", "file", name, "error", err)
+		return true
+	}
+	defer f.Close()
+	log.Infow("start replaying pcap file", "file", name)
+	for {
+		data, ci, err := f.reader.ZeroCopyReadPacketData()
+		if err != nil {
+			if err != io.EOF {
+				log.Errorw("read packet error", "file", name, "error", err)
+			}
+			return true
+		}
+		device, linkType := f.iface(ci)
+		if p.config.Device != "" {
+			device = p.config.Device
+		} else if device == "" {
+			device = f.defaultDevice()
+		}
+		if bpf := p.bpf(linkType); bpf != nil && !bpf.Matches(ci, data) {
+			continue
+		}
+		if !clock.wait(ci.Timestamp, p.done) {
+			return false
+		}
+		if p.config.RewriteTime {
+			ci.Timestamp = time.Now()
+		}
+		p.id++
+		netData := p.decoderOf(device, linkType).Decode(p.id, ci, data)
+		select {
+		case p.netData <- netData:
+		case <-p.done:
+			return false
+		}
+	}
+}
+
+func (p *pcapReplayInput) decoderOf(device string, linkType layers.LinkType) *netdata.Decoder {
+	k := replayDecoderKey{device: device, linkType: linkType}
+	d, ok := p.decoders[k]
+	if !ok {
+		d = netdata.NewDecoder(device, linkType, p.decodeOptions)
+		p.decoders[k] = d
+	}
+	return d
+}
+
+// bpf 返回链路类型对应的 BPF 过滤器，编译失败时不过滤
+func (p *pcapReplayInput) bpf(linkType layers.LinkType) *pcap.BPF {
+	if p.config.BPF == "" {
+		return nil
+	}
+	bpf, ok := p.bpfs[linkType]
+	if !ok {
+		var err error
+		if bpf, err = pcap.NewBPF(linkType, 65535, p.config.BPF); err != nil {
+			log.Errorw("compile bpf error, packets are not filtered", "bpf", p.config.BPF, "link_type", linkType, "error", err)
+		}
+		p.bpfs[linkType] = bpf
+	}
+	return bpf
+}
+
+func (p *pcapReplayInput) ReadOneEvent() map[string]interface{} {
+	select {
+	case <-p.done:
+		return nil
+	case msg, ok := <-p.netData:
+		if !ok {
+			return nil
+		}
+		return netDataEvent(p.decoder, &msg, p.fields)
+	}
+}
+
+func (p *pcapReplayInput) Shutdown() {
+	close(p.done)
+}
+
+// replayClock 按数据包的时间间隔等待，数据包时间回退（下一个文件或者重新开始）时以当前时间重新计时
+type replayClock struct {
+	speed float64
+	start time.Time // 开始计时的实际时间
+	first time.Time // 开始计时的数据包时间
+	last  time.Time
+}
+
+// wait 等待到数据包应该回放的时间，收到 done 时返回 false
+func (c *replayClock) wait(ts time.Time, done chan struct{}) bool {
+	if c.speed == 0 {
+		return true
+	}
+	if c.start.IsZero() || ts.Before(c.last) {
+		c.start, c.first = time.Now(), ts
+	}
+	c.last = ts
+	at := c.start.Add(time.Duration(float64(ts.Sub(c.first)) / c.speed))
+	if d := time.Until(at); d > 0 {
+		select {
+		case <-time.After(d):
+		case <-done:
+			return false
+		}
+	}
+	return true
+}
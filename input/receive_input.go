@@ -0,0 +1,264 @@
+package input
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+
+	"traffic-statistics/pkg/forward"
+	"traffic-statistics/pkg/log"
+	"traffic-statistics/topology"
+)
+
+type receiveConfig struct {
+	Address string            `mapstructure:"address"` // 监听的 TCP 地址，默认为 :7900
+	TLS     forward.TLSConfig `mapstructure:"tls"`
+	// 一个帧和解压后的 batch 的最大长度，单位为字节，默认为 64MB
+	MaxFrameSize int    `mapstructure:"max_frame_size"`
+	IdleTimeout  string `mapstructure:"idle_timeout"` // 超过该时间没有收到数据时关闭连接，默认为 5m
+	// pipeline 阻塞时向发送方发送 progress 帧的间隔，使发送方不会因为等待 ack 超时而重发，
+	// 需要小于发送方的 ack_timeout，默认为 1s
+	ProgressInterval string `mapstructure:"progress_interval"`
+	ChannelSize      int    `mapstructure:"channel_size"`
+}
+
+// receiveInput 接收其他实例的 Forward output 发送的事件，batch 中的事件全部交给 pipeline 后回复 ack，
+// 同一个发送方重连后重发的已确认 batch 只回复 ack，不再输出
+type receiveInput struct {
+	config           receiveConfig
+	listener         net.Listener
+	idleTimeout      time.Duration
+	progressInterval time.Duration
+	events           chan map[string]interface{}
+	done             chan struct{}
+	wg               sync.WaitGroup
+
+	lock    sync.Mutex
+	conns   map[net.Conn]bool
+	senders map[string]*receiveSender
+}
+
+// receiveSender 为一个发送方的状态
+type receiveSender struct {
+	// token 为处理 batch 的权限，容量为 1。发送方重连时旧连接可能还在输出同一个 batch，
+	// 新连接需要等待旧连接处理完，再按 acked 判断是否重复
+	token chan struct{}
+	acked uint64 // 已经确认的最大序号，持有 token 时访问
+}
+
+func init() {
+	register("Receive", newReceiveInput)
+}
+
+func newReceiveInput(config map[interface{}]interface{}) topology.InputWorker {
+	c := receiveConfig{
+		Address:          ":7900",
+		MaxFrameSize:     forward.DefaultMaxFrameSize,
+		IdleTimeout:      "5m",
+		ProgressInterval: "1s",
+		ChannelSize:      1024,
+	}
+	if err := mapstructure.Decode(config, &c); err != nil {
+		log.Fatalw("decode receive config failed", "error", err)
+	}
+	idleTimeout, err := time.ParseDuration(c.IdleTimeout)
+	if err != nil || idleTimeout <= 0 {
+		log.Fatalw("invalid idle_timeout in receive config", "idle_timeout", c.IdleTimeout)
+	}
+	progressInterval, err := time.ParseDuration(c.ProgressInterval)
+	if err != nil || progressInterval <= 0 {
+		log.Fatalw("invalid progress_interval in receive config", "progress_interval", c.ProgressInterval)
+	}
+	if c.MaxFrameSize <= 0 {
+		log.Fatalw("invalid max_frame_size in receive config", "max_frame_size", c.MaxFrameSize)
+	}
+	tlsConfig, err := c.TLS.Server()
+	if err != nil {
+		log.Fatalw("invalid tls in receive config", "error", err)
+	}
+	listener, err := net.Listen("tcp", c.Address)
+	if err != nil {
+		log.Fatalw("listen receive address failed", "address", c.Address, "error", err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	p := &receiveInput{
+		config:           c,
+		listener:         listener,
+		idleTimeout:      idleTimeout,
+		progressInterval: progressInterval,
+		events:           make(chan map[string]interface{}, c.ChannelSize),
+		done:             make(chan struct{}),
+		conns:            make(map[net.Conn]bool),
+		senders:          make(map[string]*receiveSender),
+	}
+	p.wg.Add(1)
+	go p.accept()
+	log.Infow("receive input listening", "address", listener.Addr().String(), "tls", tlsConfig != nil)
+	return p
+}
+
+func (p *receiveInput) accept() {
+	defer p.wg.Done()
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			select {
+			case <-p.done:
+				return
+			default:
+			}
+			log.Errorw("accept forward connection failed", "error", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		p.lock.Lock()
+		p.conns[conn] = true
+		p.lock.Unlock()
+		p.wg.Add(1)
+		go p.serve(conn)
+	}
+}
+
+// serve 处理一个发送方的连接，出错时关闭连接，由发送方重连后重发未确认的 batch
+func (p *receiveInput) serve(conn net.Conn) {
+	defer p.wg.Done()
+	defer func() {
+		p.lock.Lock()
+		delete(p.conns, conn)
+		p.lock.Unlock()
+		conn.Close()
+	}()
+	remote := conn.RemoteAddr().String()
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(p.idleTimeout))
+	frameType, payload, err := forward.ReadFrame(reader, p.config.MaxFrameSize)
+	if err != nil || frameType != forward.FrameHello {
+		log.Warnw("read forward hello failed", "remote", remote, "frame_type", frameType, "error", err)
+		return
+	}
+	id, err := forward.DecodeHello(payload)
+	if err != nil {
+		log.Warnw("invalid forward hello", "remote", remote, "error", err)
+		return
+	}
+	log.Infow("forward sender connected", "remote", remote, "id", id)
+	sender := p.sender(id)
+	for {
+		conn.SetReadDeadline(time.Now().Add(p.idleTimeout))
+		frameType, payload, err := forward.ReadFrame(reader, p.config.MaxFrameSize)
+		if err != nil {
+			select {
+			case <-p.done:
+			default:
+				log.Infow("forward connection closed", "remote", remote, "id", id, "error", err)
+			}
+			return
+		}
+		if frameType != forward.FrameBatch {
+			log.Warnw("unexpected forward frame", "remote", remote, "frame_type", frameType)
+			return
+		}
+		seq, lines, err := forward.DecodeBatch(payload, p.config.MaxFrameSize)
+		if err != nil {
+			log.Warnw("decode forward batch failed", "remote", remote, "error", err)
+			return
+		}
+		if !p.handleBatch(conn, remote, sender, seq, lines) {
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(p.idleTimeout))
+		if err := forward.WriteFrame(conn, forward.FrameAck, forward.EncodeAck(seq)); err != nil {
+			log.Warnw("write forward ack failed", "remote", remote, "error", err)
+			return
+		}
+	}
+}
+
+func (p *receiveInput) sender(id string) *receiveSender {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	s, ok := p.senders[id]
+	if !ok {
+		s = &receiveSender{token: make(chan struct{}, 1)}
+		p.senders[id] = s
+	}
+	return s
+}
+
+// handleBatch 将未确认的 batch 中的事件交给 pipeline，Shutdown 时返回 false。
+// 等待旧连接或者 pipeline 阻塞期间每隔 progress_interval 发送 progress 帧，
+// 发送失败（发送方已经断开）时仍然输出完整个 batch，发送方重连后重发的该 batch 只回复 ack
+func (p *receiveInput) handleBatch(conn net.Conn, remote string, s *receiveSender, seq uint64, lines [][]byte) bool {
+	ticker := time.NewTicker(p.progressInterval)
+	defer ticker.Stop()
+	disconnected := false
+	progress := func() {
+		if disconnected {
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(p.idleTimeout))
+		if err := forward.WriteFrame(conn, forward.FrameProgress, forward.EncodeAck(seq)); err != nil {
+			log.Warnw("write forward progress failed", "remote", remote, "seq", seq, "error", err)
+			disconnected = true
+		}
+	}
+	for acquired := false; !acquired; {
+		select {
+		case s.token <- struct{}{}:
+			acquired = true
+		case <-p.done:
+			return false
+		case <-ticker.C:
+			progress()
+		}
+	}
+	defer func() { <-s.token }()
+	if seq <= s.acked {
+		return true
+	}
+	for _, line := range lines {
+		event, err := decodeEvent(line)
+		if err != nil {
+			log.Warnw("decode forward event failed", "remote", remote, "error", err)
+			continue
+		}
+		for sent := false; !sent; {
+			select {
+			case p.events <- event:
+				sent = true
+			case <-p.done:
+				return false
+			case <-ticker.C:
+				progress()
+			}
+		}
+	}
+	s.acked = seq
+	return true
+}
+
+func (p *receiveInput) ReadOneEvent() map[string]interface{} {
+	select {
+	case <-p.done:
+		return nil
+	case event := <-p.events:
+		return event
+	}
+}
+
+func (p *receiveInput) Shutdown() {
+	close(p.done)
+	p.listener.Close()
+	p.lock.Lock()
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.lock.Unlock()
+	p.wg.Wait()
+}
@@ -0,0 +1,114 @@
+package input
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"traffic-statistics/output"
+	"traffic-statistics/pkg/forward"
+)
+
+// ackDroppingProxy 转发 Forward output 和 Receive input 之间的连接，第一个 ack 不转发并断开连接，
+// 模拟接收方已经输出 batch 但 ack 丢失，发送方需要重连并重发
+type ackDroppingProxy struct {
+	listener net.Listener
+	target   string
+	dropped  int32
+	conns    int32
+}
+
+func newAckDroppingProxy(t *testing.T, target string) *ackDroppingProxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &ackDroppingProxy{listener: listener, target: target}
+	t.Cleanup(func() { listener.Close() })
+	go p.accept()
+	return p
+}
+
+func (p *ackDroppingProxy) accept() {
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&p.conns, 1)
+		go p.serve(client)
+	}
+}
+
+func (p *ackDroppingProxy) serve(client net.Conn) {
+	defer client.Close()
+	server, err := net.Dial("tcp", p.target)
+	if err != nil {
+		return
+	}
+	defer server.Close()
+	go func() {
+		io.Copy(server, client)
+		server.Close()
+	}()
+	reader := bufio.NewReader(server)
+	for {
+		frameType, payload, err := forward.ReadFrame(reader, forward.DefaultMaxFrameSize)
+		if err != nil {
+			return
+		}
+		if frameType == forward.FrameAck && atomic.CompareAndSwapInt32(&p.dropped, 0, 1) {
+			return
+		}
+		if err := forward.WriteFrame(client, frameType, payload); err != nil {
+			return
+		}
+	}
+}
+
+func TestForwardToReceive(t *testing.T) {
+	initTestLogger()
+	p := newReceiveInput(map[interface{}]interface{}{
+		"address":           "127.0.0.1:0",
+		"progress_interval": "50ms",
+	}).(*receiveInput)
+	defer p.Shutdown()
+	proxy := newAckDroppingProxy(t, p.listener.Addr().String())
+
+	out := output.BuildOutput("Forward", map[interface{}]interface{}{
+		"addr":           proxy.listener.Addr().String(),
+		"batch_size":     10,
+		"flush_interval": "10ms",
+		"ack_timeout":    "5s",
+		"min_backoff":    "10ms",
+		"max_backoff":    "50ms",
+	}).OutputWorker
+	// 每个 batch 解压后超过 4KB
+	data := strings.Repeat("x", 1000)
+	const n = 30
+	for i := 0; i < n; i++ {
+		out.Emit(map[string]interface{}{"n": i, "data": data})
+	}
+	for i := 0; i < n; i++ {
+		event := readEventWithTimeout(t, p)
+		if fmt.Sprint(event["n"]) != fmt.Sprint(i) || event["data"] != data {
+			t.Fatalf("event %d = %.60v", i, event)
+		}
+	}
+	// Shutdown 等待所有 batch 被确认，重发的 batch 在回复 ack 前已经处理，不能再次输出
+	out.Shutdown()
+	select {
+	case event := <-p.events:
+		t.Errorf("duplicate event %.60v", event)
+	default:
+	}
+	if atomic.LoadInt32(&proxy.dropped) != 1 || atomic.LoadInt32(&proxy.conns) < 2 {
+		t.Errorf("dropped %d acks in %d connections, want a reconnect after the dropped ack",
+			atomic.LoadInt32(&proxy.dropped), atomic.LoadInt32(&proxy.conns))
+	}
+}
@@ -0,0 +1,75 @@
+package input
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapngMagic 为 pcapng 文件第一个块（section header）的类型
+const pcapngMagic = 0x0a0d0d0a
+
+// replayFile 为一个回放的 pcap 或 pcapng 文件，pcapng 中每个接口有自己的名称和链路类型
+type replayFile struct {
+	name     string
+	file     *os.File
+	reader   gopacket.ZeroCopyPacketDataSource
+	ng       *pcapgo.NgReader
+	linkType layers.LinkType
+}
+
+func openReplayFile(name string) (*replayFile, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	f := &replayFile{name: name, file: file}
+	r := bufio.NewReader(file)
+	magic, err := r.Peek(4)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(magic) == pcapngMagic {
+		ng, err := pcapgo.NewNgReader(r, pcapgo.NgReaderOptions{WantMixedLinkType: true, SkipUnknownVersion: true})
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		f.reader, f.ng, f.linkType = ng, ng, ng.LinkType()
+		return f, nil
+	}
+	pr, err := pcapgo.NewReader(r)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f.reader, f.linkType = pr, pr.LinkType()
+	return f, nil
+}
+
+// iface 返回数据包所在接口的名称和链路类型，只有 pcapng 中有接口名称
+func (f *replayFile) iface(ci gopacket.CaptureInfo) (string, layers.LinkType) {
+	if f.ng != nil {
+		if i, err := f.ng.Interface(ci.InterfaceIndex); err == nil {
+			return i.Name, i.LinkType
+		}
+	}
+	return "", f.linkType
+}
+
+// defaultDevice 为没有配置设备名、pcapng 中也没有接口名称时使用的设备名，即去掉扩展名的文件名
+func (f *replayFile) defaultDevice() string {
+	base := filepath.Base(f.name)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+func (f *replayFile) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,198 @@
+package sflow
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"traffic-statistics/input/netdata"
+)
+
+// CounterRecordType 为接口计数器事件的 type 字段
+const CounterRecordType = "interface_counters"
+
+// ethernetFCSLength 为以太网帧校验序列的长度，sFlow 的帧长度包含 FCS，抓包得到的长度不包含
+const ethernetFCSLength = 4
+
+// FlowSample 为一个采样的数据包，NetData 按数据包头部解析，wire_bytes 为采样前的帧长度，
+// 统计时需要乘以 SamplingRate
+type FlowSample struct {
+	NetData         netdata.NetData
+	Agent           string
+	SamplingRate    uint32
+	InputInterface  uint32
+	OutputInterface uint32
+}
+
+// InterfaceCounters 为 counter sample 中的通用接口计数器，字段含义与 IF-MIB 相同
+type InterfaceCounters struct {
+	Type       string    `json:"type"`
+	Device     string    `json:"device"` // agent 的地址和接口的 ifIndex，如 10.0.0.1:3
+	CreateTime time.Time `json:"create_time"`
+	Agent      string    `json:"agent"`
+
+	IfIndex     uint32 `json:"if_index"`
+	IfType      uint32 `json:"if_type"`
+	IfSpeed     uint64 `json:"if_speed"`
+	IfDirection uint32 `json:"if_direction"` // 0 为未知，1 为全双工，2 为半双工，3 为入方向，4 为出方向
+	IfStatus    uint32 `json:"if_status"`    // 第 0 位为管理状态，第 1 位为运行状态
+
+	InOctets         uint64 `json:"in_octets"`
+	InUcastPkts      uint32 `json:"in_ucast_pkts"`
+	InMulticastPkts  uint32 `json:"in_multicast_pkts"`
+	InBroadcastPkts  uint32 `json:"in_broadcast_pkts"`
+	InDiscards       uint32 `json:"in_discards"`
+	InErrors         uint32 `json:"in_errors"`
+	InUnknownProtos  uint32 `json:"in_unknown_protos"`
+	OutOctets        uint64 `json:"out_octets"`
+	OutUcastPkts     uint32 `json:"out_ucast_pkts"`
+	OutMulticastPkts uint32 `json:"out_multicast_pkts"`
+	OutBroadcastPkts uint32 `json:"out_broadcast_pkts"`
+	OutDiscards      uint32 `json:"out_discards"`
+	OutErrors        uint32 `json:"out_errors"`
+}
+
+// Datagram 为一个 sFlow v5 报文中的采样
+type Datagram struct {
+	Flows    []FlowSample
+	Counters []InterfaceCounters
+}
+
+// Decoder 解析 sFlow v5 报文，按 agent 和数据包头部的链路类型缓存 netdata.Decoder，
+// 与 netdata.Decoder 一样不能在多个 goroutine 中同时使用
+type Decoder struct {
+	packets map[packetDecoderKey]*netdata.Decoder
+}
+
+type packetDecoderKey struct {
+	agent    string
+	linkType layers.LinkType
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{packets: make(map[packetDecoderKey]*netdata.Decoder)}
+}
+
+// packetDecoder 返回解析 agent 采样的数据包头部的 Decoder，agent 不是本机的设备，
+// 指定 MTU 避免读取本机网卡，线路长度使用采样前的帧长度，MTU 不影响结果
+func (d *Decoder) packetDecoder(agent string, linkType layers.LinkType) *netdata.Decoder {
+	k := packetDecoderKey{agent: agent, linkType: linkType}
+	decoder, ok := d.packets[k]
+	if !ok {
+		decoder = netdata.NewDecoder(agent, linkType, netdata.Options{MTU: netdata.DefaultMTU})
+		d.packets[k] = decoder
+	}
+	return decoder
+}
+
+// Decode 解析一个 sFlow v5 报文，sFlow 中没有采样的时间，使用接收时间 now
+func (d *Decoder) Decode(data []byte, now time.Time) (result Datagram, err error) {
+	// gopacket 解析 sFlow 时没有完整检查长度，格式错误的报文会导致 panic
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed sflow datagram: %v", r)
+		}
+	}()
+	if len(data) < 4 || data[3] != 5 {
+		return result, fmt.Errorf("unsupported sflow datagram")
+	}
+	var datagram layers.SFlowDatagram
+	if err := datagram.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		return result, err
+	}
+	agent := datagram.AgentAddress.String()
+	for _, s := range datagram.FlowSamples {
+		result.Flows = append(result.Flows, d.flowSamples(agent, s, now)...)
+	}
+	for _, s := range datagram.CounterSamples {
+		for _, r := range s.Records {
+			if c, ok := r.(layers.SFlowGenericInterfaceCounters); ok {
+				result.Counters = append(result.Counters, interfaceCounters(agent, c, now))
+			}
+		}
+	}
+	return result, nil
+}
+
+// flowSamples 解析 flow sample 中的原始数据包头部
+func (d *Decoder) flowSamples(agent string, s layers.SFlowFlowSample, now time.Time) []FlowSample {
+	rate := s.SamplingRate
+	if rate == 0 {
+		rate = 1
+	}
+	// 非扩展格式的接口编号高 2 位为格式
+	input, output := s.InputInterface&0x3fffffff, s.OutputInterface&0x3fffffff
+	device := fmt.Sprintf("%s:%d", agent, input)
+	var samples []FlowSample
+	for _, r := range s.Records {
+		raw, ok := r.(layers.SFlowRawPacketFlowRecord)
+		if !ok || raw.Header == nil {
+			continue
+		}
+		header := raw.Header.Data()
+		if int(raw.HeaderLength) < len(header) {
+			header = header[:raw.HeaderLength]
+		}
+		frameLength := int(raw.FrameLength)
+		var linkType layers.LinkType
+		switch raw.HeaderProtocol {
+		case layers.SFlowProtoEthernet:
+			linkType = layers.LinkTypeEthernet
+			if frameLength > ethernetFCSLength {
+				frameLength -= ethernetFCSLength
+			}
+		case layers.SFlowProtoIPv4, layers.SFlowProtoIPv6:
+			// 原始 IP 链路按 IP 版本号选择解析的第一层
+			linkType = layers.LinkTypeRaw
+		default:
+			continue
+		}
+		ci := gopacket.CaptureInfo{
+			Timestamp:     now,
+			CaptureLength: len(header),
+			Length:        frameLength,
+		}
+		n := d.packetDecoder(agent, linkType).Decode(0, ci, header)
+		n.Device = device
+		// 头部被截断，按采样前的帧长度统计
+		n.WireBytes = int32(frameLength)
+		n.PackSize = n.WireBytes
+		samples = append(samples, FlowSample{
+			NetData:         n,
+			Agent:           agent,
+			SamplingRate:    rate,
+			InputInterface:  input,
+			OutputInterface: output,
+		})
+	}
+	return samples
+}
+
+func interfaceCounters(agent string, c layers.SFlowGenericInterfaceCounters, now time.Time) InterfaceCounters {
+	return InterfaceCounters{
+		Type:             CounterRecordType,
+		Device:           fmt.Sprintf("%s:%d", agent, c.IfIndex),
+		CreateTime:       now,
+		Agent:            agent,
+		IfIndex:          c.IfIndex,
+		IfType:           c.IfType,
+		IfSpeed:          c.IfSpeed,
+		IfDirection:      c.IfDirection,
+		IfStatus:         c.IfStatus,
+		InOctets:         c.IfInOctets,
+		InUcastPkts:      c.IfInUcastPkts,
+		InMulticastPkts:  c.IfInMulticastPkts,
+		InBroadcastPkts:  c.IfInBroadcastPkts,
+		InDiscards:       c.IfInDiscards,
+		InErrors:         c.IfInErrors,
+		InUnknownProtos:  c.IfInUnknownProtos,
+		OutOctets:        c.IfOutOctets,
+		OutUcastPkts:     c.IfOutUcastPkts,
+		OutMulticastPkts: c.IfOutMulticastPkts,
+		OutBroadcastPkts: c.IfOutBroadcastPkts,
+		OutDiscards:      c.IfOutDiscards,
+		OutErrors:        c.IfOutErrors,
+	}
+}
@@ -0,0 +1,140 @@
+package input
+
+import (
+	"net"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+
+	"traffic-statistics/codec"
+	"traffic-statistics/input/sflow"
+	"traffic-statistics/pkg/log"
+	"traffic-statistics/topology"
+)
+
+type sFlowConfig struct {
+	Address     string `mapstructure:"address"`      // 监听的 UDP 地址，默认为 :6343
+	ReadBuffer  int    `mapstructure:"read_buffer"`  // socket 接收缓冲区大小，单位为字节，为 0 则使用系统默认值
+	ChannelSize int    `mapstructure:"channel_size"` // 解析后的事件等待输出的管道大小，默认为 1024
+	// 除默认字段外需要输出的 NetData 字段，与 Packet input 的 fields 相同
+	Fields []string `mapstructure:"fields"`
+}
+
+// sFlowInput 接收交换机发送的 sFlow v5 报文，flow sample 输出为 NetData 事件并带有采样率，
+// counter sample 输出为接口计数器事件
+type sFlowInput struct {
+	conn    *net.UDPConn
+	sflow   *sflow.Decoder // 只在 receive 所在的 goroutine 中使用
+	decoder codec.Decoder
+	fields  map[string]bool
+	events  chan map[string]interface{}
+	done    chan struct{}
+}
+
+func init() {
+	register("SFlow", newSFlowInput)
+}
+
+func newSFlowInput(config map[interface{}]interface{}) topology.InputWorker {
+	c := sFlowConfig{
+		Address:     ":6343",
+		ChannelSize: 1024,
+	}
+	if err := mapstructure.Decode(config, &c); err != nil {
+		log.Fatalw("decode sflow config failed", "error", err)
+	}
+	fields, err := selectedFields(c.Fields)
+	if err != nil {
+		log.Fatalw("invalid fields in sflow config", "error", err)
+	}
+	addr, err := net.ResolveUDPAddr("udp", c.Address)
+	if err != nil {
+		log.Fatalw("invalid address in sflow config", "address", c.Address, "error", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		log.Fatalw("listen sflow address failed", "address", c.Address, "error", err)
+	}
+	if c.ReadBuffer > 0 {
+		if err := conn.SetReadBuffer(c.ReadBuffer); err != nil {
+			log.Warnw("set sflow read buffer failed", "error", err)
+		}
+	}
+	p := &sFlowInput{
+		conn:    conn,
+		sflow:   sflow.NewDecoder(),
+		decoder: codec.NewDecoder("json_tag"),
+		fields:  fields,
+		events:  make(chan map[string]interface{}, c.ChannelSize),
+		done:    make(chan struct{}),
+	}
+	go p.receive()
+	return p
+}
+
+func (p *sFlowInput) receive() {
+	defer close(p.events)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-p.done:
+			default:
+				log.Errorw("read sflow packet failed", "error", err)
+			}
+			return
+		}
+		datagram, err := p.sflow.Decode(buf[:n], time.Now())
+		if err != nil {
+			log.Warnw("decode sflow packet failed", "agent", addr.String(), "error", err)
+			continue
+		}
+		for i := range datagram.Flows {
+			if !p.send(p.flowEvent(&datagram.Flows[i])) {
+				return
+			}
+		}
+		for i := range datagram.Counters {
+			if !p.send(p.decoder.Decode(&datagram.Counters[i])) {
+				return
+			}
+		}
+	}
+}
+
+// flowEvent 输出配置的 NetData 字段，以及采样率和接口，SizeRecord 按 sampling_rate 换算流量
+func (p *sFlowInput) flowEvent(s *sflow.FlowSample) map[string]interface{} {
+	event := netDataEvent(p.decoder, &s.NetData, p.fields)
+	event["agent"] = s.Agent
+	event["sampling_rate"] = s.SamplingRate
+	event["input_interface"] = s.InputInterface
+	event["output_interface"] = s.OutputInterface
+	return event
+}
+
+func (p *sFlowInput) send(event map[string]interface{}) bool {
+	select {
+	case p.events <- event:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+func (p *sFlowInput) ReadOneEvent() map[string]interface{} {
+	select {
+	case <-p.done:
+		return nil
+	case event, ok := <-p.events:
+		if !ok {
+			return nil
+		}
+		return event
+	}
+}
+
+func (p *sFlowInput) Shutdown() {
+	close(p.done)
+	p.conn.Close()
+}
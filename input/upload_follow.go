@@ -0,0 +1,281 @@
+package input
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"traffic-statistics/input/netdata"
+	"traffic-statistics/pkg/log"
+)
+
+// fileUploaderFollow 在没有抓包模块时持续监听 pcap_dir，由外部程序（如 tcpdump）写入的新文件写完后上传，
+// 同一设备的文件按第一个数据包的时间依次上传
+type fileUploaderFollow struct {
+	lock         sync.Mutex
+	baseUploader *fileUploader
+	quietPeriod  time.Duration
+
+	watcher *fsnotify.Watcher
+	cancel  func()
+	stopped chan struct{}
+	wg      sync.WaitGroup // watch 和每个设备的上传 goroutine
+
+	// pending 为还没有写完的文件，queued 为已经交给上传 goroutine 的文件，只在 watch 中使用，
+	// 文件被删除或重命名后从两者中删除并清除上传进度，之后以同一文件名创建的文件会重新上传
+	pending map[string]*pendingFile
+	queued  map[string]bool
+	devices map[string]chan string
+	// replaced 为上传期间被删除或者重新创建的文件，由 watch 清除上传完成时写入的进度
+	replaced chan string
+}
+
+// pendingFile 记录文件最后一次变化的时间和大小，超过 quietPeriod 没有变化时认为已经写完
+type pendingFile struct {
+	device     string
+	size       int64
+	lastChange time.Time
+	first      time.Time // 第一个数据包的时间，用于排序
+}
+
+func newFileUploaderFollow(u *fileUploader, quietPeriod time.Duration) *fileUploaderFollow {
+	stopped := make(chan struct{})
+	u.stopped = stopped
+	return &fileUploaderFollow{
+		baseUploader: u,
+		quietPeriod:  quietPeriod,
+		stopped:      stopped,
+		pending:      make(map[string]*pendingFile),
+		queued:       make(map[string]bool),
+		devices:      make(map[string]chan string),
+		replaced:     make(chan string, 64),
+	}
+}
+
+func (u *fileUploaderFollow) Startup() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Fatalw("create pcap dir watcher error", "error", err)
+	}
+	if err := watcher.Add(u.baseUploader.PcapDir); err != nil {
+		log.Fatalw("watch pcap dir error", "dir", u.baseUploader.PcapDir, "error", err)
+	}
+	u.watcher = watcher
+	if err := u.baseUploader.PacketHandler.IDGenerater.Start(); err != nil {
+		log.Errorw("start id generator error", "error", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	u.baseUploader.ctx = ctx
+	u.cancel = cancel
+	// 启动前已经存在的文件也需要等待写完，可能仍在被写入
+	files, err := os.ReadDir(u.baseUploader.PcapDir)
+	if err != nil {
+		log.Errorw("read pcap dir", "dir", u.baseUploader.PcapDir, "error", err)
+	}
+	now := time.Now()
+	for _, file := range files {
+		if !file.IsDir() {
+			u.changed(filepath.Join(u.baseUploader.PcapDir, file.Name()), now)
+		}
+	}
+	u.wg.Add(1)
+	go u.watch(ctx)
+	log.Infow("watching pcap dir for new files", "dir", u.baseUploader.PcapDir)
+}
+
+func (u *fileUploaderFollow) watch(ctx context.Context) {
+	defer u.wg.Done()
+	ticker := time.NewTicker(u.quietPeriod / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-u.watcher.Events:
+			if !ok {
+				return
+			}
+			switch {
+			case event.Op&(fsnotify.Create|fsnotify.Write) != 0:
+				u.changed(event.Name, time.Now())
+			case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+				u.forget(event.Name)
+			}
+		case name := <-u.replaced:
+			u.forget(name)
+			if _, err := os.Stat(name); err == nil {
+				u.changed(name, time.Now())
+			}
+		case err, ok := <-u.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorw("watch pcap dir error", "error", err)
+		case now := <-ticker.C:
+			u.queueCompleted(ctx, now)
+		}
+	}
+}
+
+// changed 记录文件的变化，已经上传或者正在上传的文件忽略
+func (u *fileUploaderFollow) changed(name string, now time.Time) {
+	if !strings.HasSuffix(name, ".pcap") || u.queued[name] {
+		return
+	}
+	if p, ok := u.pending[name]; ok {
+		p.lastChange = now
+		return
+	}
+	_, filename := filepath.Split(name)
+	uploaded, err := u.baseUploader.PcapCursor.IsFileUploaded(filename)
+	if err != nil {
+		log.Errorw("check completed status error", "file", filename, "error", err)
+		return
+	}
+	if uploaded {
+		u.queued[name] = true
+		return
+	}
+	device, err := u.baseUploader.PacketHandler.deviceByFileName(name)
+	if err != nil {
+		log.Errorw("wrong file name", "file", name)
+		return
+	}
+	u.pending[name] = &pendingFile{device: device, size: -1, lastChange: now}
+}
+
+// forget 在文件被删除或重命名后删除文件的状态和上传进度
+func (u *fileUploaderFollow) forget(name string) {
+	delete(u.pending, name)
+	delete(u.queued, name)
+	if !strings.HasSuffix(name, ".pcap") {
+		return
+	}
+	_, filename := filepath.Split(name)
+	if err := u.baseUploader.PcapCursor.ResetFile(filename); err != nil {
+		log.Errorw("reset upload progress error", "file", filename, "error", err)
+	}
+}
+
+// queueCompleted 将写完的文件按设备和第一个数据包的时间依次交给上传 goroutine，
+// 文件超过 quietPeriod 没有变化，或者同一设备已经有更新的文件时认为已经写完
+func (u *fileUploaderFollow) queueCompleted(ctx context.Context, now time.Time) {
+	latest := make(map[string]time.Time) // 每个设备最新的文件的第一个数据包时间
+	for name, p := range u.pending {
+		info, err := os.Stat(name)
+		if err != nil {
+			delete(u.pending, name)
+			continue
+		}
+		if info.Size() != p.size {
+			p.size, p.lastChange = info.Size(), now
+		}
+		if p.first.IsZero() {
+			p.first = firstPacketTime(name)
+		}
+		if p.first.After(latest[p.device]) {
+			latest[p.device] = p.first
+		}
+	}
+	var completed []string
+	for name, p := range u.pending {
+		if p.first.IsZero() && now.Sub(p.lastChange) < u.quietPeriod {
+			continue // 还没有写入完整的文件头和第一个数据包
+		}
+		if now.Sub(p.lastChange) >= u.quietPeriod || p.first.Before(latest[p.device]) {
+			completed = append(completed, name)
+		}
+	}
+	sort.Slice(completed, func(i, j int) bool {
+		a, b := u.pending[completed[i]], u.pending[completed[j]]
+		if !a.first.Equal(b.first) {
+			return a.first.Before(b.first)
+		}
+		return completed[i] < completed[j]
+	})
+	for _, name := range completed {
+		device := u.pending[name].device
+		delete(u.pending, name)
+		u.queued[name] = true
+		files, ok := u.devices[device]
+		if !ok {
+			files = make(chan string, 64)
+			u.devices[device] = files
+			u.wg.Add(1)
+			go u.uploadByDevice(ctx, files)
+		}
+		select {
+		case files <- name:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// uploadByDevice 依次上传一个设备的文件
+func (u *fileUploaderFollow) uploadByDevice(ctx context.Context, files chan string) {
+	defer u.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case file := <-files:
+			before, err := os.Stat(file)
+			u.baseUploader.wg.Add(1)
+			u.baseUploader.uploadFile(file)
+			// 上传期间文件被删除或者重新创建时，上传完成时写入的进度属于旧的文件，需要清除
+			if after, statErr := os.Stat(file); err != nil || statErr != nil || !os.SameFile(before, after) {
+				select {
+				case u.replaced <- file:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
+
+// firstPacketTime 返回文件中第一个数据包的时间，文件还没有数据包时返回零值
+func firstPacketTime(name string) time.Time {
+	f, err := openReplayFile(name)
+	if err != nil {
+		return time.Time{}
+	}
+	defer f.Close()
+	_, ci, err := f.reader.ZeroCopyReadPacketData()
+	if err != nil {
+		return time.Time{}
+	}
+	return ci.Timestamp
+}
+
+func (u *fileUploaderFollow) Stop() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.watcher == nil {
+		return
+	}
+	close(u.stopped)
+	u.cancel()
+	u.watcher.Close()
+	u.wg.Wait()
+	u.watcher = nil
+	u.baseUploader.Stop()
+	close(u.baseUploader.message)
+}
+
+func (u *fileUploaderFollow) ReadNetData() *netdata.NetData {
+	msg, ok := <-u.baseUploader.message
+	if ok {
+		return &msg
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package input
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"traffic-statistics/cursor"
+	"traffic-statistics/id"
+	"traffic-statistics/input/netdata"
+)
+
+// writeUDPPcap 写入 pcap 文件，每个源端口为一个 UDP 数据包
+func writeUDPPcap(t *testing.T, name string, srcPorts ...uint16) {
+	t.Helper()
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	for i, port := range srcPorts {
+		eth := &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+			DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP,
+			SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 2)}
+		udp := &layers.UDP{SrcPort: layers.UDPPort(port), DstPort: 53}
+		udp.SetNetworkLayerForChecksum(ip)
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload(make([]byte, 10))); err != nil {
+			t.Fatal(err)
+		}
+		ci := gopacket.CaptureInfo{
+			Timestamp:     time.Unix(1622534400+int64(i), 0),
+			CaptureLength: len(buf.Bytes()),
+			Length:        len(buf.Bytes()),
+		}
+		if err := w.WritePacket(ci, buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// expectUploaded 依次读取上传的数据并检查源端口
+func expectUploaded(t *testing.T, u uploader, srcPorts ...uint16) {
+	t.Helper()
+	for _, port := range srcPorts {
+		data := make(chan *netdata.NetData, 1)
+		go func() {
+			data <- u.ReadNetData()
+		}()
+		select {
+		case n := <-data:
+			if n == nil || n.SrcPort != port {
+				t.Fatalf("uploaded %+v, want src_port %d", n, port)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for src_port %d", port)
+		}
+	}
+}
+
+func TestFileUploaderFollowRecreatedFile(t *testing.T) {
+	initTestLogger()
+	dir := t.TempDir()
+	pcapDir := filepath.Join(dir, "pcap")
+	if err := os.Mkdir(pcapDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	u := newFileUploaderFollow(&fileUploader{
+		PacketHandler: &PacketHandler{IDGenerater: id.BuildIDGenerater(filepath.Join(dir, "id.bin"), time.Second)},
+		message:       make(chan netdata.NetData),
+		PcapCursor: cursor.BuildPcapCursor(cursor.FileType, map[string]interface{}{
+			"file":           filepath.Join(dir, "cursor.json"),
+			"flush_interval": "1s",
+		}),
+		PcapDir: pcapDir,
+	}, 100*time.Millisecond)
+	u.Startup()
+	t.Cleanup(u.Stop)
+
+	name := filepath.Join(pcapDir, "eth0-1.pcap")
+	writeUDPPcap(t, name, 1000, 1001)
+	expectUploaded(t, u, 1000, 1001)
+
+	// 删除后以同一文件名重新创建，新的文件从头上传
+	time.Sleep(200 * time.Millisecond)
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	writeUDPPcap(t, name, 2000)
+	expectUploaded(t, u, 2000)
+}
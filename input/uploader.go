@@ -2,12 +2,13 @@ package input
 
 import (
 	"context"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/google/gopacket"
 	"github.com/google/gopacket/pcap"
 
 	"traffic-statistics/cursor"
@@ -36,6 +37,13 @@ func newUploader(c uploadConfig, packetHandler *PacketHandler, enableCapture boo
 				baseUploader: u,
 			}
 		}
+		if c.Follow {
+			quietPeriod, err := time.ParseDuration(c.QuietPeriod)
+			if err != nil || quietPeriod <= 0 {
+				log.Fatalw("invalid quiet_period in upload config", "quiet_period", c.QuietPeriod)
+			}
+			return newFileUploaderFollow(u, quietPeriod)
+		}
 		return &fileUploaderWithoutCapture{
 			baseUploader: u,
 		}
@@ -62,6 +70,8 @@ type fileUploader struct {
 	ctx          context.Context
 
 	message chan netdata.NetData
+	// stopped 关闭后正在上传的文件停止上传，文件不会被标记为已上传，为 nil 时一直上传到文件结束
+	stopped <-chan struct{}
 }
 
 func (u *fileUploader) Startup() {
@@ -267,9 +277,13 @@ func (u *fileUploader) uploadFile(file string) {
 		log.Errorw("wrong file name", "file", file)
 		return
 	}
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	packetSource.DecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true,
-		DecodeStreamsAsDatagrams: true}
+	if expr := bpfOfDevice(device, u.Config.BPF, u.Config.DeviceBPF); expr != "" {
+		if err := handle.SetBPFFilter(expr); err != nil {
+			log.Errorw("set bpf filter error", "file", file, "bpf", expr, "error", err)
+			return
+		}
+	}
+	decoder := netdata.NewDecoder(device, handle.LinkType(), u.PacketHandler.DecodeOptions)
 	_, filename := filepath.Split(file)
 	countUploadedBefore, err := u.PcapCursor.UploadedRecordCount(filename)
 	if err != nil {
@@ -279,12 +293,24 @@ func (u *fileUploader) uploadFile(file string) {
 	var uploadedCount = 0
 	var firstIndex, lastIndex = countUploadedBefore + 1, countUploadedBefore
 	var index int64
-	for packet := range packetSource.Packets() {
+	for {
+		data, ci, err := handle.ZeroCopyReadPacketData()
+		if err != nil {
+			if err != io.EOF {
+				log.Errorw("read packet error", "file", file, "error", err)
+			}
+			break
+		}
 		index++
 		if index >= firstIndex {
-			netData := netdata.NetDataFromPacket(device, u.PacketHandler.IDGenerater.GenerateID(), packet)
+			netData := decoder.Decode(u.PacketHandler.IDGenerater.GenerateID(), ci, data)
 			if netData.ID != 0 {
-				u.message <- netData
+				select {
+				case u.message <- netData:
+				case <-u.stopped:
+					log.Infow("file upload stopped", "file", file, "from", firstIndex, "to", lastIndex)
+					return
+				}
 			}
 			if err := u.PcapCursor.AddOneUploadedRecord(filename); err != nil {
 				log.Errorw("add one uploaded record error", "error", err)
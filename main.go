@@ -24,7 +24,6 @@ var exitWhenNil = flag.Bool("exit-when-nil", false, "triger gohangout to exit wh
 var mainThreadExitChan chan struct{} = make(chan struct{}, 0)
 
 func main() {
-	runtime.GOMAXPROCS(1)              // 限制 CPU 使用数，避免过载
 	runtime.SetMutexProfileFraction(1) // 开启对锁调用的跟踪
 	runtime.SetBlockProfileRate(1)     // 开启对阻塞操作的跟踪
 	go func() {
@@ -41,11 +40,12 @@ func main() {
 		msg := fmt.Sprintf("load config file error: (%v)", err)
 		panic(msg)
 	}
-	// if v, ok := config["go_max_procs"]; ok {
-	// if procs, ok := v.(int); ok {
-	// runtime.GOMAXPROCS(procs)
-	// }
-	// }
+	// 通过 go_max_procs 限制 CPU 使用数，避免过载，未配置时使用全部 CPU
+	if v, ok := config["go_max_procs"]; ok {
+		if procs, ok := v.(int); ok {
+			runtime.GOMAXPROCS(procs)
+		}
+	}
 
 	log.NewLogger(config)
 
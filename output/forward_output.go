@@ -0,0 +1,380 @@
+package output
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+
+	"traffic-statistics/pkg/forward"
+	"traffic-statistics/pkg/log"
+	"traffic-statistics/topology"
+)
+
+func init() {
+	register("Forward", newForwardOutput)
+}
+
+type forwardConfig struct {
+	Addr string            `mapstructure:"addr"` // Receive input 的地址
+	TLS  forward.TLSConfig `mapstructure:"tls"`
+	// 每个 batch 最多的事件数，默认为 500，未满的 batch 最多等待 flush_interval，默认为 1s
+	BatchSize     int    `mapstructure:"batch_size"`
+	FlushInterval string `mapstructure:"flush_interval"`
+	// 断开连接或者等待 ack 时在内存中缓存的最多事件数，默认为 100000，超过时丢弃最早的 batch
+	BufferSize      int    `mapstructure:"buffer_size"`
+	AckTimeout      string `mapstructure:"ack_timeout"`      // 等待 ack 的时间，超时后重新连接并重发，收到 progress 帧后重新计时，默认为 10s
+	MinBackoff      string `mapstructure:"min_backoff"`      // 重新连接的最短间隔，默认为 1s，每次失败后加倍
+	MaxBackoff      string `mapstructure:"max_backoff"`      // 重新连接的最长间隔，默认为 30s
+	ShutdownTimeout string `mapstructure:"shutdown_timeout"` // Shutdown 时等待缓存的事件发送完成的时间，默认为 10s
+	ChannelSize     int    `mapstructure:"channel_size"`
+}
+
+// forwardOutput 将事件分批压缩后通过 TCP（可选双向 TLS）发送给其他实例的 Receive input，
+// 收到 ack 后才从缓存中删除，断开连接时按指数退避重新连接并重发未确认的 batch
+type forwardOutput struct {
+	config          forwardConfig
+	tlsConfig       *tls.Config
+	id              string
+	flushInterval   time.Duration
+	ackTimeout      time.Duration
+	minBackoff      time.Duration
+	maxBackoff      time.Duration
+	shutdownTimeout time.Duration
+	queue           *forwardQueue
+	events          chan []byte
+	done            chan struct{}
+	abort           chan struct{} // Shutdown 超时后放弃发送缓存的事件
+	batcherWG       sync.WaitGroup
+	senderWG        sync.WaitGroup
+}
+
+func newForwardOutput(config map[interface{}]interface{}) topology.OutputWorker {
+	c := forwardConfig{
+		BatchSize:       500,
+		FlushInterval:   "1s",
+		BufferSize:      100000,
+		AckTimeout:      "10s",
+		MinBackoff:      "1s",
+		MaxBackoff:      "30s",
+		ShutdownTimeout: "10s",
+		ChannelSize:     1024,
+	}
+	if err := mapstructure.Decode(config, &c); err != nil {
+		log.Fatalw("decode forward config failed", "error", err)
+	}
+	if c.Addr == "" {
+		log.Fatal("addr is required in forward config")
+	}
+	if c.BatchSize <= 0 || c.BufferSize < c.BatchSize {
+		log.Fatalw("invalid batch_size or buffer_size in forward config", "batch_size", c.BatchSize, "buffer_size", c.BufferSize)
+	}
+	durations := make(map[string]time.Duration, 5)
+	for name, v := range map[string]string{
+		"flush_interval":   c.FlushInterval,
+		"ack_timeout":      c.AckTimeout,
+		"min_backoff":      c.MinBackoff,
+		"max_backoff":      c.MaxBackoff,
+		"shutdown_timeout": c.ShutdownTimeout,
+	} {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalw("invalid duration in forward config", "option", name, "value", v)
+		}
+		durations[name] = d
+	}
+	tlsConfig, err := c.TLS.Client()
+	if err != nil {
+		log.Fatalw("invalid tls in forward config", "error", err)
+	}
+	if tlsConfig != nil && tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(c.Addr)
+		if err != nil {
+			log.Fatalw("invalid addr in forward config", "addr", c.Addr, "error", err)
+		}
+		tlsConfig.ServerName = host
+	}
+	hostname, _ := os.Hostname()
+	o := &forwardOutput{
+		config:    c,
+		tlsConfig: tlsConfig,
+		// 接收方按 ID 和序号去重，每次启动序号从 1 开始，ID 需要不同
+		id:              fmt.Sprintf("%s/%d/%d", hostname, os.Getpid(), time.Now().UnixNano()),
+		flushInterval:   durations["flush_interval"],
+		ackTimeout:      durations["ack_timeout"],
+		minBackoff:      durations["min_backoff"],
+		maxBackoff:      durations["max_backoff"],
+		shutdownTimeout: durations["shutdown_timeout"],
+		queue:           newForwardQueue(c.BufferSize),
+		events:          make(chan []byte, c.ChannelSize),
+		done:            make(chan struct{}),
+		abort:           make(chan struct{}),
+	}
+	o.batcherWG.Add(1)
+	go o.batch()
+	o.senderWG.Add(1)
+	go o.send()
+	return o
+}
+
+func (o *forwardOutput) Emit(event map[string]interface{}) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Errorw("encode forward event failed", "error", err)
+		return
+	}
+	select {
+	case o.events <- data:
+	case <-o.done:
+	}
+}
+
+// batch 将事件按 batch_size 和 flush_interval 分批放入缓存
+func (o *forwardOutput) batch() {
+	defer o.batcherWG.Done()
+	defer o.queue.close()
+	ticker := time.NewTicker(o.flushInterval)
+	defer ticker.Stop()
+	var events [][]byte
+	flush := func() {
+		if len(events) > 0 {
+			o.queue.push(events)
+			events = nil
+		}
+	}
+	for {
+		select {
+		case e := <-o.events:
+			events = append(events, e)
+			if len(events) >= o.config.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-o.done:
+			for len(o.events) > 0 {
+				events = append(events, <-o.events)
+				if len(events) >= o.config.BatchSize {
+					flush()
+				}
+			}
+			flush()
+			return
+		}
+	}
+}
+
+// send 依次发送缓存中的 batch，收到 ack 后删除，失败时关闭连接，按退避时间重新连接后重发
+func (o *forwardOutput) send() {
+	defer o.senderWG.Done()
+	var (
+		conn    net.Conn
+		reader  *bufio.Reader
+		backoff = o.minBackoff
+	)
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		b, ok := o.queue.peek()
+		if !ok {
+			return
+		}
+		if conn == nil {
+			var err error
+			if conn, err = o.dial(); err != nil {
+				log.Errorw("connect forward receiver failed", "addr", o.config.Addr, "retry_after", backoff, "error", err)
+				select {
+				case <-time.After(backoff):
+				case <-o.abort:
+					return
+				}
+				if backoff *= 2; backoff > o.maxBackoff {
+					backoff = o.maxBackoff
+				}
+				continue
+			}
+			log.Infow("forward receiver connected", "addr", o.config.Addr)
+			reader = bufio.NewReader(conn)
+			backoff = o.minBackoff
+		}
+		if err := o.sendBatch(conn, reader, b); err != nil {
+			log.Errorw("forward batch failed, reconnect", "addr", o.config.Addr, "events", len(b.events), "error", err)
+			conn.Close()
+			conn = nil
+			continue
+		}
+		o.queue.pop(b.seq)
+	}
+}
+
+func (o *forwardOutput) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: o.ackTimeout, KeepAlive: 30 * time.Second}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if o.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", o.config.Addr, o.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", o.config.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetWriteDeadline(time.Now().Add(o.ackTimeout))
+	if err := forward.WriteFrame(conn, forward.FrameHello, forward.EncodeHello(o.id)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// sendBatch 发送一个 batch 并等待对应的 ack，接收方的 pipeline 阻塞时会定期发送 progress 帧，
+// 收到该 batch 的 progress 时延长等待时间，避免重发接收方正在处理的 batch
+func (o *forwardOutput) sendBatch(conn net.Conn, reader *bufio.Reader, b *forwardBatch) error {
+	if b.payload == nil {
+		payload, err := forward.EncodeBatch(b.seq, b.events)
+		if err != nil {
+			return err
+		}
+		b.payload = payload
+	}
+	conn.SetDeadline(time.Now().Add(o.ackTimeout))
+	if err := forward.WriteFrame(conn, forward.FrameBatch, b.payload); err != nil {
+		return err
+	}
+	for {
+		frameType, payload, err := forward.ReadFrame(reader, forward.DefaultMaxFrameSize)
+		if err != nil {
+			return err
+		}
+		if frameType != forward.FrameAck && frameType != forward.FrameProgress {
+			return fmt.Errorf("unexpected frame type %d", frameType)
+		}
+		seq, err := forward.DecodeAck(payload)
+		if err != nil {
+			return err
+		}
+		if frameType == forward.FrameProgress {
+			if seq == b.seq {
+				conn.SetReadDeadline(time.Now().Add(o.ackTimeout))
+			}
+			continue
+		}
+		// 之前超时重发的 batch 的 ack 可能晚到，忽略
+		if seq >= b.seq {
+			return nil
+		}
+	}
+}
+
+func (o *forwardOutput) Shutdown() {
+	close(o.done)
+	o.batcherWG.Wait()
+	finished := make(chan struct{})
+	go func() {
+		o.senderWG.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(o.shutdownTimeout):
+		log.Warnw("forward shutdown timeout, drop buffered events", "events", o.queue.size())
+		o.queue.discard()
+		close(o.abort)
+		<-finished
+	}
+}
+
+// forwardBatch 为一个等待发送的 batch，payload 为压缩后的数据，第一次发送时生成
+type forwardBatch struct {
+	seq     uint64
+	events  [][]byte
+	payload []byte
+}
+
+// forwardQueue 为等待发送和等待 ack 的 batch，事件数超过 max 时丢弃最早的 batch
+type forwardQueue struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	batches []*forwardBatch
+	events  int
+	max     int
+	seq     uint64
+	closed  bool
+}
+
+func newForwardQueue(max int) *forwardQueue {
+	q := &forwardQueue{max: max}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+func (q *forwardQueue) push(events [][]byte) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.seq++
+	q.batches = append(q.batches, &forwardBatch{seq: q.seq, events: events})
+	q.events += len(events)
+	dropped := 0
+	for q.events > q.max && len(q.batches) > 1 {
+		q.events -= len(q.batches[0].events)
+		dropped += len(q.batches[0].events)
+		q.batches = q.batches[1:]
+	}
+	if dropped > 0 {
+		log.Warnw("forward buffer is full, drop oldest events", "events", dropped)
+	}
+	q.cond.Signal()
+}
+
+// peek 返回最早的 batch，没有 batch 时等待，缓存关闭并且为空时返回 false
+func (q *forwardQueue) peek() (*forwardBatch, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for len(q.batches) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.batches) == 0 {
+		return nil, false
+	}
+	return q.batches[0], true
+}
+
+// pop 删除已经确认的 batch，发送期间该 batch 可能已经因为缓存满而被丢弃
+func (q *forwardQueue) pop(seq uint64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.batches) > 0 && q.batches[0].seq == seq {
+		q.events -= len(q.batches[0].events)
+		q.batches = q.batches[1:]
+	}
+}
+
+func (q *forwardQueue) size() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.events
+}
+
+func (q *forwardQueue) discard() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.batches, q.events = nil, 0
+}
+
+func (q *forwardQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
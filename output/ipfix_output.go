@@ -0,0 +1,449 @@
+package output
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+
+	"traffic-statistics/pkg/ipfix"
+	"traffic-statistics/pkg/log"
+	"traffic-statistics/topology"
+)
+
+func init() {
+	register("IPFIX", newIPFIXOutput)
+}
+
+const (
+	ipfixProtocolUDP  = "udp"
+	ipfixProtocolTCP  = "tcp"
+	ipfixProtocolFile = "file"
+
+	// IPv4 和 IPv6 流记录使用的模板编号
+	ipfixTemplateIPv4 = ipfix.MinDataSetID
+	ipfixTemplateIPv6 = ipfix.MinDataSetID + 1
+)
+
+type ipfixConfig struct {
+	Protocol string `mapstructure:"protocol"` // 可选 udp、tcp、file，默认为 udp
+	Addr     string `mapstructure:"addr"`     // collector 的地址，protocol 为 udp 或 tcp 时使用
+	// protocol 为 file 时写入的目录，每隔 new_file_interval 创建一个新的 .ipfix 文件，默认为 1h
+	FileDir         string `mapstructure:"file_dir"`
+	NewFileInterval string `mapstructure:"new_file_interval"`
+	DomainID        uint32 `mapstructure:"observation_domain_id"`
+	// UDP 不保证 collector 收到模板，每隔该时间重新发送一次，默认为 1m，tcp 和 file 只在连接建立和新文件开始时发送
+	TemplateRefresh string `mapstructure:"template_refresh"`
+	FlushInterval   string `mapstructure:"flush_interval"` // 未满一个消息的记录最多等待的时间，默认为 1s
+	// 一个消息的最大长度，UDP 默认为 1400 以避免 IP 分片，其他默认为 65535
+	MaxMessageSize int `mapstructure:"max_message_size"`
+	ChannelSize    int `mapstructure:"channel_size"`
+}
+
+// ipfixTemplates 为输出使用的模板，IPv4 和 IPv6 只有地址字段不同
+var ipfixTemplates = []ipfix.Template{
+	{ID: ipfixTemplateIPv4, Fields: ipfixFields(ipfix.IESourceIPv4Address, ipfix.IEDestinationIPv4Address, net.IPv4len)},
+	{ID: ipfixTemplateIPv6, Fields: ipfixFields(ipfix.IESourceIPv6Address, ipfix.IEDestinationIPv6Address, net.IPv6len)},
+}
+
+func ipfixFields(srcIP, dstIP uint16, ipLength uint16) []ipfix.Field {
+	return []ipfix.Field{
+		{ID: ipfix.IEFlowStartMilliseconds, Length: 8},
+		{ID: ipfix.IEFlowEndMilliseconds, Length: 8},
+		{ID: srcIP, Length: ipLength},
+		{ID: dstIP, Length: ipLength},
+		{ID: ipfix.IESourceTransportPort, Length: 2},
+		{ID: ipfix.IEDestinationTransportPort, Length: 2},
+		{ID: ipfix.IEProtocolIdentifier, Length: 1},
+		{ID: ipfix.IETCPControlBits, Length: 2},
+		{ID: ipfix.IEIPClassOfService, Length: 1},
+		{ID: ipfix.IEVLANID, Length: 2},
+		{ID: ipfix.IEIngressInterface, Length: 4},
+		{ID: ipfix.IEEgressInterface, Length: 4},
+		{ID: ipfix.IEOctetDeltaCount, Length: 8},
+		{ID: ipfix.IEPacketDeltaCount, Length: 8},
+	}
+}
+
+// ipfixRecord 为一条单向的流记录，字段顺序与 ipfixFields 相同
+type ipfixRecord struct {
+	start, end       time.Time
+	srcIP, dstIP     net.IP
+	srcPort, dstPort uint16
+	protocol         uint8
+	tcpFlags         uint8
+	tos              uint8
+	vlanID           uint16
+	input, output    uint32
+	bytes, packets   int64
+}
+
+func (r *ipfixRecord) templateID() uint16 {
+	if r.srcIP.To4() != nil {
+		return ipfixTemplateIPv4
+	}
+	return ipfixTemplateIPv6
+}
+
+func (r *ipfixRecord) encode(b []byte) []byte {
+	b = ipfix.AppendUint64(b, uint64(r.start.UnixNano()/int64(time.Millisecond)))
+	b = ipfix.AppendUint64(b, uint64(r.end.UnixNano()/int64(time.Millisecond)))
+	if r.templateID() == ipfixTemplateIPv4 {
+		b = append(b, r.srcIP.To4()...)
+		b = append(b, r.dstIP.To4()...)
+	} else {
+		b = append(b, r.srcIP.To16()...)
+		b = append(b, r.dstIP.To16()...)
+	}
+	b = ipfix.AppendUint16(b, r.srcPort)
+	b = ipfix.AppendUint16(b, r.dstPort)
+	b = append(b, r.protocol)
+	b = ipfix.AppendUint16(b, uint16(r.tcpFlags))
+	b = append(b, r.tos)
+	b = ipfix.AppendUint16(b, r.vlanID)
+	b = ipfix.AppendUint32(b, r.input)
+	b = ipfix.AppendUint32(b, r.output)
+	b = ipfix.AppendUint64(b, uint64(r.bytes))
+	b = ipfix.AppendUint64(b, uint64(r.packets))
+	return b
+}
+
+// ipfixWriter 为消息的发送方式，open 在每次发送前调用，
+// 新建连接或者新文件时返回 true，需要先发送模板
+type ipfixWriter interface {
+	open(now time.Time) (bool, error)
+	write(msg []byte) error
+	close()
+}
+
+type ipfixOutput struct {
+	config          ipfixConfig
+	writer          ipfixWriter
+	encoder         *ipfix.Encoder
+	templateRefresh time.Duration
+	flushInterval   time.Duration
+	maxRecords      int // 一个消息中最多的数据记录数量，按 IPv6 模板计算
+	lastTemplate    time.Time
+	// pending 为每个模板等待发送的数据记录，count 为记录数量
+	pending map[uint16][]byte
+	count   map[uint16]int
+	records chan ipfixRecord
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newIPFIXOutput(config map[interface{}]interface{}) topology.OutputWorker {
+	c := ipfixConfig{
+		Protocol:        ipfixProtocolUDP,
+		NewFileInterval: "1h",
+		TemplateRefresh: "1m",
+		FlushInterval:   "1s",
+		ChannelSize:     1024,
+	}
+	if err := mapstructure.Decode(config, &c); err != nil {
+		log.Fatalw("decode ipfix config failed", "error", err)
+	}
+	durations := make(map[string]time.Duration, 3)
+	for name, v := range map[string]string{
+		"new_file_interval": c.NewFileInterval,
+		"template_refresh":  c.TemplateRefresh,
+		"flush_interval":    c.FlushInterval,
+	} {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalw("invalid duration in ipfix config", "option", name, "value", v)
+		}
+		durations[name] = d
+	}
+	if c.MaxMessageSize == 0 {
+		c.MaxMessageSize = 65535
+		if c.Protocol == ipfixProtocolUDP {
+			c.MaxMessageSize = 1400
+		}
+	}
+	recordLength := ipfixTemplates[1].RecordLength()
+	maxRecords := (c.MaxMessageSize - ipfix.HeaderLength - ipfix.SetHeaderLength) / recordLength
+	if c.MaxMessageSize > 65535 || maxRecords < 1 {
+		log.Fatalw("invalid max_message_size in ipfix config", "max_message_size", c.MaxMessageSize)
+	}
+	var writer ipfixWriter
+	switch c.Protocol {
+	case ipfixProtocolUDP:
+		conn, err := net.Dial("udp", c.Addr)
+		if err != nil {
+			log.Fatalw("dial ipfix collector failed", "addr", c.Addr, "error", err)
+		}
+		writer = &ipfixUDPWriter{conn: conn}
+	case ipfixProtocolTCP:
+		if c.Addr == "" {
+			log.Fatal("addr is required for ipfix over tcp")
+		}
+		writer = &ipfixTCPWriter{addr: c.Addr}
+	case ipfixProtocolFile:
+		if err := os.MkdirAll(c.FileDir, 0755); err != nil {
+			log.Fatalw("create ipfix file dir failed", "file_dir", c.FileDir, "error", err)
+		}
+		writer = &ipfixFileWriter{dir: c.FileDir, interval: durations["new_file_interval"]}
+	default:
+		log.Fatalw("invalid protocol in ipfix config", "protocol", c.Protocol)
+	}
+	o := &ipfixOutput{
+		config:          c,
+		writer:          writer,
+		encoder:         ipfix.NewEncoder(c.DomainID),
+		templateRefresh: durations["template_refresh"],
+		flushInterval:   durations["flush_interval"],
+		maxRecords:      maxRecords,
+		pending:         make(map[uint16][]byte, len(ipfixTemplates)),
+		count:           make(map[uint16]int, len(ipfixTemplates)),
+		records:         make(chan ipfixRecord, c.ChannelSize),
+		done:            make(chan struct{}),
+	}
+	o.wg.Add(1)
+	go o.run()
+	return o
+}
+
+// Emit 将流记录或者数据包事件转换为 IPFIX 数据记录，没有 IP 地址的事件忽略
+func (o *ipfixOutput) Emit(event map[string]interface{}) {
+	for _, r := range ipfixRecords(event) {
+		select {
+		case o.records <- r:
+		case <-o.done:
+			return
+		}
+	}
+}
+
+// ipfixRecords 转换一个事件，流记录的反方向流量作为另一条记录
+func ipfixRecords(event map[string]interface{}) []ipfixRecord {
+	srcIP, _ := event["src_ip"].(string)
+	dstIP, _ := event["dst_ip"].(string)
+	r := ipfixRecord{
+		srcIP: net.ParseIP(srcIP),
+		dstIP: net.ParseIP(dstIP),
+	}
+	if r.srcIP == nil || r.dstIP == nil || (r.srcIP.To4() == nil) != (r.dstIP.To4() == nil) {
+		return nil
+	}
+	srcPort, _ := int64Of(event["src_port"])
+	dstPort, _ := int64Of(event["dst_port"])
+	protocol, _ := int64Of(event["protocol"])
+	tcpFlags, _ := int64Of(event["tcp_flags"])
+	dscp, _ := int64Of(event["dscp"])
+	ecn, _ := int64Of(event["ecn"])
+	vlanID, _ := int64Of(event["vlan_id"])
+	input, _ := int64Of(event["input_interface"])
+	output, _ := int64Of(event["output_interface"])
+	r.srcPort, r.dstPort = uint16(srcPort), uint16(dstPort)
+	r.protocol = uint8(protocol)
+	r.tcpFlags = uint8(tcpFlags)
+	r.tos = uint8(dscp<<2 | ecn&0x03)
+	r.vlanID = uint16(vlanID)
+	r.input, r.output = uint32(input), uint32(output)
+	createTime, _ := event["create_time"].(time.Time)
+	if event["type"] != flowRecordType {
+		var ok bool
+		if r.bytes, ok = int64Of(event["pack_size"]); !ok {
+			return nil
+		}
+		r.packets = 1
+		if rate, ok := int64Of(event["sampling_rate"]); ok && rate > 1 {
+			r.bytes *= rate
+			r.packets = rate
+		}
+		r.start, r.end = createTime, createTime
+		return []ipfixRecord{r}
+	}
+	r.start, _ = event["first_seen"].(time.Time)
+	r.end, _ = event["last_seen"].(time.Time)
+	if r.end.IsZero() {
+		r.end = createTime
+	}
+	if r.start.IsZero() {
+		r.start = r.end
+	}
+	r.bytes, _ = int64Of(event["bytes"])
+	r.packets, _ = int64Of(event["packets"])
+	records := make([]ipfixRecord, 0, 2)
+	if r.packets > 0 {
+		records = append(records, r)
+	}
+	reverse := r
+	reverse.srcIP, reverse.dstIP = r.dstIP, r.srcIP
+	reverse.srcPort, reverse.dstPort = r.dstPort, r.srcPort
+	reverse.input, reverse.output = r.output, r.input
+	reverse.bytes, _ = int64Of(event["reverse_bytes"])
+	reverse.packets, _ = int64Of(event["reverse_packets"])
+	if reverse.packets > 0 {
+		records = append(records, reverse)
+	}
+	return records
+}
+
+func (o *ipfixOutput) run() {
+	defer o.wg.Done()
+	ticker := time.NewTicker(o.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case r := <-o.records:
+			o.add(r)
+		case <-ticker.C:
+			o.flush()
+		case <-o.done:
+			// 发送 Shutdown 之前已经收到的记录
+			for len(o.records) > 0 {
+				o.add(<-o.records)
+			}
+			o.flush()
+			o.writer.close()
+			return
+		}
+	}
+}
+
+func (o *ipfixOutput) add(r ipfixRecord) {
+	id := r.templateID()
+	if o.count[id] >= o.maxRecords {
+		o.flush()
+	}
+	o.pending[id] = r.encode(o.pending[id])
+	o.count[id]++
+}
+
+// flush 发送所有等待的数据记录，需要时先发送模板，发送失败的记录丢弃
+func (o *ipfixOutput) flush() {
+	now := time.Now()
+	fresh, err := o.writer.open(now)
+	if err != nil {
+		log.Errorw("open ipfix writer failed", "error", err)
+		o.drop()
+		return
+	}
+	if fresh || (o.config.Protocol == ipfixProtocolUDP && now.Sub(o.lastTemplate) >= o.templateRefresh) {
+		if err := o.writer.write(o.encoder.TemplateMessage(now, ipfixTemplates)); err != nil {
+			log.Errorw("write ipfix template failed", "error", err)
+			o.drop()
+			return
+		}
+		o.lastTemplate = now
+	}
+	for _, t := range ipfixTemplates {
+		if o.count[t.ID] == 0 {
+			continue
+		}
+		msg := o.encoder.DataMessage(now, t.ID, o.pending[t.ID], o.count[t.ID])
+		if err := o.writer.write(msg); err != nil {
+			log.Errorw("write ipfix data failed", "records", o.count[t.ID], "error", err)
+		}
+	}
+	o.drop()
+}
+
+func (o *ipfixOutput) drop() {
+	for id := range o.pending {
+		o.pending[id] = o.pending[id][:0]
+		o.count[id] = 0
+	}
+}
+
+func (o *ipfixOutput) Shutdown() {
+	close(o.done)
+	o.wg.Wait()
+}
+
+type ipfixUDPWriter struct {
+	conn    net.Conn
+	started bool
+}
+
+func (w *ipfixUDPWriter) open(now time.Time) (bool, error) {
+	fresh := !w.started
+	w.started = true
+	return fresh, nil
+}
+
+func (w *ipfixUDPWriter) write(msg []byte) error {
+	_, err := w.conn.Write(msg)
+	return err
+}
+
+func (w *ipfixUDPWriter) close() {
+	w.conn.Close()
+}
+
+// ipfixTCPWriter 在连接断开后的下一次发送时重新连接
+type ipfixTCPWriter struct {
+	addr string
+	conn net.Conn
+}
+
+func (w *ipfixTCPWriter) open(now time.Time) (bool, error) {
+	if w.conn != nil {
+		return false, nil
+	}
+	conn, err := net.DialTimeout("tcp", w.addr, 5*time.Second)
+	if err != nil {
+		return false, err
+	}
+	w.conn = conn
+	return true, nil
+}
+
+func (w *ipfixTCPWriter) write(msg []byte) error {
+	if w.conn == nil {
+		return fmt.Errorf("not connected to %s", w.addr)
+	}
+	if _, err := w.conn.Write(msg); err != nil {
+		w.close()
+		return err
+	}
+	return nil
+}
+
+func (w *ipfixTCPWriter) close() {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+}
+
+// ipfixFileWriter 按时间创建文件，每个文件以模板开始，可以单独被 collector 读取
+type ipfixFileWriter struct {
+	dir      string
+	interval time.Duration
+	file     *os.File
+	end      time.Time // 当前文件的结束时间
+}
+
+func (w *ipfixFileWriter) open(now time.Time) (bool, error) {
+	if w.file != nil && now.Before(w.end) {
+		return false, nil
+	}
+	w.close()
+	name := filepath.Join(w.dir, now.Format("20060102150405")+".ipfix")
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return false, err
+	}
+	w.file = f
+	w.end = now.Truncate(w.interval).Add(w.interval)
+	return true, nil
+}
+
+func (w *ipfixFileWriter) write(msg []byte) error {
+	_, err := w.file.Write(msg)
+	return err
+}
+
+func (w *ipfixFileWriter) close() {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+}
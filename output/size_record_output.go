@@ -26,8 +26,20 @@ type sizeRecordConfig struct {
 	Interval   string `mapstructure:"interval"`
 	Timeout    string `mapstructure:"timeout"`
 	RetryTimes int    `mapstructure:"retry_times"`
+	NonIPTable string `mapstructure:"non_ip_table"` // 非 IP 流量的统计表，为空时丢弃非 IP 流量
+	// 隧道流量按哪一层的 IP 统计，可选 outer 或 inner，默认为 outer，
+	// inner 时使用 inner_src_ip 和 inner_dst_ip，没有解封装的数据包仍然使用外层 IP
+	IPLayer string `mapstructure:"ip_layer"`
 }
 
+// flowRecordType 为流记录事件的 type，与 input/flow 中的 RecordType 相同
+const flowRecordType = "flow"
+
+const (
+	ipLayerOuter = "outer"
+	ipLayerInner = "inner"
+)
+
 /*
 CREATE TABLE interval_traffic
 (
@@ -59,14 +71,48 @@ type intervalPacketSizeDB struct {
 	CreateTime  int64
 }
 
+/*
+CREATE TABLE interval_non_ip_traffic
+(
+
+	    `device` String,
+			`start_time` Int64,
+			`end_time` Int64,
+			`ether_type` UInt16,
+			`src_mac` String,
+			`dst_mac` String,
+			`packet_size` Int64,
+			`packet_count` Int64,
+			`create_time` Int64
+
+)
+ENGINE = MergeTree
+PARTITION BY toYYYYMM(toDateTime(create_time))
+ORDER BY create_time
+SETTINGS index_granularity = 8192
+*/
+type intervalNonIPSizeDB struct {
+	// 时间统计规则与 intervalPacketSizeDB 相同
+	Device      string
+	StartTime   int64
+	EndTime     int64
+	EtherType   uint16
+	SrcMAC      string
+	DstMAC      string
+	PacketSize  int64
+	PacketCount int64
+	CreateTime  int64
+}
+
 type sizeRecordOuput struct {
 	db         *gorm.DB
 	interval   int64 // 时间间隔，单位为秒
 	mux        sync.Mutex
 	config     sizeRecordConfig
 	idxSizeMap map[int64]map[string]*intervalPacketSizeDB
-	startTime  int64 // 程序启动时刻的时间戳
-	timeout    int64 // 超时时间
+	idxNonIP   map[int64]map[string]*intervalNonIPSizeDB // 非 IP 流量，按 EtherType 和 MAC 统计
+	startTime  int64                                     // 程序启动时刻的时间戳
+	timeout    int64                                     // 超时时间
 	exit       chan struct{}
 }
 
@@ -79,6 +125,12 @@ func newSizeRecordOutput(config map[interface{}]interface{}) topology.OutputWork
 	if c.Interval == "" {
 		c.Interval = "1m"
 	}
+	if c.IPLayer == "" {
+		c.IPLayer = ipLayerOuter
+	}
+	if c.IPLayer != ipLayerOuter && c.IPLayer != ipLayerInner {
+		log.Fatalw("invalid ip_layer in size record config", "ip_layer", c.IPLayer)
+	}
 	interval, err := time.ParseDuration(c.Interval)
 	if err != nil {
 		log.Fatalw("parse duration error", "duration", c.Interval, "error", err)
@@ -103,6 +155,7 @@ func newSizeRecordOutput(config map[interface{}]interface{}) topology.OutputWork
 		interval:   int64(interval.Seconds()),
 		config:     c,
 		idxSizeMap: make(map[int64]map[string]*intervalPacketSizeDB, 0),
+		idxNonIP:   make(map[int64]map[string]*intervalNonIPSizeDB, 0),
 		startTime:  time.Now().Unix(),
 		exit:       make(chan struct{}),
 		timeout:    int64(timeout.Seconds()),
@@ -121,9 +174,33 @@ func (o *sizeRecordOuput) Emit(event map[string]interface{}) {
 	}
 	createTimeUnix := createTime.Unix()
 	var device, srcIP, dstIP string
-	device = event["device"].(string)        // 因为input部分已经确保了device不为空且为string类型，故该处直接转换
-	packetSize := event["pack_size"].(int32) // 因为input部分已经确保了pack_size不为空且为int32类型，故该处直接转换
-	ip := event["src_ip"]
+	device = event["device"].(string) // 因为input部分已经确保了device不为空且为string类型，故该处直接转换
+	// 流记录包含两个方向的字节数和数据包数，分别统计
+	var packetSize, packetCount, reverseSize, reverseCount int64
+	if event["type"] == flowRecordType {
+		packetSize, _ = int64Of(event["bytes"])
+		packetCount, _ = int64Of(event["packets"])
+		reverseSize, _ = int64Of(event["reverse_bytes"])
+		reverseCount, _ = int64Of(event["reverse_packets"])
+	} else {
+		// 抓包统计等内部事件没有 pack_size，不参与统计
+		if packetSize, ok = int64Of(event["pack_size"]); !ok {
+			return
+		}
+		packetCount = 1
+		// sFlow 等采样得到的数据包按采样率换算为实际流量
+		if rate, ok := int64Of(event["sampling_rate"]); ok && rate > 1 {
+			packetSize *= rate
+			packetCount = rate
+		}
+	}
+	srcField, dstField := "src_ip", "dst_ip"
+	if o.config.IPLayer == ipLayerInner {
+		if v, _ := event["inner_src_ip"].(string); v != "" {
+			srcField, dstField = "inner_src_ip", "inner_dst_ip"
+		}
+	}
+	ip := event[srcField]
 	if ip != nil {
 		srcIP, ok = ip.(string)
 		if !ok {
@@ -131,7 +208,7 @@ func (o *sizeRecordOuput) Emit(event map[string]interface{}) {
 			return
 		}
 	}
-	ip = event["dst_ip"]
+	ip = event[dstField]
 	if ip != nil {
 		dstIP, ok = ip.(string)
 		if !ok {
@@ -140,7 +217,11 @@ func (o *sizeRecordOuput) Emit(event map[string]interface{}) {
 		}
 	}
 	if srcIP == "" && dstIP == "" {
-		log.Warn("src_ip and dst_ip are all empty")
+		if o.config.NonIPTable == "" {
+			log.Warn("src_ip and dst_ip are all empty")
+			return
+		}
+		o.emitNonIP(event, device, createTimeUnix, packetSize, packetCount)
 		return
 	}
 	if (srcIP == "" && dstIP != "") || (srcIP != "" && dstIP == "") {
@@ -153,47 +234,163 @@ func (o *sizeRecordOuput) Emit(event map[string]interface{}) {
 	}
 
 	idx := periodIdx(createTimeUnix, o.startTime, o.interval)
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if packetCount > 0 {
+		o.add(idx, device, srcIP, dstIP, packetSize, packetCount)
+	}
+	if reverseCount > 0 {
+		o.add(idx, device, dstIP, srcIP, reverseSize, reverseCount)
+	}
+}
+
+// add 将数据包计入某个周期内某个方向的统计，调用方需持有锁
+func (o *sizeRecordOuput) add(idx int64, device, srcIP, dstIP string, packetSize, packetCount int64) {
 	direction := fmt.Sprintf("%s_%s_%s", device, srcIP, dstIP)
-	s := &intervalPacketSizeDB{
+	if o.idxSizeMap[idx] == nil {
+		o.idxSizeMap[idx] = make(map[string]*intervalPacketSizeDB)
+	}
+	if s := o.idxSizeMap[idx][direction]; s != nil {
+		s.PacketSize += packetSize
+		s.PacketCount += packetCount
+		return
+	}
+	o.idxSizeMap[idx][direction] = &intervalPacketSizeDB{
 		Device:      device,
 		StartTime:   startTimeOfIdx(o.startTime, idx, o.interval),
 		EndTime:     endTimeOfIdx(o.startTime, idx, o.interval),
 		SrcIP:       srcIP,
 		DstIP:       dstIP,
-		PacketSize:  int64(packetSize),
-		PacketCount: 1,
+		PacketSize:  packetSize,
+		PacketCount: packetCount,
+	}
+}
+
+// emitNonIP 统计 ARP、LLDP、STP 等非 IP 流量，按设备、EtherType 和 MAC 聚合
+func (o *sizeRecordOuput) emitNonIP(event map[string]interface{}, device string, createTimeUnix int64, packetSize, packetCount int64) {
+	if _, ok := event["ether_type"]; !ok {
+		// 没有 ether_type 时所有非 IP 流量都会聚合到 0，统计没有意义
+		log.Errorw("non-IP event without ether_type, drop it", "device", device)
+		return
 	}
+	etherType, ok := etherTypeOf(event["ether_type"])
+	if !ok {
+		log.Errorw("failed to parse ether_type from event", "ether_type", event["ether_type"])
+		return
+	}
+	// MAC 字段可能未输出，此时按空字符串聚合
+	srcMAC, _ := event["src_mac"].(string)
+	dstMAC, _ := event["dst_mac"].(string)
+	if createTimeUnix < time.Now().Unix()-o.timeout {
+		log.Errorw("data is outdated", "create_time", createTimeUnix, "now", time.Now())
+		return
+	}
+
+	idx := periodIdx(createTimeUnix, o.startTime, o.interval)
+	key := fmt.Sprintf("%s_%d_%s_%s", device, etherType, srcMAC, dstMAC)
 	o.mux.Lock()
 	defer o.mux.Unlock()
-	if o.idxSizeMap[idx] == nil {
-		o.idxSizeMap[idx] = map[string]*intervalPacketSizeDB{
-			direction: s,
-		}
-	} else {
-		if o.idxSizeMap[idx][direction] == nil {
-			o.idxSizeMap[idx][direction] = s
-		} else {
-			o.idxSizeMap[idx][direction].PacketSize += int64(packetSize)
-			o.idxSizeMap[idx][direction].PacketCount++
-		}
+	if o.idxNonIP[idx] == nil {
+		o.idxNonIP[idx] = make(map[string]*intervalNonIPSizeDB)
+	}
+	if s := o.idxNonIP[idx][key]; s != nil {
+		s.PacketSize += packetSize
+		s.PacketCount += packetCount
+		return
+	}
+	o.idxNonIP[idx][key] = &intervalNonIPSizeDB{
+		Device:      device,
+		StartTime:   startTimeOfIdx(o.startTime, idx, o.interval),
+		EndTime:     endTimeOfIdx(o.startTime, idx, o.interval),
+		EtherType:   etherType,
+		SrcMAC:      srcMAC,
+		DstMAC:      dstMAC,
+		PacketSize:  packetSize,
+		PacketCount: packetCount,
 	}
 }
 
+// etherTypeOf 兼容不同输入得到的 ether_type 类型
+func etherTypeOf(v interface{}) (uint16, bool) {
+	n, ok := int64Of(v)
+	return uint16(n), ok
+}
+
+// int64Of 将数值字段转换为 int64，抓包得到的事件与 json 等格式解析得到的事件中数值类型不同
+func int64Of(v interface{}) (int64, bool) {
+	switch t := v.(type) {
+	case int32:
+		return int64(t), true
+	case int64:
+		return t, true
+	case int:
+		return int64(t), true
+	case uint8:
+		return int64(t), true
+	case uint16:
+		return int64(t), true
+	case uint32:
+		return int64(t), true
+	case uint64:
+		return int64(t), true
+	case float64:
+		return int64(t), true
+	}
+	return 0, false
+}
+
 func (o *sizeRecordOuput) Shutdown() {
 	// return
 	o.exit <- struct{}{}
-	listToCreate := make([]intervalPacketSizeDB, 0)
 	o.mux.Lock()
-	defer o.mux.Unlock()
-	for idx := range o.idxSizeMap {
+	listToCreate, nonIPToCreate := o.takeIdx(o.allIdx())
+	o.mux.Unlock()
+	o.create(o.config.CKTable, &listToCreate, len(listToCreate))
+	o.create(o.config.NonIPTable, &nonIPToCreate, len(nonIPToCreate))
+}
+
+// takeIdx 取出并删除指定周期的统计数据，调用方需持有锁
+func (o *sizeRecordOuput) takeIdx(idxList []int64) ([]intervalPacketSizeDB, []intervalNonIPSizeDB) {
+	listToCreate := make([]intervalPacketSizeDB, 0)
+	nonIPToCreate := make([]intervalNonIPSizeDB, 0)
+	now := time.Now().Unix()
+	for _, idx := range idxList {
 		for _, directionToSize := range o.idxSizeMap[idx] {
-			directionToSize.CreateTime = time.Now().Unix()
+			directionToSize.CreateTime = now
 			listToCreate = append(listToCreate, *directionToSize)
 		}
 		delete(o.idxSizeMap, idx)
+		for _, s := range o.idxNonIP[idx] {
+			s.CreateTime = now
+			nonIPToCreate = append(nonIPToCreate, *s)
+		}
+		delete(o.idxNonIP, idx)
+	}
+	return listToCreate, nonIPToCreate
+}
+
+// create 批量写入 clickhouse，配置了 retry_times 时失败会重试
+func (o *sizeRecordOuput) create(table string, list interface{}, size int) {
+	if size == 0 {
+		return
+	}
+	if o.config.RetryTimes == 0 {
+		if err := o.db.Table(table).Create(list).Error; err != nil {
+			log.Errorw("clickhouse batch write error", "table", table, "error", err)
+		}
+		return
+	}
+	var err error
+	for i := 0; i < o.config.RetryTimes; i++ {
+		err = o.db.Table(table).Create(list).Error
+		if err == nil {
+			break
+		}
+		// 间隔1秒后重试
+		time.Sleep(time.Second)
 	}
-	if err := o.db.Table(o.config.CKTable).Create(&listToCreate).Error; err != nil {
-		log.Errorw("clickhouse batch write error", "error", err)
+	if err != nil {
+		log.Errorw("clickhouse batch write error", "table", table, "error", err, "tried_times", o.config.RetryTimes)
 	}
 }
 
@@ -211,35 +408,12 @@ func (o *sizeRecordOuput) witeToDB() {
 			// fmt.Println("...........<-ticker.C:......")
 			t := time.Now().Unix() - o.timeout
 			idxList := o.allIdxToWrite(t)
-			listToCreate := make([]intervalPacketSizeDB, 0)
 			o.mux.Lock()
-			for _, idx := range idxList {
-				for _, directionToSize := range o.idxSizeMap[idx] {
-					directionToSize.CreateTime = time.Now().Unix()
-					listToCreate = append(listToCreate, *directionToSize)
-				}
-				delete(o.idxSizeMap, idx)
-			}
+			listToCreate, nonIPToCreate := o.takeIdx(idxList)
 			o.mux.Unlock()
 			// fmt.Println("......listToCreate........", listToCreate)
-			if o.config.RetryTimes == 0 {
-				if err := o.db.Table(o.config.CKTable).Create(&listToCreate).Error; err != nil {
-					log.Errorw("clickhouse batch write error", "error", err)
-				}
-			} else {
-				var err error
-				for i := 0; i < o.config.RetryTimes; i++ {
-					err = o.db.Table(o.config.CKTable).Create(&listToCreate).Error
-					if err == nil {
-						break
-					}
-					// 间隔1秒后重试
-					time.Sleep(time.Second)
-				}
-				if err != nil {
-					log.Errorw("clickhouse batch write error", "error", err, "tried_times", o.config.RetryTimes)
-				}
-			}
+			o.create(o.config.CKTable, &listToCreate, len(listToCreate))
+			o.create(o.config.NonIPTable, &nonIPToCreate, len(nonIPToCreate))
 		}
 	}
 }
@@ -254,6 +428,25 @@ func (o *sizeRecordOuput) allIdxToWrite(t int64) []int64 {
 			r = append(r, k)
 		}
 	}
+	for k := range o.idxNonIP {
+		if k <= idx && o.idxSizeMap[k] == nil {
+			r = append(r, k)
+		}
+	}
+	return r
+}
+
+// allIdx 返回所有未写入的周期，调用方需持有锁
+func (o *sizeRecordOuput) allIdx() []int64 {
+	var r = make([]int64, 0)
+	for k := range o.idxSizeMap {
+		r = append(r, k)
+	}
+	for k := range o.idxNonIP {
+		if o.idxSizeMap[k] == nil {
+			r = append(r, k)
+		}
+	}
 	return r
 }
 
@@ -0,0 +1,143 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 连接建立（TLS 握手之后）时发送方先发送 hello 帧，之后发送 batch 帧，接收方对每个 batch 回复 ack 帧，
+// 处理 batch 期间（如 pipeline 阻塞）定期回复 progress 帧。
+// 每个帧为 4 字节的长度（大端，不包括长度本身）、1 字节的类型和数据：
+//
+//	hello: 1 字节的协议版本和发送方的 ID，接收方按 ID 丢弃重连后重复发送的 batch
+//	batch: 8 字节的序号和 gzip 压缩的事件，每个事件为一行 JSON
+//	ack:   8 字节的序号，表示该序号及之前的 batch 已经被接收
+//	progress: 8 字节的序号，格式与 ack 相同，表示接收方仍在处理该 batch，发送方收到后重新计算等待 ack 的时间
+const (
+	Version = 1
+
+	FrameHello = 1
+	FrameBatch = 2
+	FrameAck   = 3
+	// FrameProgress 为接收方处理 batch 期间发送的帧
+	FrameProgress = 4
+
+	// DefaultMaxFrameSize 为接收方默认允许的最大帧长度
+	DefaultMaxFrameSize = 64 << 20
+)
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// WriteFrame 写入一个帧
+func WriteFrame(w io.Writer, frameType byte, payload []byte) error {
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)+1))
+	header[4] = frameType
+	if _, err := w.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReadFrame 读取一个帧，长度超过 maxSize 时返回 ErrFrameTooLarge
+func ReadFrame(r io.Reader, maxSize int) (byte, []byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header)
+	if n == 0 {
+		return 0, nil, errors.New("empty frame")
+	}
+	if int64(n) > int64(maxSize) {
+		return 0, nil, ErrFrameTooLarge
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return 0, nil, err
+	}
+	return frame[0], frame[1:], nil
+}
+
+func EncodeHello(id string) []byte {
+	return append([]byte{Version}, id...)
+}
+
+func DecodeHello(payload []byte) (string, error) {
+	if len(payload) < 1 {
+		return "", errors.New("short hello frame")
+	}
+	if payload[0] != Version {
+		return "", fmt.Errorf("unsupported version %d", payload[0])
+	}
+	return string(payload[1:]), nil
+}
+
+// EncodeBatch 压缩一批事件，events 中每个元素为一个 JSON 编码的事件，不能包含换行符
+func EncodeBatch(seq uint64, events [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	seqBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(seqBytes, seq)
+	buf.Write(seqBytes)
+	zw := gzip.NewWriter(&buf)
+	for _, e := range events {
+		if _, err := zw.Write(e); err != nil {
+			return nil, err
+		}
+		if _, err := zw.Write([]byte{'\n'}); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeBatch 解压一批事件，maxSize 为解压后的最大长度
+func DecodeBatch(payload []byte, maxSize int) (uint64, [][]byte, error) {
+	if len(payload) < 8 {
+		return 0, nil, errors.New("short batch frame")
+	}
+	seq := binary.BigEndian.Uint64(payload)
+	zr, err := gzip.NewReader(bytes.NewReader(payload[8:]))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(io.LimitReader(zr, int64(maxSize)+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) > maxSize {
+		return 0, nil, ErrFrameTooLarge
+	}
+	var events [][]byte
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(nil, len(data)+1)
+	for s.Scan() {
+		// Scanner 会复用缓冲区，每个事件需要复制
+		if len(s.Bytes()) > 0 {
+			events = append(events, append([]byte(nil), s.Bytes()...))
+		}
+	}
+	return seq, events, s.Err()
+}
+
+func EncodeAck(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
+
+func DecodeAck(payload []byte) (uint64, error) {
+	if len(payload) != 8 {
+		return 0, errors.New("invalid ack frame")
+	}
+	return binary.BigEndian.Uint64(payload), nil
+}
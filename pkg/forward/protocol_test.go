@@ -0,0 +1,101 @@
+package forward
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testEvents 返回 n 个不同的事件，每个事件约 size 字节
+func testEvents(n, size int) [][]byte {
+	events := make([][]byte, n)
+	for i := range events {
+		events[i] = []byte(fmt.Sprintf(`{"n":%d,"data":%q}`, i, strings.Repeat(fmt.Sprint(i%10), size)))
+	}
+	return events
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		events [][]byte
+	}{
+		{name: "empty"},
+		{name: "small", events: testEvents(3, 10)},
+		// 解压后超过 bufio.Scanner 的初始缓冲区 4KB，缓冲区扩容和移动时不能改变已经返回的事件
+		{name: "larger than 4KB", events: testEvents(200, 100)},
+		{name: "event larger than 4KB", events: testEvents(5, 10000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := EncodeBatch(42, tt.events)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seq, events, err := DecodeBatch(payload, DefaultMaxFrameSize)
+			if err != nil {
+				t.Fatalf("DecodeBatch: %v", err)
+			}
+			if seq != 42 {
+				t.Errorf("seq = %d, want 42", seq)
+			}
+			if len(events) != len(tt.events) {
+				t.Fatalf("decoded %d events, want %d", len(events), len(tt.events))
+			}
+			for i := range events {
+				if !bytes.Equal(events[i], tt.events[i]) {
+					t.Fatalf("event %d = %.60s..., want %.60s...", i, events[i], tt.events[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeBatchTooLarge(t *testing.T) {
+	payload, err := EncodeBatch(1, testEvents(10, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DecodeBatch(payload, 5000); err != ErrFrameTooLarge {
+		t.Errorf("DecodeBatch error = %v, want %v", err, ErrFrameTooLarge)
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, FrameHello, EncodeHello("sender")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFrame(&buf, FrameAck, EncodeAck(7)); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFrame(&buf, FrameBatch, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	frameType, payload, err := ReadFrame(&buf, 100)
+	if err != nil || frameType != FrameHello {
+		t.Fatalf("ReadFrame = %d, %v, want hello", frameType, err)
+	}
+	if id, err := DecodeHello(payload); err != nil || id != "sender" {
+		t.Errorf("DecodeHello = %q, %v", id, err)
+	}
+	frameType, payload, err = ReadFrame(&buf, 100)
+	if err != nil || frameType != FrameAck {
+		t.Fatalf("ReadFrame = %d, %v, want ack", frameType, err)
+	}
+	if seq, err := DecodeAck(payload); err != nil || seq != 7 {
+		t.Errorf("DecodeAck = %d, %v", seq, err)
+	}
+	// 长度包括 1 字节的类型
+	if _, _, err := ReadFrame(&buf, 100); err != ErrFrameTooLarge {
+		t.Errorf("ReadFrame error = %v, want %v", err, ErrFrameTooLarge)
+	}
+}
+
+func TestDecodeHelloVersion(t *testing.T) {
+	if _, err := DecodeHello(append([]byte{Version + 1}, "sender"...)); err == nil {
+		t.Error("DecodeHello accepted an unsupported version")
+	}
+}
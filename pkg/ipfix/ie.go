@@ -0,0 +1,34 @@
+package ipfix
+
+// 常用的信息元素（Information Element）编号，NetFlow v9 的字段类型与 IPFIX 的编号相同，
+// 参考 https://www.iana.org/assignments/ipfix/ipfix.xhtml
+const (
+	IEOctetDeltaCount          uint16 = 1
+	IEPacketDeltaCount         uint16 = 2
+	IEProtocolIdentifier       uint16 = 4
+	IEIPClassOfService         uint16 = 5
+	IETCPControlBits           uint16 = 6
+	IESourceTransportPort      uint16 = 7
+	IESourceIPv4Address        uint16 = 8
+	IEIngressInterface         uint16 = 10
+	IEDestinationTransportPort uint16 = 11
+	IEDestinationIPv4Address   uint16 = 12
+	IEEgressInterface          uint16 = 14
+	IEFlowEndSysUpTime         uint16 = 21
+	IEFlowStartSysUpTime       uint16 = 22
+	IESourceIPv6Address        uint16 = 27
+	IEDestinationIPv6Address   uint16 = 28
+	IESamplingInterval         uint16 = 34
+	IESamplerRandomInterval    uint16 = 50
+	IEVLANID                   uint16 = 58
+	IEIPVersion                uint16 = 60
+	IEFlowStartSeconds         uint16 = 150
+	IEFlowEndSeconds           uint16 = 151
+	IEFlowStartMilliseconds    uint16 = 152
+	IEFlowEndMilliseconds      uint16 = 153
+	IESamplingPacketInterval   uint16 = 305
+	IESamplingPacketSpace      uint16 = 306
+)
+
+// VariableLength 为 IPFIX 模板中变长字段的长度
+const VariableLength = 65535
@@ -0,0 +1,110 @@
+package ipfix
+
+import (
+	"time"
+)
+
+const (
+	Version = 10
+
+	HeaderLength    = 16
+	SetHeaderLength = 4
+
+	TemplateSetID        = 2
+	OptionsTemplateSetID = 3
+	// MinDataSetID 为数据 set 和模板的最小编号，小于该值的编号为保留值
+	MinDataSetID = 256
+)
+
+// Field 为模板中的一个定长字段
+type Field struct {
+	ID     uint16
+	Length uint16
+}
+
+// Template 为一个数据模板，数据记录按字段顺序编码
+type Template struct {
+	ID     uint16
+	Fields []Field
+}
+
+// RecordLength 为按该模板编码的一条数据记录的长度
+func (t *Template) RecordLength() int {
+	n := 0
+	for _, f := range t.Fields {
+		n += int(f.Length)
+	}
+	return n
+}
+
+func (t *Template) length() int {
+	return 4 + 4*len(t.Fields)
+}
+
+// Encoder 编码一个 observation domain 的 IPFIX 消息，记录已经发送的数据记录数量作为序列号，
+// Encoder 不能在多个 goroutine 中同时使用
+type Encoder struct {
+	domain   uint32
+	sequence uint32
+}
+
+func NewEncoder(domain uint32) *Encoder {
+	return &Encoder{domain: domain}
+}
+
+// TemplateMessage 编码只包含模板 set 的消息
+func (e *Encoder) TemplateMessage(exportTime time.Time, templates []Template) []byte {
+	length := HeaderLength + SetHeaderLength
+	for i := range templates {
+		length += templates[i].length()
+	}
+	b := make([]byte, 0, length)
+	b = e.header(b, exportTime, length)
+	b = AppendUint16(b, TemplateSetID)
+	b = AppendUint16(b, uint16(length-HeaderLength))
+	for _, t := range templates {
+		b = AppendUint16(b, t.ID)
+		b = AppendUint16(b, uint16(len(t.Fields)))
+		for _, f := range t.Fields {
+			b = AppendUint16(b, f.ID)
+			b = AppendUint16(b, f.Length)
+		}
+	}
+	return b
+}
+
+// DataMessage 编码只包含一个数据 set 的消息，records 为按模板编码后依次拼接的数据记录，
+// 序列号增加 count
+func (e *Encoder) DataMessage(exportTime time.Time, templateID uint16, records []byte, count int) []byte {
+	length := HeaderLength + SetHeaderLength + len(records)
+	b := make([]byte, 0, length)
+	b = e.header(b, exportTime, length)
+	b = AppendUint16(b, templateID)
+	b = AppendUint16(b, uint16(SetHeaderLength+len(records)))
+	b = append(b, records...)
+	e.sequence += uint32(count)
+	return b
+}
+
+// header 编码消息头，序列号为此前发送的数据记录数量，不包括本消息中的记录
+func (e *Encoder) header(b []byte, exportTime time.Time, length int) []byte {
+	b = AppendUint16(b, Version)
+	b = AppendUint16(b, uint16(length))
+	b = AppendUint32(b, uint32(exportTime.Unix()))
+	b = AppendUint32(b, e.sequence)
+	b = AppendUint32(b, e.domain)
+	return b
+}
+
+// AppendUint16 等函数按网络字节序追加整数，用于编码数据记录
+func AppendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func AppendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func AppendUint64(b []byte, v uint64) []byte {
+	return AppendUint32(AppendUint32(b, uint32(v>>32)), uint32(v))
+}
@@ -0,0 +1,85 @@
+package iptrie
+
+import (
+	"net"
+)
+
+// Trie 为 IPv4 和 IPv6 前缀的二进制基数树，Lookup 返回最长匹配的前缀的值，
+// Insert 和 Lookup 不能同时调用，需要更新时构建新的 Trie 后替换
+type Trie struct {
+	v4   *node
+	v6   *node
+	size int
+}
+
+type node struct {
+	children [2]*node
+	prefix   *net.IPNet
+	value    interface{}
+}
+
+func New() *Trie {
+	return &Trie{v4: &node{}, v6: &node{}}
+}
+
+// Len 返回前缀的数量
+func (t *Trie) Len() int {
+	return t.size
+}
+
+// Insert 插入一个前缀，IPv4 映射的 IPv6 前缀按 IPv4 处理，相同的前缀覆盖之前的值，覆盖时返回 true
+func (t *Trie) Insert(prefix *net.IPNet, value interface{}) bool {
+	ones, _ := prefix.Mask.Size()
+	ip := prefix.IP
+	root := t.v6
+	if v4 := ip.To4(); v4 != nil {
+		if len(prefix.Mask) == net.IPv6len && ones >= 96 {
+			ones -= 96
+		}
+		ip, root = v4, t.v4
+	}
+	n := root
+	for i := 0; i < ones; i++ {
+		b := bit(ip, i)
+		if n.children[b] == nil {
+			n.children[b] = &node{}
+		}
+		n = n.children[b]
+	}
+	replaced := n.prefix != nil
+	if !replaced {
+		t.size++
+	}
+	n.prefix = &net.IPNet{IP: ip.Mask(net.CIDRMask(ones, len(ip)*8)), Mask: net.CIDRMask(ones, len(ip)*8)}
+	n.value = value
+	return replaced
+}
+
+// Lookup 返回包含 ip 的最长前缀和对应的值
+func (t *Trie) Lookup(ip net.IP) (*net.IPNet, interface{}, bool) {
+	root := t.v6
+	if v4 := ip.To4(); v4 != nil {
+		ip, root = v4, t.v4
+	} else if len(ip) != net.IPv6len {
+		return nil, nil, false
+	}
+	var match *node
+	n := root
+	for i := 0; n != nil; i++ {
+		if n.prefix != nil {
+			match = n
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		n = n.children[bit(ip, i)]
+	}
+	if match == nil {
+		return nil, nil, false
+	}
+	return match.prefix, match.value, true
+}
+
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
@@ -0,0 +1,102 @@
+package iptrie
+
+import (
+	"net"
+	"testing"
+)
+
+func mustCIDR(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	_, prefix, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prefix
+}
+
+func TestTrieLookup(t *testing.T) {
+	trie := New()
+	for _, cidr := range []string{
+		"0.0.0.0/0",
+		"10.0.0.0/8",
+		"10.1.0.0/16",
+		"10.1.2.3/32",
+		"::/0",
+		"2001:db8::/32",
+		"2001:db8:1::/48",
+		"2001:db8:1::1/128",
+		// IPv4 映射的前缀按 IPv4 的 192.168.0.0/16 插入
+		"::ffff:192.168.0.0/112",
+	} {
+		if trie.Insert(mustCIDR(t, cidr), cidr) {
+			t.Fatalf("Insert(%s) replaced a prefix", cidr)
+		}
+	}
+	if trie.Len() != 9 {
+		t.Errorf("Len = %d, want 9", trie.Len())
+	}
+	tests := []struct {
+		ip         string
+		wantPrefix string
+		wantValue  string
+	}{
+		{"10.1.2.3", "10.1.2.3/32", "10.1.2.3/32"},
+		{"10.1.2.4", "10.1.0.0/16", "10.1.0.0/16"},
+		{"10.2.0.1", "10.0.0.0/8", "10.0.0.0/8"},
+		{"11.0.0.1", "0.0.0.0/0", "0.0.0.0/0"},
+		{"255.255.255.255", "0.0.0.0/0", "0.0.0.0/0"},
+		{"::ffff:10.1.2.4", "10.1.0.0/16", "10.1.0.0/16"},
+		{"192.168.5.5", "192.168.0.0/16", "::ffff:192.168.0.0/112"},
+		{"2001:db8:1::1", "2001:db8:1::1/128", "2001:db8:1::1/128"},
+		{"2001:db8:1::2", "2001:db8:1::/48", "2001:db8:1::/48"},
+		{"2001:db8:2::1", "2001:db8::/32", "2001:db8::/32"},
+		{"2002::1", "::/0", "::/0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			prefix, value, ok := trie.Lookup(net.ParseIP(tt.ip))
+			if !ok {
+				t.Fatal("Lookup found nothing")
+			}
+			if prefix.String() != tt.wantPrefix || value != tt.wantValue {
+				t.Errorf("Lookup = %s, %v, want %s, %s", prefix, value, tt.wantPrefix, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestTrieNoMatch(t *testing.T) {
+	trie := New()
+	trie.Insert(mustCIDR(t, "10.0.0.0/8"), "v4")
+	trie.Insert(mustCIDR(t, "2001:db8::/32"), "v6")
+	for _, ip := range []net.IP{
+		net.ParseIP("11.0.0.1"),
+		net.ParseIP("2001:db9::1"),
+		// IPv4 的前缀不匹配 IPv6 地址，即使低 32 位相同
+		net.ParseIP("::a00:1"),
+		net.IP{10, 0, 0},
+		nil,
+	} {
+		if prefix, _, ok := trie.Lookup(ip); ok {
+			t.Errorf("Lookup(%v) = %s, want no match", ip, prefix)
+		}
+	}
+}
+
+func TestTrieInsertReplaces(t *testing.T) {
+	trie := New()
+	trie.Insert(mustCIDR(t, "10.1.0.0/16"), "a")
+	// 掩码后相同的前缀和 IPv4 映射的写法都覆盖之前的值
+	if !trie.Insert(mustCIDR(t, "10.1.5.0/16"), "b") {
+		t.Error("Insert(10.1.5.0/16) did not replace 10.1.0.0/16")
+	}
+	if !trie.Insert(mustCIDR(t, "::ffff:10.1.0.0/112"), "c") {
+		t.Error("Insert(::ffff:10.1.0.0/112) did not replace 10.1.0.0/16")
+	}
+	if trie.Len() != 1 {
+		t.Errorf("Len = %d, want 1", trie.Len())
+	}
+	if _, value, _ := trie.Lookup(net.ParseIP("10.1.2.3")); value != "c" {
+		t.Errorf("value = %v, want c", value)
+	}
+}
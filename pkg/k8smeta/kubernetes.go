@@ -0,0 +1,233 @@
+package k8smeta
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// apiPod 为 Kubernetes API 返回的 pod 中使用的字段
+type apiPod struct {
+	Metadata struct {
+		UID               string            `json:"uid"`
+		Name              string            `json:"name"`
+		Namespace         string            `json:"namespace"`
+		Labels            map[string]string `json:"labels"`
+		CreationTimestamp time.Time         `json:"creationTimestamp"`
+		ResourceVersion   string            `json:"resourceVersion"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName    string `json:"nodeName"`
+		HostNetwork bool   `json:"hostNetwork"`
+	} `json:"spec"`
+	Status struct {
+		Phase  string `json:"phase"`
+		PodIP  string `json:"podIP"`
+		PodIPs []struct {
+			IP string `json:"ip"`
+		} `json:"podIPs"`
+	} `json:"status"`
+}
+
+type apiPodList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []apiPod `json:"items"`
+}
+
+type apiWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// apiStatus 为 watch 返回的 ERROR 事件，410 表示 resourceVersion 已经过期，需要重新 list
+type apiStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// toPod 转换 API 返回的 pod，hostNetwork 的 pod 使用节点的 IP，不参与按 IP 查找；
+// 已经结束的 pod 不再占用 IP，Ended 为 now
+func (p *apiPod) toPod(now time.Time) (Pod, bool) {
+	if p.Spec.HostNetwork {
+		return Pod{}, false
+	}
+	ips := make([]string, 0, len(p.Status.PodIPs)+1)
+	for _, ip := range p.Status.PodIPs {
+		ips = append(ips, ip.IP)
+	}
+	if len(ips) == 0 && p.Status.PodIP != "" {
+		ips = append(ips, p.Status.PodIP)
+	}
+	if len(ips) == 0 {
+		return Pod{}, false
+	}
+	pod := Pod{
+		UID:       p.Metadata.UID,
+		Name:      p.Metadata.Name,
+		Namespace: p.Metadata.Namespace,
+		Node:      p.Spec.NodeName,
+		IPs:       ips,
+		Labels:    p.Metadata.Labels,
+		Created:   p.Metadata.CreationTimestamp,
+	}
+	if p.Status.Phase == "Succeeded" || p.Status.Phase == "Failed" {
+		pod.Ended = now
+	}
+	return pod, true
+}
+
+// APIConfig 为访问 Kubernetes API 的配置，在集群中运行时默认使用 service account
+type APIConfig struct {
+	Server        string // 如 https://10.96.0.1:443
+	Token         string
+	FieldSelector string // 如 spec.nodeName=node1，只关注部分 pod
+	Client        *http.Client
+}
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// InClusterServer 返回集群中运行时 API server 的地址、token 文件和 CA 文件
+func InClusterServer() (server, tokenFile, caFile string, err error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return "", "", "", errors.New("not running in a kubernetes cluster")
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return "https://" + host + ":" + port, serviceAccountDir + "/token", serviceAccountDir + "/ca.crt", nil
+}
+
+// Watcher 先 list 所有 pod，再从返回的 resourceVersion 开始 watch，watch 断开后继续 watch，
+// resourceVersion 过期或者出错时重新 list
+type Watcher struct {
+	config  APIConfig
+	store   *Store
+	onError func(error)
+}
+
+func NewWatcher(config APIConfig, store *Store, onError func(error)) *Watcher {
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	return &Watcher{config: config, store: store, onError: onError}
+}
+
+// Run 持续同步直到 ctx 结束，出错后等待 backoff 再重试
+func (w *Watcher) Run(ctx context.Context, backoff time.Duration) {
+	for ctx.Err() == nil {
+		rv, err := w.list(ctx)
+		for err == nil && ctx.Err() == nil {
+			rv, err = w.watch(ctx, rv)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		w.onError(err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func (w *Watcher) request(ctx context.Context, query url.Values) (*http.Response, error) {
+	if w.config.FieldSelector != "" {
+		query.Set("fieldSelector", w.config.FieldSelector)
+	}
+	u := strings.TrimSuffix(w.config.Server, "/") + "/api/v1/pods?" + query.Encode()
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if w.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.config.Token)
+	}
+	resp, err := w.config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+func (w *Watcher) list(ctx context.Context) (string, error) {
+	resp, err := w.request(ctx, url.Values{})
+	if err != nil {
+		return "", fmt.Errorf("list pods: %v", err)
+	}
+	defer resp.Body.Close()
+	var list apiPodList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", fmt.Errorf("decode pod list: %v", err)
+	}
+	now := time.Now()
+	pods := make([]Pod, 0, len(list.Items))
+	for i := range list.Items {
+		if p, ok := list.Items[i].toPod(now); ok {
+			pods = append(pods, p)
+		}
+	}
+	w.store.Replace(pods, now)
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch 处理 watch 事件直到连接断开，返回最后的 resourceVersion
+func (w *Watcher) watch(ctx context.Context, rv string) (string, error) {
+	resp, err := w.request(ctx, url.Values{
+		"watch":               {"true"},
+		"resourceVersion":     {rv},
+		"allowWatchBookmarks": {"true"},
+	})
+	if err != nil {
+		return rv, fmt.Errorf("watch pods: %v", err)
+	}
+	defer resp.Body.Close()
+	d := json.NewDecoder(resp.Body)
+	for {
+		var event apiWatchEvent
+		if err := d.Decode(&event); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return rv, nil
+			}
+			return rv, fmt.Errorf("decode watch event: %v", err)
+		}
+		if event.Type == "ERROR" {
+			var status apiStatus
+			json.Unmarshal(event.Object, &status)
+			return rv, fmt.Errorf("watch error %d: %s", status.Code, status.Message)
+		}
+		var p apiPod
+		if err := json.Unmarshal(event.Object, &p); err != nil {
+			return rv, fmt.Errorf("decode watch object: %v", err)
+		}
+		if p.Metadata.ResourceVersion != "" {
+			rv = p.Metadata.ResourceVersion
+		}
+		now := time.Now()
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			if pod, ok := p.toPod(now); ok {
+				w.store.Upsert(pod)
+			}
+		case "DELETED":
+			w.store.End(p.Metadata.UID, now)
+		}
+	}
+}
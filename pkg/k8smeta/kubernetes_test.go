@@ -0,0 +1,185 @@
+package k8smeta
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	// web-0 在 created0 创建，被删除后 IP 10.1.0.5 被 web-1 在 created1 复用
+	created0 = time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC)
+	created1 = created0.Add(time.Hour)
+)
+
+// podJSON 返回 API 格式的 pod，spec 为 spec 中 nodeName 之后的字段
+func podJSON(uid, name, ip string, created time.Time, rv string, spec string) string {
+	return fmt.Sprintf(`{"metadata":{"uid":%q,"name":%q,"namespace":"default","labels":{"app":%q},`+
+		`"creationTimestamp":%q,"resourceVersion":%q},"spec":{"nodeName":"node1"%s},`+
+		`"status":{"phase":"Running","podIP":%q,"podIPs":[{"ip":%q}]}}`,
+		uid, name, name, created.Format(time.RFC3339), rv, spec, ip, ip)
+}
+
+func watchEvent(eventType, object string) string {
+	return fmt.Sprintf(`{"type":%q,"object":%s}`+"\n", eventType, object)
+}
+
+// fakeAPIServer 依次返回两次 list 和三次 watch，记录每次 watch 的 resourceVersion
+type fakeAPIServer struct {
+	t        *testing.T
+	lock     sync.Mutex
+	lists    int
+	watchRVs []string
+	// relisted 在第二次 list 之后开始 watch 时关闭
+	relisted chan struct{}
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/v1/pods" {
+		http.NotFound(w, r)
+		return
+	}
+	if got := r.Header.Get("Authorization"); got != "Bearer token" {
+		s.t.Errorf("Authorization = %q", got)
+	}
+	query := r.URL.Query()
+	if got := query.Get("fieldSelector"); got != "spec.nodeName=node1" {
+		s.t.Errorf("fieldSelector = %q", got)
+	}
+	s.lock.Lock()
+	if query.Get("watch") != "true" {
+		s.lists++
+		lists := s.lists
+		s.lock.Unlock()
+		s.list(w, lists)
+		return
+	}
+	rv := query.Get("resourceVersion")
+	s.watchRVs = append(s.watchRVs, rv)
+	s.lock.Unlock()
+	switch rv {
+	case "100":
+		fmt.Fprint(w,
+			watchEvent("ADDED", podJSON("uid-db", "db-0", "10.1.0.7", created0, "101", ""))+
+				watchEvent("MODIFIED", strings.Replace(podJSON("uid-web-0", "web-0", "10.1.0.5", created0, "102", ""),
+					`"app":"web-0"`, `"app":"web-0","version":"2"`, 1))+
+				watchEvent("DELETED", podJSON("uid-web-0", "web-0", "10.1.0.5", created0, "103", ""))+
+				watchEvent("BOOKMARK", `{"metadata":{"resourceVersion":"104"}}`))
+		// 连接正常结束，从 BOOKMARK 的 resourceVersion 继续 watch
+	case "104":
+		fmt.Fprint(w,
+			watchEvent("ADDED", podJSON("uid-web-1", "web-1", "10.1.0.5", created1, "105", ""))+
+				watchEvent("ERROR", `{"kind":"Status","code":410,"message":"too old resource version: 104 (150)"}`))
+	default:
+		w.(http.Flusher).Flush()
+		close(s.relisted)
+		<-r.Context().Done()
+	}
+}
+
+func (s *fakeAPIServer) list(w http.ResponseWriter, lists int) {
+	var items []string
+	rv := "100"
+	if lists == 1 {
+		items = []string{
+			podJSON("uid-web-0", "web-0", "10.1.0.5", created0, "90", ""),
+			podJSON("uid-cache-0", "cache-0", "10.1.0.6", created0, "91", ""),
+			podJSON("uid-node-exporter", "node-exporter", "192.168.0.10", created0, "92", `,"hostNetwork":true`),
+		}
+	} else {
+		// 重新 list 时 cache-0 已经被删除
+		rv = "200"
+		items = []string{
+			podJSON("uid-db", "db-0", "10.1.0.7", created0, "101", ""),
+			podJSON("uid-web-1", "web-1", "10.1.0.5", created1, "105", ""),
+		}
+	}
+	fmt.Fprintf(w, `{"kind":"PodList","metadata":{"resourceVersion":%q},"items":[%s]}`, rv, strings.Join(items, ","))
+}
+
+func TestWatcher(t *testing.T) {
+	api := &fakeAPIServer{t: t, relisted: make(chan struct{})}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	store := NewStore(time.Hour)
+	var errs []error
+	var errLock sync.Mutex
+	watcher := NewWatcher(APIConfig{
+		Server:        server.URL,
+		Token:         "token",
+		FieldSelector: "spec.nodeName=node1",
+	}, store, func(err error) {
+		errLock.Lock()
+		defer errLock.Unlock()
+		errs = append(errs, err)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		watcher.Run(ctx, 10*time.Millisecond)
+		close(stopped)
+	}()
+	select {
+	case <-api.relisted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for relist")
+	}
+	afterRelist := time.Now()
+	cancel()
+	<-stopped
+
+	api.lock.Lock()
+	if api.lists != 2 {
+		t.Errorf("listed %d times, want 2", api.lists)
+	}
+	if got := strings.Join(api.watchRVs, ","); got != "100,104,200" {
+		t.Errorf("watch resourceVersions = %s, want 100,104,200", got)
+	}
+	api.lock.Unlock()
+	errLock.Lock()
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "410") {
+		t.Errorf("errors = %v, want one 410 error", errs)
+	}
+	errLock.Unlock()
+
+	tests := []struct {
+		name    string
+		ip      string
+		at      time.Time
+		wantUID string
+	}{
+		// web-0 被删除前的事件仍然关联到 web-0，web-1 创建后的事件关联到 web-1
+		{"before ip reuse", "10.1.0.5", created1.Add(-time.Minute), "uid-web-0"},
+		{"after ip reuse", "10.1.0.5", created1.Add(time.Minute), "uid-web-1"},
+		{"now", "10.1.0.5", afterRelist, "uid-web-1"},
+		{"added by watch", "10.1.0.7", afterRelist, "uid-db"},
+		// 重新 list 时不存在的 pod 结束，结束之前的事件仍然可以关联
+		{"ended by relist", "10.1.0.6", created1, "uid-cache-0"},
+		{"after end by relist", "10.1.0.6", afterRelist.Add(time.Minute), ""},
+		{"host network", "192.168.0.10", afterRelist, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod, ok := store.Lookup(tt.ip, tt.at)
+			if tt.wantUID == "" {
+				if ok {
+					t.Errorf("Lookup(%s) = %s, want none", tt.ip, pod.UID)
+				}
+				return
+			}
+			if !ok || pod.UID != tt.wantUID {
+				t.Errorf("Lookup(%s) = %q, %v, want %s", tt.ip, pod.UID, ok, tt.wantUID)
+			}
+		})
+	}
+	web0, _ := store.Lookup("10.1.0.5", created0)
+	if web0.Labels["version"] != "2" || web0.Ended.IsZero() || web0.Ended.After(afterRelist) {
+		t.Errorf("web-0 = %+v, want MODIFIED labels and ended by DELETED", web0)
+	}
+}
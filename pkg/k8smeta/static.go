@@ -0,0 +1,74 @@
+package k8smeta
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+// staticPod 为 JSON 文件或 HTTP 接口中简化的 pod 格式
+type staticPod struct {
+	UID       string            `json:"uid"`
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace"`
+	Node      string            `json:"node"`
+	IP        string            `json:"ip"`
+	IPs       []string          `json:"ips"`
+	Labels    map[string]string `json:"labels"`
+	Created   time.Time         `json:"created"`
+}
+
+// DecodePods 解析完整的 pod 列表，支持 kubectl get pods -A -o json 输出的 PodList，
+// 以及简化格式的数组，如 [{"name": "web-0", "namespace": "default", "node": "node1", "ip": "10.244.1.5", "labels": {"app": "web"}}]，
+// 简化格式没有 uid 时以 namespace/name 区分 pod
+func DecodePods(data []byte, now time.Time) ([]Pod, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var pods []Pod
+	switch data[0] {
+	case '{':
+		var list apiPodList
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			if p, ok := list.Items[i].toPod(now); ok {
+				pods = append(pods, p)
+			}
+		}
+	case '[':
+		var list []staticPod
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		for _, s := range list {
+			ips := s.IPs
+			if s.IP != "" {
+				ips = append([]string{s.IP}, ips...)
+			}
+			if len(ips) == 0 {
+				continue
+			}
+			uid := s.UID
+			if uid == "" {
+				uid = s.Namespace + "/" + s.Name
+			}
+			pods = append(pods, Pod{
+				UID:       uid,
+				Name:      s.Name,
+				Namespace: s.Namespace,
+				Node:      s.Node,
+				IPs:       ips,
+				Labels:    s.Labels,
+				Created:   s.Created,
+			})
+		}
+	default:
+		return nil, errors.New("expect a PodList object or an array of pods")
+	}
+	return pods, nil
+}
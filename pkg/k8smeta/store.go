@@ -0,0 +1,130 @@
+package k8smeta
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Pod 为按 IP 查找的 pod 信息，Ended 为 pod 被删除或者结束（不再占用 IP）的时间，运行中的 pod 为零值
+type Pod struct {
+	UID       string
+	Name      string
+	Namespace string
+	Node      string
+	IPs       []string
+	Labels    map[string]string
+	Created   time.Time
+	Ended     time.Time
+}
+
+// Store 保存每个 IP 的 pod 历史，IP 被新的 pod 复用后，时间早于新 pod 创建时间的事件仍然关联到旧的 pod，
+// 结束超过 retention 的 pod 在 Expire 时删除
+type Store struct {
+	lock      sync.RWMutex
+	retention time.Duration
+	pods      map[string]*Pod   // uid 对应的 pod
+	byIP      map[string][]*Pod // 按 Created 排序
+}
+
+func NewStore(retention time.Duration) *Store {
+	return &Store{
+		retention: retention,
+		pods:      make(map[string]*Pod),
+		byIP:      make(map[string][]*Pod),
+	}
+}
+
+// Upsert 添加或者更新一个 pod，pod 的 IP 变化时更新索引
+func (s *Store) Upsert(p Pod) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if old, ok := s.pods[p.UID]; ok {
+		// 已经结束的 pod 不再恢复，避免晚到的更新覆盖删除
+		if !old.Ended.IsZero() && p.Ended.IsZero() {
+			p.Ended = old.Ended
+		}
+		s.unindex(old)
+	}
+	pod := &p
+	s.pods[p.UID] = pod
+	for _, ip := range p.IPs {
+		pods := append(s.byIP[ip], pod)
+		sort.SliceStable(pods, func(i, j int) bool { return pods[i].Created.Before(pods[j].Created) })
+		s.byIP[ip] = pods
+	}
+}
+
+// End 标记 pod 在 at 结束，之后的事件不再关联到该 pod
+func (s *Store) End(uid string, at time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if p, ok := s.pods[uid]; ok && p.Ended.IsZero() {
+		p.Ended = at
+	}
+}
+
+// Replace 以完整的 pod 列表更新，列表中没有的 pod 在 at 结束
+func (s *Store) Replace(pods []Pod, at time.Time) {
+	present := make(map[string]bool, len(pods))
+	for _, p := range pods {
+		present[p.UID] = true
+		s.Upsert(p)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for uid, p := range s.pods {
+		if !present[uid] && p.Ended.IsZero() {
+			p.Ended = at
+		}
+	}
+}
+
+// Expire 删除结束超过 retention 的 pod
+func (s *Store) Expire(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for uid, p := range s.pods {
+		if !p.Ended.IsZero() && now.Sub(p.Ended) > s.retention {
+			s.unindex(p)
+			delete(s.pods, uid)
+		}
+	}
+}
+
+func (s *Store) unindex(p *Pod) {
+	for _, ip := range p.IPs {
+		pods := s.byIP[ip]
+		for i, v := range pods {
+			if v == p {
+				pods = append(pods[:i:i], pods[i+1:]...)
+				break
+			}
+		}
+		if len(pods) == 0 {
+			delete(s.byIP, ip)
+		} else {
+			s.byIP[ip] = pods
+		}
+	}
+}
+
+// Lookup 返回 at 时使用该 IP 的 pod，即创建时间不晚于 at 并且在 at 时还没有结束的最新的 pod，
+// 没有时（如节点之间的时钟偏差）返回最新的运行中的 pod
+func (s *Store) Lookup(ip string, at time.Time) (Pod, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	pods := s.byIP[ip]
+	for i := len(pods) - 1; i >= 0; i-- {
+		p := pods[i]
+		if !p.Created.After(at) && (p.Ended.IsZero() || at.Before(p.Ended)) {
+			return *p, true
+		}
+	}
+	for i := len(pods) - 1; i >= 0; i-- {
+		if pods[i].Ended.IsZero() {
+			return *pods[i], true
+		}
+	}
+	return Pod{}, false
+}
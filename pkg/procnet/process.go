@@ -0,0 +1,104 @@
+package procnet
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Process 为进程的名称和所属的 cgroup，ContainerID 从 cgroup 路径中提取，不在容器中时为空
+type Process struct {
+	PID         int
+	Name        string
+	Cgroup      string
+	ContainerID string
+}
+
+// containerIDPattern 匹配 docker、containerd、cri-o 等在 cgroup 路径中使用的 64 位十六进制容器 ID
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// Pids 返回 procRoot 下所有进程的 pid
+func Pids(procRoot string) ([]int, error) {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+	pids := make([]int, 0, len(entries))
+	for _, e := range entries {
+		if pid, err := strconv.Atoi(e.Name()); err == nil && pid > 0 {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// SocketInodes 返回进程打开的所有 socket 的 inode，需要有读取该进程 fd 的权限
+func SocketInodes(procRoot string, pid int) ([]uint64, error) {
+	dir := filepath.Join(procRoot, strconv.Itoa(pid), "fd")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var inodes []uint64
+	for _, e := range entries {
+		link, err := os.Readlink(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue // fd 可能已经关闭
+		}
+		if inode, err := socketInode(link); err == nil {
+			inodes = append(inodes, inode)
+		}
+	}
+	return inodes, nil
+}
+
+// ReadProcess 读取进程的名称和 cgroup
+func ReadProcess(procRoot string, pid int) (Process, error) {
+	dir := filepath.Join(procRoot, strconv.Itoa(pid))
+	p := Process{PID: pid}
+	comm, err := os.ReadFile(filepath.Join(dir, "comm"))
+	if err != nil {
+		return p, err
+	}
+	p.Name = strings.TrimSpace(string(comm))
+	// 没有 cgroup 文件时只返回名称
+	if f, err := os.Open(filepath.Join(dir, "cgroup")); err == nil {
+		p.Cgroup = parseCgroup(f)
+		f.Close()
+		p.ContainerID = containerID(p.Cgroup)
+	}
+	return p, nil
+}
+
+// parseCgroup 返回 cgroup v2 的路径（0::），只有 cgroup v1 时返回第一个非空的路径，
+// 每行的格式为 hierarchy-ID:controller-list:cgroup-path
+func parseCgroup(f *os.File) string {
+	var first string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			return parts[2]
+		}
+		if first == "" && parts[2] != "/" {
+			first = parts[2]
+		}
+	}
+	return first
+}
+
+// containerID 返回 cgroup 路径中最后一个容器 ID，如
+// /system.slice/docker-<id>.scope 或 /kubepods/burstable/pod<uid>/<id>
+func containerID(cgroup string) string {
+	ids := containerIDPattern.FindAllString(cgroup, -1)
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[len(ids)-1]
+}
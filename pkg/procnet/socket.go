@@ -0,0 +1,144 @@
+package procnet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	ProtocolTCP = 6
+	ProtocolUDP = 17
+)
+
+// Socket 为 /proc/net/tcp 等文件中的一个 socket，只包含读取进程所在 network namespace 的 socket
+type Socket struct {
+	Protocol   uint8
+	LocalIP    net.IP
+	LocalPort  uint16
+	RemoteIP   net.IP
+	RemotePort uint16
+	State      uint8
+	// Inode 为 socket 的 inode，TIME_WAIT 等已经不属于任何进程的 socket 为 0
+	Inode uint64
+}
+
+// socketTables 为读取的文件、协议和是否为 IPv6
+var socketTables = []struct {
+	name     string
+	protocol uint8
+	ipv6     bool
+}{
+	{"tcp", ProtocolTCP, false},
+	{"tcp6", ProtocolTCP, true},
+	{"udp", ProtocolUDP, false},
+	{"udp6", ProtocolUDP, true},
+}
+
+// ReadSockets 读取 procRoot/net 下的 tcp、tcp6、udp 和 udp6，不存在的文件（如关闭了 IPv6）跳过
+func ReadSockets(procRoot string) ([]Socket, error) {
+	var sockets []Socket
+	for _, t := range socketTables {
+		f, err := os.Open(filepath.Join(procRoot, "net", t.name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		s, err := parseSocketTable(f, t.protocol, t.ipv6)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %v", t.name, err)
+		}
+		sockets = append(sockets, s...)
+	}
+	return sockets, nil
+}
+
+// parseSocketTable 解析 socket 表，第一行为表头，每行的格式如
+// 0: 0100007F:0050 00000000:0000 0A 00000000:00000000 00:00000000 00000000 0 0 12345 1 ...
+func parseSocketTable(r io.Reader, protocol uint8, ipv6 bool) ([]Socket, error) {
+	var sockets []Socket
+	s := bufio.NewScanner(r)
+	header := true
+	for s.Scan() {
+		if header {
+			header = false
+			continue
+		}
+		fields := strings.Fields(s.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		localIP, localPort, err := parseAddr(fields[1], ipv6)
+		if err != nil {
+			return nil, err
+		}
+		remoteIP, remotePort, err := parseAddr(fields[2], ipv6)
+		if err != nil {
+			return nil, err
+		}
+		state, err := strconv.ParseUint(fields[3], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid state (%s)", fields[3])
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid inode (%s)", fields[9])
+		}
+		sockets = append(sockets, Socket{
+			Protocol:   protocol,
+			LocalIP:    localIP,
+			LocalPort:  localPort,
+			RemoteIP:   remoteIP,
+			RemotePort: remotePort,
+			State:      uint8(state),
+			Inode:      inode,
+		})
+	}
+	return sockets, s.Err()
+}
+
+// parseAddr 解析十六进制的地址和端口，地址按 32 位分组，每组为主机字节序（小端）
+func parseAddr(s string, ipv6 bool) (net.IP, uint16, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return nil, 0, fmt.Errorf("invalid address (%s)", s)
+	}
+	b, err := hex.DecodeString(s[:i])
+	if err != nil || (ipv6 && len(b) != net.IPv6len) || (!ipv6 && len(b) != net.IPv4len) {
+		return nil, 0, fmt.Errorf("invalid address (%s)", s)
+	}
+	port, err := strconv.ParseUint(s[i+1:], 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port (%s)", s)
+	}
+	ip := make(net.IP, len(b))
+	for j := 0; j < len(b); j += 4 {
+		binary.BigEndian.PutUint32(ip[j:], binary.LittleEndian.Uint32(b[j:]))
+	}
+	// IPv4 映射的 IPv6 地址与 IPv4 地址按同一个地址处理
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	return ip, uint16(port), nil
+}
+
+var errNotSocket = errors.New("not a socket")
+
+// socketInode 解析 /proc/<pid>/fd 下符号链接的目标，如 socket:[12345]
+func socketInode(link string) (uint64, error) {
+	if !strings.HasPrefix(link, "socket:[") || !strings.HasSuffix(link, "]") {
+		return 0, errNotSocket
+	}
+	return strconv.ParseUint(link[len("socket:["):len(link)-1], 10, 64)
+}
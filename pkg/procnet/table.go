@@ -0,0 +1,195 @@
+package procnet
+
+import (
+	"net"
+	"sync"
+)
+
+// Table 维护本地 socket 到进程的映射，Refresh 定时调用，Lookup 可以在其他 goroutine 中同时调用
+type Table struct {
+	procRoot string
+
+	lock  sync.RWMutex
+	index map[socketKey]*Process
+	// local 为本机的地址，包括 socket 表中的本地地址和网卡的地址，只有本机地址才匹配绑定所有地址的 socket
+	local map[string]bool
+
+	// 以下字段只在 Refresh 中使用
+	owners    map[uint64]int // socket inode 对应的 pid
+	processes map[int]*Process
+	// unresolved 为扫描所有进程后仍然找不到所属进程的 socket（如属于没有权限读取的进程），
+	// socket 消失之前不再扫描，避免每次 Refresh 都扫描所有进程的 fd
+	unresolved map[uint64]bool
+}
+
+// socketKey 为已连接的 socket 的本地和远端地址，监听和未连接的 socket 的远端地址为空
+type socketKey struct {
+	protocol   uint8
+	localIP    string
+	localPort  uint16
+	remoteIP   string
+	remotePort uint16
+}
+
+func NewTable(procRoot string) *Table {
+	return &Table{
+		procRoot:   procRoot,
+		index:      make(map[socketKey]*Process),
+		local:      make(map[string]bool),
+		owners:     make(map[uint64]int),
+		processes:  make(map[int]*Process),
+		unresolved: make(map[uint64]bool),
+	}
+}
+
+// Refresh 重新读取 socket 表，只有出现未知的 socket 时才扫描进程的 fd，
+// 先扫描新出现的进程，找到所有 socket 的进程后停止；进程信息只在第一次出现时读取
+func (t *Table) Refresh() error {
+	sockets, err := ReadSockets(t.procRoot)
+	if err != nil {
+		return err
+	}
+	pids, err := Pids(t.procRoot)
+	if err != nil {
+		return err
+	}
+	alive := make(map[int]bool, len(pids))
+	for _, pid := range pids {
+		alive[pid] = true
+	}
+	for pid := range t.processes {
+		if !alive[pid] {
+			delete(t.processes, pid)
+		}
+	}
+	inodes := make(map[uint64]bool, len(sockets))
+	unknown := make(map[uint64]bool)
+	for _, s := range sockets {
+		if s.Inode == 0 {
+			continue
+		}
+		inodes[s.Inode] = true
+		if t.unresolved[s.Inode] {
+			continue
+		}
+		if pid, ok := t.owners[s.Inode]; !ok || !alive[pid] {
+			unknown[s.Inode] = true
+		}
+	}
+	for inode := range t.owners {
+		if !inodes[inode] || unknown[inode] {
+			delete(t.owners, inode)
+		}
+	}
+	for inode := range t.unresolved {
+		if !inodes[inode] {
+			delete(t.unresolved, inode)
+		}
+	}
+	if len(unknown) > 0 {
+		t.scan(pids, unknown)
+		for inode := range unknown {
+			t.unresolved[inode] = true
+		}
+	}
+	index := make(map[socketKey]*Process, len(sockets))
+	local := localAddrs()
+	for _, s := range sockets {
+		if !s.LocalIP.IsUnspecified() {
+			local[s.LocalIP.String()] = true
+		}
+		pid, ok := t.owners[s.Inode]
+		if !ok {
+			continue
+		}
+		p, ok := t.processes[pid]
+		if !ok {
+			process, err := ReadProcess(t.procRoot, pid)
+			if err != nil {
+				continue
+			}
+			p = &process
+			t.processes[pid] = p
+		}
+		k := socketKey{protocol: s.Protocol, localIP: s.LocalIP.String(), localPort: s.LocalPort}
+		if !s.RemoteIP.IsUnspecified() || s.RemotePort != 0 {
+			k.remoteIP, k.remotePort = s.RemoteIP.String(), s.RemotePort
+		}
+		index[k] = p
+	}
+	t.lock.Lock()
+	t.index = index
+	t.local = local
+	t.lock.Unlock()
+	return nil
+}
+
+// scan 扫描进程的 fd，找到 unknown 中 socket 所属的进程，找到的 socket 从 unknown 中删除
+func (t *Table) scan(pids []int, unknown map[uint64]bool) {
+	ordered := make([]int, 0, len(pids))
+	for _, pid := range pids {
+		if _, ok := t.processes[pid]; !ok {
+			ordered = append(ordered, pid)
+		}
+	}
+	for _, pid := range pids {
+		if _, ok := t.processes[pid]; ok {
+			ordered = append(ordered, pid)
+		}
+	}
+	for _, pid := range ordered {
+		inodes, err := SocketInodes(t.procRoot, pid)
+		if err != nil {
+			continue // 进程已经退出或者没有权限
+		}
+		for _, inode := range inodes {
+			if unknown[inode] {
+				t.owners[inode] = pid
+				delete(unknown, inode)
+			}
+		}
+		if len(unknown) == 0 {
+			return
+		}
+	}
+}
+
+// localAddrs 返回网卡的地址，proc_root 不是当前 network namespace 时可能不准确，由 socket 表中的地址补充
+func localAddrs() map[string]bool {
+	local := make(map[string]bool)
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return local
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			local[ipNet.IP.String()] = true
+		}
+	}
+	return local
+}
+
+// Lookup 返回本地地址和端口所属的进程，依次查找已连接的 socket、绑定该地址的 socket 和绑定所有地址的 socket，
+// 绑定所有地址的 socket 只匹配本机的地址，经过本机转发的流量不会关联到监听相同端口的进程
+func (t *Table) Lookup(protocol uint8, localIP net.IP, localPort uint16, remoteIP net.IP, remotePort uint16) (*Process, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	local := localIP.String()
+	keys := []socketKey{
+		{protocol: protocol, localIP: local, localPort: localPort, remoteIP: remoteIP.String(), remotePort: remotePort},
+		{protocol: protocol, localIP: local, localPort: localPort},
+	}
+	if t.local[local] || localIP.IsLoopback() {
+		keys = append(keys,
+			socketKey{protocol: protocol, localIP: net.IPv4zero.String(), localPort: localPort},
+			// IPv6 的 :: 同时接收 IPv4 的连接
+			socketKey{protocol: protocol, localIP: net.IPv6unspecified.String(), localPort: localPort},
+		)
+	}
+	for _, k := range keys {
+		if p, ok := t.index[k]; ok {
+			return p, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,217 @@
+package procnet
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		name     string
+		addr     string
+		ipv6     bool
+		wantIP   string
+		wantPort uint16
+		wantErr  bool
+	}{
+		{name: "ipv4 loopback", addr: "0100007F:0050", wantIP: "127.0.0.1", wantPort: 80},
+		{name: "ipv4", addr: "0900000A:C738", wantIP: "10.0.0.9", wantPort: 51000},
+		{name: "ipv6 unspecified", addr: "00000000000000000000000000000000:0016", ipv6: true, wantIP: "::", wantPort: 22},
+		{name: "ipv6", addr: "B80D0120000000000000000001000000:01BB", ipv6: true, wantIP: "2001:db8::1", wantPort: 443},
+		{name: "ipv4 mapped", addr: "0000000000000000FFFF00000200000A:01BB", ipv6: true, wantIP: "10.0.0.2", wantPort: 443},
+		{name: "no port", addr: "0100007F", wantErr: true},
+		{name: "ipv6 in ipv4 table", addr: "00000000000000000000000000000000:0016", wantErr: true},
+		{name: "invalid hex", addr: "0100007G:0050", wantErr: true},
+		{name: "invalid port", addr: "0100007F:10000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, port, err := parseAddr(tt.addr, tt.ipv6)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseAddr(%s) = %v:%d, want error", tt.addr, ip, port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseAddr(%s): %v", tt.addr, err)
+			}
+			if !ip.Equal(net.ParseIP(tt.wantIP)) || port != tt.wantPort {
+				t.Errorf("parseAddr(%s) = %v:%d, want %s:%d", tt.addr, ip, port, tt.wantIP, tt.wantPort)
+			}
+			// IPv4 映射的地址按 IPv4 处理，与 IPv4 socket 使用同一个 key
+			if strings.Contains(tt.wantIP, ".") && len(ip) != net.IPv4len {
+				t.Errorf("parseAddr(%s) returned %d bytes ip", tt.addr, len(ip))
+			}
+		})
+	}
+}
+
+func TestReadSockets(t *testing.T) {
+	sockets, err := ReadSockets("testdata/proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 没有 udp6 文件，跳过
+	count := map[uint8]int{}
+	for _, s := range sockets {
+		count[s.Protocol]++
+	}
+	if count[ProtocolTCP] != 7 || count[ProtocolUDP] != 1 {
+		t.Errorf("read %d tcp and %d udp sockets, want 7 and 1", count[ProtocolTCP], count[ProtocolUDP])
+	}
+	s := sockets[1]
+	if !s.LocalIP.Equal(net.IPv4(10, 0, 0, 2)) || s.LocalPort != 22 || !s.RemoteIP.Equal(net.IPv4(10, 0, 0, 9)) ||
+		s.RemotePort != 51000 || s.State != 1 || s.Inode != 2001 {
+		t.Errorf("second tcp socket = %+v", s)
+	}
+}
+
+// testdata/proc 中 nginx（pid 100，在 docker 容器中）监听 127.0.0.1:80 和 udp 0.0.0.0:53，
+// 有一个 IPv4 映射地址和一个 IPv6 地址的连接；sshd（pid 200）监听 [::]:22，有一个 IPv4 连接；
+// 监听 10.0.0.2:8080 的 socket 3001 不属于任何进程
+func TestTableLookup(t *testing.T) {
+	table := NewTable("testdata/proc")
+	if err := table.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		protocol   uint8
+		local      string
+		localPort  uint16
+		remote     string
+		remotePort uint16
+		wantPID    int
+	}{
+		{"bound address", ProtocolTCP, "127.0.0.1", 80, "127.0.0.1", 40000, 100},
+		{"connected", ProtocolTCP, "10.0.0.2", 22, "10.0.0.9", 51000, 200},
+		{"ipv6 any accepts ipv4", ProtocolTCP, "10.0.0.2", 22, "10.0.0.8", 50000, 200},
+		{"ipv4 mapped connected", ProtocolTCP, "10.0.0.2", 443, "10.0.0.9", 54321, 100},
+		{"ipv6 connected", ProtocolTCP, "2001:db8::1", 443, "2001:db8::2", 58016, 100},
+		{"udp ipv4 any", ProtocolUDP, "10.0.0.2", 53, "10.0.0.9", 40000, 100},
+		// 不是本机的地址，为经过本机转发的流量
+		{"ipv6 any ignores forwarded", ProtocolTCP, "192.0.2.1", 22, "10.0.0.8", 50000, 0},
+		{"udp ipv4 any ignores forwarded", ProtocolUDP, "192.0.2.1", 53, "10.0.0.9", 40000, 0},
+		{"time wait", ProtocolTCP, "10.0.0.2", 42000, "10.0.0.9", 80, 0},
+		{"unowned", ProtocolTCP, "10.0.0.2", 8080, "10.0.0.9", 40000, 0},
+		{"other protocol", ProtocolUDP, "127.0.0.1", 80, "127.0.0.1", 40000, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, ok := table.Lookup(tt.protocol, net.ParseIP(tt.local), tt.localPort, net.ParseIP(tt.remote), tt.remotePort)
+			if tt.wantPID == 0 {
+				if ok {
+					t.Errorf("Lookup found pid %d, want none", p.PID)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("Lookup found nothing, want pid %d", tt.wantPID)
+			}
+			if p.PID != tt.wantPID {
+				t.Errorf("Lookup pid = %d, want %d", p.PID, tt.wantPID)
+			}
+		})
+	}
+	nginx, _ := table.Lookup(ProtocolTCP, net.ParseIP("127.0.0.1"), 80, nil, 0)
+	if nginx.Name != "nginx" || nginx.ContainerID != "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef" {
+		t.Errorf("nginx process = %+v", nginx)
+	}
+	sshd, _ := table.Lookup(ProtocolTCP, net.ParseIP("10.0.0.2"), 22, nil, 0)
+	if sshd.Name != "sshd" || sshd.Cgroup != "/system.slice/sshd.service" || sshd.ContainerID != "" {
+		t.Errorf("sshd process = %+v", sshd)
+	}
+}
+
+func TestTableSkipsUnresolvedSockets(t *testing.T) {
+	root := copyTree(t, "testdata/proc")
+	table := NewTable(root)
+	if err := table.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if !table.unresolved[3001] || len(table.unresolved) != 1 {
+		t.Fatalf("unresolved = %v, want only 3001", table.unresolved)
+	}
+
+	// 之后出现的进程打开了该 socket，socket 仍然存在时不再扫描
+	addProcess(t, root, 300, "java", 3001)
+	if err := table.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := table.Lookup(ProtocolTCP, net.ParseIP("10.0.0.2"), 8080, nil, 0); ok {
+		t.Error("unresolved socket was scanned again")
+	}
+
+	// socket 消失后不再记录
+	tcp := filepath.Join(root, "net", "tcp")
+	data, err := os.ReadFile(tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if err := os.WriteFile(tcp, []byte(strings.Join(lines[:len(lines)-1], "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if len(table.unresolved) != 0 {
+		t.Errorf("unresolved = %v after the socket is closed", table.unresolved)
+	}
+}
+
+// copyTree 将 testdata 复制到临时目录，符号链接按原样复制
+func copyTree(t *testing.T, src string) string {
+	t.Helper()
+	dst := t.TempDir()
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.IsDir():
+			return os.MkdirAll(target, 0755)
+		default:
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(target, data, 0644)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dst
+}
+
+// addProcess 在 root 下添加一个打开了 socket inode 的进程
+func addProcess(t *testing.T, root string, pid int, name string, inode int) {
+	t.Helper()
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	if err := os.MkdirAll(filepath.Join(dir, "fd"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "comm"), []byte(name+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("socket:["+strconv.Itoa(inode)+"]", filepath.Join(dir, "fd", "3")); err != nil {
+		t.Fatal(err)
+	}
+}
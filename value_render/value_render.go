@@ -33,3 +33,21 @@ func getValueRender(template string) ValueRender {
 func GetBoolValueRender(template bool) ValueRender {
 	return NewBoolValueRender(template)
 }
+
+var matchPath, _ = regexp.Compile(`^(\[.*?\])+$`)
+var findPath, _ = regexp.Compile(`\[(.*?)\]`)
+
+// GetPathValueRender 按字段路径取值，[a][b] 的格式为多层字段，与 field_setter 相同，否则为一层字段
+func GetPathValueRender(path string) ValueRender {
+	if !matchPath.MatchString(path) {
+		return NewOneLevelValueRender(path)
+	}
+	fields := make([]string, 0)
+	for _, v := range findPath.FindAllStringSubmatch(path, -1) {
+		fields = append(fields, v[1])
+	}
+	if len(fields) == 1 {
+		return NewOneLevelValueRender(fields[0])
+	}
+	return NewMultiLevelValueRender(fields)
+}